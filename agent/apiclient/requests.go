@@ -1,44 +1,88 @@
 package apiclient
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/lucacoratu/ADTool/agent/logging"
 	"github.com/lucacoratu/ADTool/agent/models"
 )
 
+// Error returned when the API rejects the enrollment token (it is not valid or it was already used), retrying would not help
+var ErrEnrollmentRejected = errors.New("the API rejected the enrollment token")
+
 type APIClient struct {
-	baseURL string
-	logger  logging.ILogger
+	baseURL    string
+	logger     logging.ILogger
+	httpClient *http.Client
+}
+
+func NewAPIClient(logger logging.ILogger, baseURL string, tlsConfig *tls.Config) *APIClient {
+	httpClient := &http.Client{
+		Timeout:   time.Second * 30,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	return &APIClient{logger: logger, baseURL: baseURL, httpClient: httpClient}
 }
 
-func NewAPIClient(logger logging.ILogger, baseURL string) *APIClient {
-	return &APIClient{logger: logger, baseURL: baseURL}
+// Check if the API is reachable using the healthcheck endpoint
+func (ac *APIClient) Healthcheck() error {
+	response, err := ac.httpClient.Get(ac.baseURL + "/healthcheck")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.New("healthcheck returned status " + response.Status)
+	}
+	return nil
 }
 
-// Register a new agent to the api
-func (ac *APIClient) RegisterAgent(machineInfo models.MachineInformation) (int64, error) {
+// Register a new agent to the api using an enrollment token
+// The certificate request is optional, if it is sent the response also contains the client certificate
+// The response contains the id and the secret of the agent
+func (ac *APIClient) RegisterAgent(machineInfo models.MachineInformation, enrollmentToken string, certificateRequest string) (AgentRegisterResponse, error) {
 	//Send the request to the server to register the agent in the database
-	client := http.Client{}
 	url := ac.baseURL + "/agents"
-	marshaledData, err := json.Marshal(machineInfo)
+	resp := AgentRegisterResponse{}
+	registerReq := AgentRegisterRequest{MachineInformation: machineInfo, CertificateRequest: certificateRequest}
+	marshaledData, err := json.Marshal(registerReq)
 	//Check if an error occured
 	if err != nil {
-		return -1, err
+		return resp, err
+	}
+	request, err := http.NewRequest(http.MethodPost, url, strings.NewReader(string(marshaledData)))
+	if err != nil {
+		return resp, err
 	}
-	response, err := client.Post(url, "application/json", strings.NewReader(string(marshaledData)))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+enrollmentToken)
+	response, err := ac.httpClient.Do(request)
 	if err != nil {
-		return -1, err
+		return resp, err
+	}
+	defer response.Body.Close()
+
+	//Check if the API refused to register the agent
+	if response.StatusCode != http.StatusOK {
+		apiErr := APIError{}
+		apiErr.FromJSON(response.Body)
+		if response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden {
+			return resp, fmt.Errorf("%w, %s", ErrEnrollmentRejected, apiErr.Message)
+		}
+		return resp, errors.New("registration refused by the API, " + apiErr.Message)
 	}
 
-	resp := AgentRegisterResponse{}
 	err = resp.FromJSON(response.Body)
 	//Check if an error occured when parsing the response from the server
 	if err != nil {
-		return -1, err
+		return resp, err
 	}
 
-	return resp.AgentId, nil
+	return resp, nil
 }
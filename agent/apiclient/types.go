@@ -3,11 +3,22 @@ package apiclient
 import (
 	"encoding/json"
 	"io"
+
+	"github.com/lucacoratu/ADTool/agent/models"
 )
 
 type AgentRegisterResponse struct {
-	Status  string `json:"status"`
-	AgentId int64  `json:"agentId"`
+	Status      string `json:"status"`
+	AgentId     int64  `json:"agentId"`
+	Secret      string `json:"secret"`      //The secret used to authenticate on the websocket
+	Certificate string `json:"certificate"` //The PEM client certificate signed by the API (if a certificate request was sent)
+}
+
+// This structure holds the data sent to the API when registering
+// The machine information is embedded so the fields are at the top level of the JSON
+type AgentRegisterRequest struct {
+	models.MachineInformation
+	CertificateRequest string `json:"certificateRequest,omitempty"` //The PEM certificate signing request for the client certificate
 }
 
 func (arr *AgentRegisterResponse) FromJSON(r io.Reader) error {
@@ -19,3 +30,14 @@ func (arr *AgentRegisterResponse) ToJSON(w io.Writer) error {
 	e := json.NewEncoder(w)
 	return e.Encode(arr)
 }
+
+// This structure holds the error message that the api can send back
+type APIError struct {
+	Code    int64  `json:"code"`    //The code of the error
+	Message string `json:"message"` //The message of the error
+}
+
+func (ae *APIError) FromJSON(r io.Reader) error {
+	d := json.NewDecoder(r)
+	return d.Decode(ae)
+}
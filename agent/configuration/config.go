@@ -11,8 +11,15 @@ import (
 )
 
 type Configuration struct {
-	ServerURL string `json:"serverURL" validate:"required"` //The URL of the API
-	Id        int64  `json:"id"`                            //The id of the agent
+	ServerURL                    string `json:"serverURL" validate:"required"`                                      //The URL of the API
+	Id                           int64  `json:"id"`                                                                 //The id of the agent
+	Secret                       string `json:"secret"`                                                             //The secret received from the API when the agent was registered
+	EnrollmentToken              string `json:"enrollmentToken"`                                                    //The token created by an admin which allows the agent to register
+	ServerCertificateFingerprint string `json:"serverCertificateFingerprint"`                                       //The SHA256 fingerprint of the API certificate to pin (when using https)
+	UseClientCertificate         bool   `json:"useClientCertificate"`                                               //If the agent should request a client certificate when registering (mutual TLS)
+	ClientCertificate            string `json:"clientCertificate" validate:"required_if=UseClientCertificate true"` //The path where the client certificate is saved
+	ClientKey                    string `json:"clientKey" validate:"required_if=UseClientCertificate true"`         //The path where the private key of the client certificate is saved
+	ReconnectMaxDelay            int64  `json:"reconnectMaxDelay" validate:"gte=0"`                                 //The maximum delay between two connection attempts to the API in seconds (default 300)
 }
 
 // Load the configuration from a file
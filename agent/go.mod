@@ -2,13 +2,16 @@ module github.com/lucacoratu/ADTool/agent
 
 go 1.21.0
 
-require github.com/gorilla/websocket v1.5.1
+require (
+	github.com/creack/pty v1.1.24
+	github.com/go-playground/validator/v10 v10.19.0
+	github.com/gorilla/websocket v1.5.1
+)
 
 require (
 	github.com/gabriel-vasile/mimetype v1.4.3 // indirect
 	github.com/go-playground/locales v0.14.1 // indirect
 	github.com/go-playground/universal-translator v0.18.1 // indirect
-	github.com/go-playground/validator/v10 v10.19.0 // indirect
 	github.com/leodido/go-urn v1.4.0 // indirect
 	golang.org/x/crypto v0.19.0 // indirect
 	golang.org/x/net v0.21.0 // indirect
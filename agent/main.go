@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
-	"net/http"
+	"errors"
+	"fmt"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/lucacoratu/ADTool/agent/apiclient"
 	"github.com/lucacoratu/ADTool/agent/configuration"
@@ -16,26 +18,38 @@ import (
 func main() {
 	//Initialize the logger
 	logger := logging.NewDefaultDebugLogger()
-	//Verify the connection to the API via the healthcheck endpoint
-	client := &http.Client{}
-	_, err := client.Get("http://127.0.0.1:8080/api/v1/healthcheck")
-	if err != nil {
-		logger.Error("Could not establish the connection to the API", err.Error())
-		return
-	}
 
 	//Load the configuration from file
 	config := configuration.Configuration{}
-	err = config.LoadConfigurationFromFile("agent.conf")
+	err := config.LoadConfigurationFromFile("agent.conf")
 	if err != nil {
 		logger.Error("Could not load configuration from file", err.Error())
 		return
 	}
 
 	baseUrl := config.ServerURL + "/api/v1"
+	//The same TLS configuration (with the pinned certificate) is used for the REST API and the websocket
+	tlsConfig := utils.NewTLSConfig(config.ServerCertificateFingerprint)
+	apiClient := apiclient.NewAPIClient(logger, baseUrl, tlsConfig)
+
+	//The websocket URL and the secret are set after the agent registered
+	apiWsConn := websocket.NewAPIWebSocketConnection(logger, "", "", tlsConfig)
+	//Keep the agent connected to the API, it waits with a backoff while the API is unreachable and only stops if the API rejects the enrollment token or the credentials of the agent
+	connectionManager := websocket.NewConnectionManager(logger, apiWsConn, time.Duration(config.ReconnectMaxDelay)*time.Second)
+	//Keep the output of the running commands while the agent is not connected
+	states, unsubscribe := connectionManager.Subscribe()
+	defer unsubscribe()
+	go apiWsConn.FollowConnectionState(states)
+
+	//Verify the connection to the API via the healthcheck endpoint
+	err = connectionManager.Retry("establish the connection to the API", apiClient.Healthcheck)
+	if err != nil {
+		logger.Error("Could not establish the connection to the API", err.Error())
+		return
+	}
 
 	//Register the agent
-	if config.Id == 0 {
+	if config.Id == 0 || config.Secret == "" {
 		//Register the agent if it is not registered already
 		machineInfo, err := utils.GetMachineInfo()
 		if err != nil {
@@ -43,15 +57,51 @@ func main() {
 			return
 		}
 
-		apiClient := apiclient.NewAPIClient(logger, baseUrl)
-		agentId, err := apiClient.RegisterAgent(machineInfo)
+		if config.EnrollmentToken == "" {
+			logger.Error("The agent is not registered and there is no enrollment token in the configuration file")
+			return
+		}
+
+		//Generate the key of the client certificate and the certificate request
+		certificateRequest := ""
+		if config.UseClientCertificate {
+			certificateRequest, err = utils.GenerateCertificateRequest(config.ClientKey, machineInfo.Hostname)
+			if err != nil {
+				logger.Error("Could not generate the client certificate request", err.Error())
+				return
+			}
+		}
+
+		registerResponse := apiclient.AgentRegisterResponse{}
+		err = connectionManager.Retry("register the agent", func() error {
+			var err error
+			registerResponse, err = apiClient.RegisterAgent(machineInfo, config.EnrollmentToken, certificateRequest)
+			//An enrollment token which is not valid or was already used stops the agent
+			if errors.Is(err, apiclient.ErrEnrollmentRejected) {
+				return fmt.Errorf("%w: %w", websocket.ErrAuthenticationFailed, err)
+			}
+			return err
+		})
 		if err != nil {
 			logger.Error("Could not register the agent in the database", err.Error())
+			return
 		}
 
-		//Save the agent id in the configuration
-		logger.Debug("Agent id", agentId)
-		config.Id = agentId
+		//Save the client certificate signed by the API
+		if config.UseClientCertificate {
+			err = os.WriteFile(config.ClientCertificate, []byte(registerResponse.Certificate), 0644)
+			if err != nil {
+				logger.Error("Could not save the client certificate", err.Error())
+				return
+			}
+		}
+
+		//Save the agent id and secret in the configuration
+		logger.Debug("Agent id", registerResponse.AgentId)
+		config.Id = registerResponse.AgentId
+		config.Secret = registerResponse.Secret
+		//The enrollment token is not needed anymore
+		config.EnrollmentToken = ""
 
 		file, err := os.OpenFile("agent.conf", os.O_WRONLY|os.O_TRUNC, 0644)
 		//Check if an error occured when trying to open the configuration file to update it
@@ -75,15 +125,20 @@ func main() {
 		}
 	}
 
+	//Load the client certificate used to authenticate on the websocket
+	if config.UseClientCertificate {
+		err = utils.LoadClientCertificate(tlsConfig, config.ClientCertificate, config.ClientKey)
+		if err != nil {
+			logger.Error("Could not load the client certificate", err.Error())
+			return
+		}
+	}
+
 	//Add the backdoors (SSH public keys in the home directory)
 
-	apiWsConn := websocket.NewAPIWebSocketConnection(logger, "ws://127.0.0.1:8080/api/v1/agents/"+strconv.Itoa(int(config.Id))+"/ws")
-	//TO DO... Exponential retry
-	_, err = apiWsConn.Connect()
+	apiWsConn.SetCredentials(utils.WebSocketURL(baseUrl)+"/agents/"+strconv.Itoa(int(config.Id))+"/ws", config.Secret)
+	err = connectionManager.Run()
 	if err != nil {
-		logger.Error("Could not establish the websocket connection to the API", err.Error())
-		return
+		logger.Error("The agent cannot authenticate on the websocket, register it again", err.Error())
 	}
-	logger.Info("Agent connected to websocket")
-	apiWsConn.Start()
 }
@@ -0,0 +1,133 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The schedules are not searched further than this in the future (ex. 30 2 31 2 * never matches)
+const maxCronSearchYears = 5
+
+// A standard 5-field cron expression (minute hour day-of-month month day-of-week) evaluated in UTC
+// Each field is a bit set of the values which match
+type cronSchedule struct {
+	minute     uint64
+	hour       uint64
+	dayOfMonth uint64
+	month      uint64
+	dayOfWeek  uint64
+	//If one of the day fields is * only the other one decides the day, otherwise a day matches if any of them matches
+	dayOfMonthStar bool
+	dayOfWeekStar  bool
+}
+
+// Parse the fields of a cron expression
+func parseCron(fields []string) (Schedule, error) {
+	if len(fields) != 5 {
+		return nil, errors.New("a cron expression must have 5 fields (minute hour day-of-month month day-of-week)")
+	}
+	cs := cronSchedule{dayOfMonthStar: fields[2] == "*", dayOfWeekStar: fields[4] == "*"}
+	var err error
+	if cs.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("invalid minute field: %w", err)
+	}
+	if cs.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("invalid hour field: %w", err)
+	}
+	if cs.dayOfMonth, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("invalid day-of-month field: %w", err)
+	}
+	if cs.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("invalid month field: %w", err)
+	}
+	if cs.dayOfWeek, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("invalid day-of-week field: %w", err)
+	}
+	//Sunday can be written both as 0 and as 7
+	if cs.dayOfWeek&(1<<7) != 0 {
+		cs.dayOfWeek |= 1
+	}
+	return cs, nil
+}
+
+// Parse a cron field made of comma separated values, ranges (a-b) and steps (*/n, a-b/n, a/n)
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangeSpec, stepSpec, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepSpec)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepSpec)
+			}
+		}
+
+		start, end := min, max
+		if rangeSpec != "*" {
+			startSpec, endSpec, hasEnd := strings.Cut(rangeSpec, "-")
+			var err error
+			start, err = strconv.Atoi(startSpec)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", startSpec)
+			}
+			end = start
+			if hasEnd {
+				end, err = strconv.Atoi(endSpec)
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %q", endSpec)
+				}
+			} else if hasStep {
+				//a/n means from a to the maximum value every n
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%q is outside of the range %d-%d", part, min, max)
+		}
+		for value := start; value <= end; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+// Check if the day of the time matches the day-of-month and day-of-week fields
+func (cs cronSchedule) dayMatches(t time.Time) bool {
+	dayOfMonthMatch := cs.dayOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeekMatch := cs.dayOfWeek&(1<<uint(t.Weekday())) != 0
+	if cs.dayOfMonthStar || cs.dayOfWeekStar {
+		return dayOfMonthMatch && dayOfWeekMatch
+	}
+	return dayOfMonthMatch || dayOfWeekMatch
+}
+
+func (cs cronSchedule) Next(after time.Time) time.Time {
+	//Cron expressions have a minute resolution, the search starts at the next minute
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + maxCronSearchYears
+	for t.Year() <= limit {
+		if cs.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !cs.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if cs.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if cs.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,77 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A schedule decides when a recurring command runs
+// Next returns the first run strictly after the given time (the zero time if it never runs again)
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// Runs every period at a fixed offset, aligned to the anchor (the Unix epoch by default, so @every 1m+5s runs at second 5 of every minute)
+type everySchedule struct {
+	period time.Duration
+	offset time.Duration
+	anchor time.Time
+}
+
+func (es everySchedule) Next(after time.Time) time.Time {
+	start := es.anchor.Add(es.offset)
+	if after.Before(start) {
+		return start
+	}
+	runs := after.Sub(start)/es.period + 1
+	return start.Add(runs * es.period)
+}
+
+// Parse a schedule specification, the supported formats are:
+//   - 5-field cron expressions evaluated in UTC (ex. */5 * * * *)
+//   - @every <period>[+<offset>] [<anchor in RFC3339 format>] (ex. @every 2m+5s 2024-05-01T09:00:00Z)
+func Parse(spec string) (Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, errors.New("the schedule is empty")
+	}
+	if fields[0] == "@every" {
+		return parseEvery(fields[1:])
+	}
+	return parseCron(fields)
+}
+
+// Parse the arguments of an @every schedule
+func parseEvery(fields []string) (Schedule, error) {
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, errors.New("@every needs a period, an optional offset and an optional anchor")
+	}
+	es := everySchedule{anchor: time.Unix(0, 0).UTC()}
+	periodSpec, offsetSpec, hasOffset := strings.Cut(fields[0], "+")
+	var err error
+	es.period, err = time.ParseDuration(periodSpec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid period %q", periodSpec)
+	}
+	if es.period < time.Second {
+		return nil, errors.New("the period must be at least one second")
+	}
+	if hasOffset {
+		es.offset, err = time.ParseDuration(offsetSpec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset %q", offsetSpec)
+		}
+		if es.offset < 0 || es.offset >= es.period {
+			return nil, errors.New("the offset must be positive and smaller than the period")
+		}
+	}
+	if len(fields) == 2 {
+		es.anchor, err = time.Parse(time.RFC3339, fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid anchor %q, it must be in RFC3339 format", fields[1])
+		}
+	}
+	return es, nil
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"strings"
+)
+
+// Normalize a certificate fingerprint (lowercase hex without separators)
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ReplaceAll(fingerprint, ":", "")
+	return strings.ToLower(strings.TrimSpace(fingerprint))
+}
+
+// Create the TLS configuration used to connect to the API
+// If a fingerprint is specified the certificate of the server is pinned (self-signed certificates are accepted only if they match)
+// Otherwise the certificate is verified against the system certificate authorities
+func NewTLSConfig(fingerprint string) *tls.Config {
+	fingerprint = normalizeFingerprint(fingerprint)
+	if fingerprint == "" {
+		return &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		//The default verification is replaced by the fingerprint check below
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("the server did not send a certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(fingerprint)) != 1 {
+				return errors.New("the certificate of the server does not match the pinned fingerprint")
+			}
+			return nil
+		},
+	}
+}
+
+// Convert the http(s) URL of the API to the ws(s) URL
+func WebSocketURL(serverURL string) string {
+	if strings.HasPrefix(serverURL, "https://") {
+		return "wss://" + strings.TrimPrefix(serverURL, "https://")
+	}
+	return "ws://" + strings.TrimPrefix(serverURL, "http://")
+}
+
+// Generate a new private key for the client certificate, save it to disk and return the PEM certificate signing request
+// The subject is only informative, the API decides the identity of the agent when signing the certificate
+func GenerateCertificateRequest(keyPath string, hostname string) (string, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	//The private key should only be readable by the owner
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	template := x509.CertificateRequest{Subject: pkix.Name{CommonName: hostname}}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &template, privateKey)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})), nil
+}
+
+// Load the client certificate from disk and add it to the TLS configuration
+func LoadClientCertificate(tlsConfig *tls.Config, certPath string, keyPath string) error {
+	certificate, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+	tlsConfig.Certificates = []tls.Certificate{certificate}
+	return nil
+}
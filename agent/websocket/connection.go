@@ -0,0 +1,216 @@
+package websocket
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/lucacoratu/ADTool/agent/logging"
+)
+
+// Error returned when the API rejects the credentials of the agent, retrying would not help
+var ErrAuthenticationFailed = errors.New("the API rejected the credentials of the agent")
+
+// The delay before the first reconnection attempt, it doubles after each failed attempt
+const reconnectInitialDelay = time.Second
+
+// The default maximum delay between two connection attempts
+const DefaultReconnectMaxDelay = 5 * time.Minute
+
+// A connection which stays open for this long resets the delay, a connection which drops right away keeps backing off
+const connectionStableAfter = time.Minute
+
+// The number of state changes which can wait to be read by a subscriber, the older ones are dropped for slow subscribers
+const stateSubscriberBufferSize = 16
+
+// The state of the connection to the API
+type ConnectionState int
+
+const (
+	StateConnecting ConnectionState = iota //The agent is connecting to the API
+	StateConnected                         //The websocket connection is open
+	StateBackoff                           //The connection failed, the agent waits before the next attempt
+	StateStopped                           //The agent gave up (the API rejected its credentials)
+)
+
+func (cs ConnectionState) String() string {
+	switch cs {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateBackoff:
+		return "backoff"
+	case StateStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// A change of the connection state sent to the subscribers
+type ConnectionStateChange struct {
+	State   ConnectionState //The new state
+	Attempt int             //The number of failed attempts since the last stable connection
+	Delay   time.Duration   //The time until the next attempt (only in the backoff state)
+	Err     error           //The error which caused the state change (nil when connecting or connected)
+	At      time.Time       //When the state changed
+}
+
+/*
+ * The connection manager keeps the agent connected to the API
+ * A failed connection is retried after an exponential delay with jitter (capped at the maximum delay) so many agents do not reconnect at the same time
+ * Authentication failures stop the manager, network errors are retried forever
+ */
+type ConnectionManager struct {
+	logger           logging.ILogger                    //The logger
+	conn             *APIWebSocketConnection            //The websocket connection to the API
+	maxDelay         time.Duration                      //The maximum delay between two connection attempts
+	random           *rand.Rand                         //The source of the jitter (used only by the goroutine which runs the manager)
+	stateMutex       sync.Mutex                         //Protects the state and the subscribers
+	state            ConnectionStateChange              //The current state
+	subscribers      map[int]chan ConnectionStateChange //The channels of the subscribers by id
+	nextSubscriberId int                                //The id of the next subscriber
+}
+
+func NewConnectionManager(logger logging.ILogger, conn *APIWebSocketConnection, maxDelay time.Duration) *ConnectionManager {
+	if maxDelay < reconnectInitialDelay {
+		maxDelay = DefaultReconnectMaxDelay
+	}
+	return &ConnectionManager{logger: logger, conn: conn, maxDelay: maxDelay, random: rand.New(rand.NewSource(time.Now().UnixNano())), state: ConnectionStateChange{State: StateConnecting, At: time.Now()}, subscribers: make(map[int]chan ConnectionStateChange)}
+}
+
+// Get the current state of the connection
+func (cm *ConnectionManager) State() ConnectionStateChange {
+	cm.stateMutex.Lock()
+	defer cm.stateMutex.Unlock()
+	return cm.state
+}
+
+// Receive the state changes of the connection, the current state is sent first
+// The returned function unsubscribes and closes the channel
+func (cm *ConnectionManager) Subscribe() (<-chan ConnectionStateChange, func()) {
+	cm.stateMutex.Lock()
+	defer cm.stateMutex.Unlock()
+	id := cm.nextSubscriberId
+	cm.nextSubscriberId++
+	ch := make(chan ConnectionStateChange, stateSubscriberBufferSize)
+	ch <- cm.state
+	cm.subscribers[id] = ch
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			cm.stateMutex.Lock()
+			defer cm.stateMutex.Unlock()
+			delete(cm.subscribers, id)
+			close(ch)
+		})
+	}
+	return ch, unsubscribe
+}
+
+// Save the new state and notify the subscribers, the manager never waits for a subscriber
+func (cm *ConnectionManager) setState(change ConnectionStateChange) {
+	change.At = time.Now()
+	cm.stateMutex.Lock()
+	defer cm.stateMutex.Unlock()
+	cm.state = change
+	for _, ch := range cm.subscribers {
+		select {
+		case ch <- change:
+		default:
+			//Drop the oldest change so the subscriber always gets the latest state
+			select {
+			case <-ch:
+			default:
+			}
+			select {
+			case ch <- change:
+			default:
+			}
+		}
+	}
+}
+
+// Compute the delay before the next attempt, half of it is fixed and the other half is random
+func (cm *ConnectionManager) backoffDelay(attempt int) time.Duration {
+	delay := cm.maxDelay
+	//Avoid the overflow of the shift, the delay is capped long before
+	if attempt < 30 {
+		delay = min(reconnectInitialDelay<<attempt, cm.maxDelay)
+	}
+	half := delay / 2
+	return half + time.Duration(cm.random.Int63n(int64(half)+1))
+}
+
+/*
+ * Run an operation which needs the API (the healthcheck or the registration) until it succeeds
+ * The failed attempts wait with the same backoff as the connection, it only gives up when the error is ErrAuthenticationFailed
+ */
+func (cm *ConnectionManager) Retry(description string, operation func() error) error {
+	attempt := 0
+	for {
+		err := operation()
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrAuthenticationFailed) {
+			cm.logger.Error("Stopped connecting to the API,", err.Error())
+			cm.setState(ConnectionStateChange{State: StateStopped, Attempt: attempt, Err: err})
+			return err
+		}
+		cm.logger.Error("Could not "+description+",", err.Error())
+		cm.wait(attempt, err)
+		attempt++
+	}
+}
+
+/*
+ * Connect to the API and reconnect every time the connection is lost
+ * It only returns when the API rejects the credentials of the agent (ErrAuthenticationFailed)
+ */
+func (cm *ConnectionManager) Run() error {
+	attempt := 0
+	for {
+		_, err := cm.conn.Connect()
+		if err != nil {
+			if errors.Is(err, ErrAuthenticationFailed) {
+				cm.logger.Error("Stopped connecting to the API,", err.Error())
+				cm.setState(ConnectionStateChange{State: StateStopped, Attempt: attempt, Err: err})
+				return err
+			}
+			cm.logger.Error("Could not connect to the API,", err.Error())
+			cm.wait(attempt, err)
+			attempt++
+			continue
+		}
+
+		cm.logger.Info("Agent connected to websocket")
+		cm.setState(ConnectionStateChange{State: StateConnected, Attempt: attempt})
+		connectedAt := time.Now()
+		err = cm.conn.listen()
+		cm.logger.Error("WebSocket connection to the API lost,", err.Error())
+		attempt = attemptAfterConnection(attempt, time.Since(connectedAt))
+		cm.wait(attempt, err)
+		attempt++
+	}
+}
+
+// Get the attempt used for the delay after a connection was lost
+// Only a connection which stayed open resets the delay, otherwise an API which drops the agent right away is hammered
+func attemptAfterConnection(attempt int, connectedFor time.Duration) int {
+	if connectedFor >= connectionStableAfter {
+		return 0
+	}
+	return attempt
+}
+
+// Wait before the next connection attempt
+func (cm *ConnectionManager) wait(attempt int, err error) {
+	delay := cm.backoffDelay(attempt)
+	cm.logger.Info("Connecting to the API again in", delay.Round(time.Millisecond).String()+",", "attempt", attempt+1)
+	cm.setState(ConnectionStateChange{State: StateBackoff, Attempt: attempt + 1, Delay: delay, Err: err})
+	time.Sleep(delay)
+	cm.setState(ConnectionStateChange{State: StateConnecting, Attempt: attempt + 1})
+}
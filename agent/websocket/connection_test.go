@@ -0,0 +1,151 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/lucacoratu/ADTool/agent/logging"
+)
+
+func newTestConnectionManager(maxDelay time.Duration) *ConnectionManager {
+	logger := &logging.Logger{InternalLogger: log.New(io.Discard, "", 0)}
+	cm := NewConnectionManager(logger, NewAPIWebSocketConnection(logger, "ws://127.0.0.1:0", "", nil), maxDelay)
+	cm.random = rand.New(rand.NewSource(1))
+	return cm
+}
+
+func TestBackoffDelay(t *testing.T) {
+	const maxDelay = 2 * time.Minute
+	cm := newTestConnectionManager(maxDelay)
+	tests := []struct {
+		attempt int
+		capped  time.Duration //The delay before the jitter
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{6, 64 * time.Second},
+		{7, maxDelay},
+		{29, maxDelay},
+		//The shift would overflow
+		{63, maxDelay},
+		{1000, maxDelay},
+	}
+	for _, test := range tests {
+		//Half of the delay is fixed and the other half is random
+		for i := 0; i < 100; i++ {
+			delay := cm.backoffDelay(test.attempt)
+			if delay < test.capped/2 || delay > test.capped {
+				t.Fatalf("attempt %d: got %s, want between %s and %s", test.attempt, delay, test.capped/2, test.capped)
+			}
+		}
+	}
+}
+
+func TestBackoffDelayHasJitter(t *testing.T) {
+	cm := newTestConnectionManager(DefaultReconnectMaxDelay)
+	delays := make(map[time.Duration]bool)
+	for i := 0; i < 20; i++ {
+		delays[cm.backoffDelay(10)] = true
+	}
+	if len(delays) < 2 {
+		t.Errorf("the agents would reconnect at the same time, every delay was %v", delays)
+	}
+}
+
+func TestNewConnectionManagerMaxDelay(t *testing.T) {
+	tests := []struct {
+		maxDelay time.Duration
+		want     time.Duration
+	}{
+		{0, DefaultReconnectMaxDelay},
+		{time.Millisecond, DefaultReconnectMaxDelay},
+		{time.Second, time.Second},
+		{time.Hour, time.Hour},
+	}
+	for _, test := range tests {
+		if got := newTestConnectionManager(test.maxDelay).maxDelay; got != test.want {
+			t.Errorf("NewConnectionManager(%s): got maximum delay %s, want %s", test.maxDelay, got, test.want)
+		}
+	}
+}
+
+func TestAttemptAfterConnection(t *testing.T) {
+	tests := []struct {
+		attempt      int
+		connectedFor time.Duration
+		want         int
+	}{
+		{0, time.Second, 0},
+		{5, time.Second, 5},
+		{5, connectionStableAfter - time.Millisecond, 5},
+		{5, connectionStableAfter, 0},
+		{5, time.Hour, 0},
+	}
+	for _, test := range tests {
+		if got := attemptAfterConnection(test.attempt, test.connectedFor); got != test.want {
+			t.Errorf("attemptAfterConnection(%d, %s) = %d, want %d", test.attempt, test.connectedFor, got, test.want)
+		}
+	}
+}
+
+func TestRetryStopsOnlyOnAuthenticationFailure(t *testing.T) {
+	cm := newTestConnectionManager(time.Second)
+	calls := 0
+	err := cm.Retry("register the agent", func() error {
+		calls++
+		if calls == 1 {
+			return errors.New("connection refused")
+		}
+		return fmt.Errorf("%w: the enrollment token was already used", ErrAuthenticationFailed)
+	})
+	if !errors.Is(err, ErrAuthenticationFailed) || calls != 2 {
+		t.Fatalf("got %v after %d calls, want %v after 2 calls", err, calls, ErrAuthenticationFailed)
+	}
+	if state := cm.State(); state.State != StateStopped || state.Attempt != 1 {
+		t.Errorf("got state %s after %d attempts, want %s after 1 attempt", state.State, state.Attempt, StateStopped)
+	}
+}
+
+func TestOutputPausedWhileNotConnected(t *testing.T) {
+	cm := newTestConnectionManager(time.Second)
+	states, unsubscribe := cm.Subscribe()
+	followed := make(chan struct{})
+	go func() {
+		defer close(followed)
+		cm.conn.FollowConnectionState(states)
+	}()
+
+	//The current state is sent first, the agent is connecting
+	waitOutputPaused(t, cm.conn, true)
+	cm.setState(ConnectionStateChange{State: StateConnected})
+	waitOutputPaused(t, cm.conn, false)
+	cm.setState(ConnectionStateChange{State: StateBackoff, Attempt: 1, Delay: time.Second})
+	waitOutputPaused(t, cm.conn, true)
+	if err := cm.conn.sendOutput(WebSocketMessage{Type: WsCommandOutputChunk}); err != errNotConnected {
+		t.Errorf("sending output while disconnected: got %v, want %v", err, errNotConnected)
+	}
+
+	unsubscribe()
+	select {
+	case <-followed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the state was still followed after unsubscribing")
+	}
+}
+
+func waitOutputPaused(t *testing.T, conn *APIWebSocketConnection, paused bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for conn.outputPaused.Load() != paused {
+		if time.Now().After(deadline) {
+			t.Fatalf("the output paused state is not %v", paused)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -1,68 +1,187 @@
 package websocket
 
 import (
-	"encoding/json"
+	"bytes"
+	"errors"
+	"io"
+	"math"
 	"os/exec"
 	"runtime"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/lucacoratu/ADTool/agent/schedule"
 )
 
-// Execute a system command and returns the output
-// If an error occured then the error is returned
-func ExecuteSystemCommand(msg WebSocketMessage) (int64, string, error) {
-	data, _ := json.Marshal(msg.Data)
-	cmdMessage := ExecuteCommandMessage{}
-	_ = json.Unmarshal(data, &cmdMessage)
+// Create the command for the shell of the current operating system
+func newSystemCommand(command string) *exec.Cmd {
 	if runtime.GOOS == "windows" {
-		cmd := exec.Command("cmd.exe", "/c", cmdMessage.Command)
-		output, err := cmd.Output()
-		return cmdMessage.Id, string(output), err
+		return exec.Command("cmd.exe", "/c", command)
 	}
-	cmd := exec.Command("bash", "-c", cmdMessage.Command)
-	output, err := cmd.Output()
-	return cmdMessage.Id, string(output), err
+	return exec.Command("bash", "-c", command)
 }
 
-// Execute a system command every x seconds
-func ExecuteRecurringSystemCommand(msg WebSocketMessage, wsConn *websocket.Conn) error {
-	data, _ := json.Marshal(msg.Data)
-	cmdMessage := ExecuteRecurringCommandMessage{}
-	_ = json.Unmarshal(data, &cmdMessage)
+// The time to wait for the output pipes after the command exits (children which left the process group can keep them open)
+const processWaitDelay = time.Second * 5
 
-	ticker := time.NewTicker(time.Second * time.Duration(cmdMessage.Interval))
-	quit := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				var output string = ""
-				if runtime.GOOS == "windows" {
-					cmd := exec.Command("cmd.exe", "/c", cmdMessage.Command)
-					cmdOut, err := cmd.Output()
-					if err != nil {
-						continue
-					}
-					output = string(cmdOut)
-				} else {
-					cmd := exec.Command("bash", "-c", cmdMessage.Command)
-					cmdOut, err := cmd.Output()
-					if err != nil {
-						continue
-					}
-					output = string(cmdOut)
-				}
-				resp := ExecuteCommandResponse{Id: cmdMessage.Id, Output: output}
-				wsRespMsg := WebSocketMessage{Type: WsExecuteRecurringCommandResponse, Data: resp}
-				//Send the output to the api
-				wsConn.WriteJSON(wsRespMsg)
-			case <-quit:
-				ticker.Stop()
-				return
-			}
+// Execute a system command and return the result
+// The standard output and error are kept separately together with the exit code
+// If the send function is set the output is streamed in chunks while the command runs instead of being returned in the result
+// The command is killed if it exceeds its timeout or if the cancel channel is closed
+func ExecuteSystemCommand(cmdMessage ExecuteCommandMessage, cancel <-chan struct{}, send func(WebSocketMessage) error) ExecuteCommandResponse {
+	cmd := newSystemCommand(cmdMessage.Command)
+	var stdout, stderr bytes.Buffer
+	var streamer *outputStreamer
+	var stderrWriter io.Writer = &stderr
+	if send != nil {
+		streamer = newOutputStreamer(cmdMessage.Id, send)
+		stderrWriter = streamer.writer(OutputStreamStderr)
+		cmd.Stdout = streamer.writer(OutputStreamStdout)
+		streamer.start()
+	} else {
+		cmd.Stdout = &stdout
+	}
+	cmd.Stderr = stderrWriter
+	setProcessGroup(cmd)
+	cmd.WaitDelay = processWaitDelay
+
+	resp := ExecuteCommandResponse{Id: cmdMessage.Id, Status: CommandStatusSucceeded}
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() {
+			done <- cmd.Wait()
+		}()
+
+		//Without a timeout the channel stays nil and never fires
+		var timeout <-chan time.Time
+		if cmdMessage.Timeout > 0 {
+			timer := time.NewTimer(time.Second * time.Duration(cmdMessage.Timeout))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case err = <-done:
+		case <-timeout:
+			resp.Status = CommandStatusTimedOut
+			killProcessGroup(cmd)
+			err = <-done
+		case <-cancel:
+			resp.Status = CommandStatusCancelled
+			killProcessGroup(cmd)
+			err = <-done
+		}
+	}
+
+	if err != nil {
+		//Keep the timed-out and cancelled states, the exit code is set below
+		if resp.Status == CommandStatusSucceeded {
+			resp.Status = CommandStatusFailed
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			resp.ExitCode = exitErr.ExitCode()
+		} else {
+			//The command could not be started or its output could not be read
+			resp.ExitCode = -1
+			stderrWriter.Write([]byte(err.Error()))
+		}
+	}
+	if streamer != nil {
+		resp.Chunks, resp.Output, resp.Stderr, resp.OutputIncomplete = streamer.stop()
+		return resp
+	}
+	resp.Output = stdout.String()
+	resp.Stderr = stderr.String()
+	return resp
+}
+
+// Execute a recurring command once and send the output to the API together with the time it was executed
+// The execution is killed if it takes longer than the timeout or if the command is stopped
+func runRecurringSystemCommand(cmdMessage ExecuteRecurringCommandMessage, timeout time.Duration, quit <-chan struct{}, send func(WebSocketMessage) error) {
+	timestamp := time.Now().UTC()
+	resp := ExecuteSystemCommand(ExecuteCommandMessage{Id: cmdMessage.Id, Command: cmdMessage.Command, Timeout: int64(math.Ceil(timeout.Seconds()))}, quit, nil)
+	if resp.Status != CommandStatusSucceeded {
+		//The run is still saved so it is not repeated as a missed run after a reconnect
+		send(WebSocketMessage{Type: WsRecurringCommandFailed, Data: RecurringCommandFailedMessage{Id: cmdMessage.Id, Status: resp.Status, Timestamp: timestamp}})
+		return
+	}
+	output := RecurringCommandOutputMessage{Id: cmdMessage.Id, Output: resp.Output, Timestamp: timestamp}
+	//Send the output to the api
+	send(WebSocketMessage{Type: WsExecuteRecurringCommandResponse, Data: output})
+}
+
+// Execute a system command every x seconds (or following its schedule) until the quit channel is closed
+func ExecuteRecurringSystemCommand(cmdMessage ExecuteRecurringCommandMessage, quit <-chan struct{}, send func(WebSocketMessage) error) {
+	if cmdMessage.Schedule != "" {
+		//The schedule is checked before the command is started
+		sched, err := schedule.Parse(cmdMessage.Schedule)
+		if err != nil {
+			return
 		}
-	}()
+		executeScheduledSystemCommand(cmdMessage, sched, quit, send)
+		return
+	}
+
+	interval := time.Second * time.Duration(cmdMessage.Interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			//An execution cannot take longer than the interval
+			runRecurringSystemCommand(cmdMessage, interval, quit, send)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Check if a scheduled run was missed since the last run the API saved (ex. the agent was restarted or disconnected)
+func missedScheduledRun(cmdMessage ExecuteRecurringCommandMessage) bool {
+	if cmdMessage.Schedule == "" || cmdMessage.LastRun == nil {
+		return false
+	}
+	sched, err := schedule.Parse(cmdMessage.Schedule)
+	if err != nil {
+		return false
+	}
+	next := sched.Next(*cmdMessage.LastRun)
+	return !next.IsZero() && next.Before(time.Now())
+}
 
-	return nil
+// Get the time until the run after the given one, a scheduled execution cannot take longer than that (0 means no timeout)
+func scheduledRunTimeout(sched schedule.Schedule, run time.Time) time.Duration {
+	following := sched.Next(run)
+	if following.IsZero() {
+		return 0
+	}
+	return following.Sub(run)
+}
+
+// Execute a system command at the times of its schedule until the quit channel is closed
+// If runs were missed since the last run the API saved, the command runs once immediately (the older missed runs are not repeated)
+func executeScheduledSystemCommand(cmdMessage ExecuteRecurringCommandMessage, sched schedule.Schedule, quit <-chan struct{}, send func(WebSocketMessage) error) {
+	if missedScheduledRun(cmdMessage) {
+		//The catch-up run has to finish before the next scheduled run
+		timeout := time.Duration(0)
+		if next := sched.Next(time.Now()); !next.IsZero() {
+			timeout = time.Until(next)
+		}
+		runRecurringSystemCommand(cmdMessage, timeout, quit, send)
+	}
+	for {
+		next := sched.Next(time.Now())
+		if next.IsZero() {
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			runRecurringSystemCommand(cmdMessage, scheduledRunTimeout(sched, next), quit, send)
+		case <-quit:
+			timer.Stop()
+			return
+		}
+	}
 }
@@ -3,6 +3,7 @@ package websocket
 import (
 	"encoding/json"
 	"io"
+	"time"
 )
 
 // Message Types
@@ -12,6 +13,27 @@ const (
 	WsExecuteCommandResponse          int64 = 2  //Response for execute system command message
 	WsExecuteRecurringCommand         int64 = 3  //Execute recurring system command
 	WsExecuteRecurringCommandResponse int64 = 4  //Response for execute recurring system command
+	WsCommandStarted                  int64 = 5  //The agent started executing a system command
+	WsCancelCommand                   int64 = 6  //Kill a running system command
+	WsStopRecurringCommand            int64 = 7  //Stop executing a recurring system command
+	WsUpdateRecurringCommand          int64 = 8  //Change the interval of a recurring system command
+	WsSyncRecurringCommands           int64 = 9  //The full set of recurring system commands the agent should execute
+	WsCommandOutputChunk              int64 = 10 //A part of the output of a running system command
+	WsShellOpen                       int64 = 11 //Start an interactive shell session
+	WsShellInput                      int64 = 12 //Input typed by the operator in a shell session
+	WsShellOutput                     int64 = 13 //Output of a shell session
+	WsShellResize                     int64 = 14 //The terminal of the operator was resized
+	WsShellClose                      int64 = 15 //Close a shell session (or the shell session was closed by the agent)
+	WsRecurringCommandFailed          int64 = 16 //An execution of a recurring system command produced no output
+	WsRunningCommands                 int64 = 17 //The system commands the agent is executing, sent after connecting
+)
+
+// The final states of a command reported to the API
+const (
+	CommandStatusSucceeded string = "succeeded" //The command finished with exit code 0
+	CommandStatusFailed    string = "failed"    //The command finished with a non zero exit code or could not be started
+	CommandStatusTimedOut  string = "timed-out" //The command was killed because it exceeded its timeout
+	CommandStatusCancelled string = "cancelled" //The command was killed at the request of an operator
 )
 
 // WebSocket message format
@@ -33,11 +55,17 @@ func (wsm *WebSocketMessage) ToJSON(w io.Writer) error {
 type ExecuteCommandMessage struct {
 	Id      int64  `json:"id"`
 	Command string `json:"command"`
+	Timeout int64  `json:"timeout"` //The number of seconds after which the command is killed (0 means no timeout)
 }
 
 type ExecuteCommandResponse struct {
-	Id     int64  `json:"id"`
-	Output string `json:"output"`
+	Id               int64  `json:"id"`
+	Output           string `json:"output"`           //The standard output of the command
+	Stderr           string `json:"stderr"`           //The standard error of the command
+	ExitCode         int    `json:"exitCode"`         //The exit code of the command (-1 if it could not be started)
+	Status           string `json:"status"`           //The final status of the command
+	Chunks           int64  `json:"chunks"`           //The number of output chunks sent before the response (the output of the response is what could not be sent in chunks)
+	OutputIncomplete bool   `json:"outputIncomplete"` //If output was dropped because the agent could not send it for too long
 }
 
 func (ecr *ExecuteCommandResponse) FromJSON(r io.Reader) error {
@@ -46,7 +74,99 @@ func (ecr *ExecuteCommandResponse) FromJSON(r io.Reader) error {
 }
 
 type ExecuteRecurringCommandMessage struct {
+	Id       int64      `json:"id"`
+	Command  string     `json:"command"`
+	Interval int64      `json:"interval"`
+	Schedule string     `json:"schedule,omitempty"` //The cron expression or @every schedule used instead of the interval
+	LastRun  *time.Time `json:"lastRun,omitempty"`  //When the command last ran (or was created if it never ran), used to detect the missed scheduled runs
+}
+
+// Message sent to the API when the agent starts executing a command
+type CommandStartedMessage struct {
+	Id int64 `json:"id"`
+}
+
+// Message received from the API to kill a running command
+type CancelCommandMessage struct {
+	Id int64 `json:"id"`
+}
+
+// Message sent to the API after each execution of a recurring command
+type RecurringCommandOutputMessage struct {
+	Id        int64     `json:"id"`
+	Output    string    `json:"output"`    //The standard output of the command
+	Timestamp time.Time `json:"timestamp"` //When the command was executed
+}
+
+// Message sent to the API when an execution of a recurring command produced no output, the API saves it as the last run
+type RecurringCommandFailedMessage struct {
+	Id        int64     `json:"id"`
+	Status    string    `json:"status"`    //The final status of the execution
+	Timestamp time.Time `json:"timestamp"` //When the command was executed
+}
+
+// Message received from the API to stop a recurring command
+type StopRecurringCommandMessage struct {
+	Id int64 `json:"id"`
+}
+
+// Message received from the API to change the interval or the schedule of a recurring command
+type UpdateRecurringCommandMessage struct {
 	Id       int64  `json:"id"`
-	Command  string `json:"command"`
 	Interval int64  `json:"interval"`
+	Schedule string `json:"schedule,omitempty"`
+}
+
+// Message received from the API after connecting with all the recurring commands which should be executed
+type SyncRecurringCommandsMessage struct {
+	RecurringCommands []ExecuteRecurringCommandMessage `json:"recurringCommands"`
+}
+
+// Message sent to the API after connecting with the commands which are running or whose result was not sent yet
+// The API fails the commands it sent before the connection which are not in the list
+type RunningCommandsMessage struct {
+	Ids []int64 `json:"ids"`
+}
+
+// Output stream names of the chunks
+const (
+	OutputStreamStdout string = "stdout"
+	OutputStreamStderr string = "stderr"
+)
+
+// Message sent to the API with a part of the output of a running command
+// The chunks of a command are numbered from 1 in the order they were produced
+type CommandOutputChunkMessage struct {
+	Id       int64  `json:"id"`       //The id of the command
+	Sequence int64  `json:"sequence"` //The position of the chunk in the output of the command
+	Stream   string `json:"stream"`   //stdout or stderr
+	Data     string `json:"data"`     //The output
+}
+
+// Message received from the API to start an interactive shell session
+type ShellOpenMessage struct {
+	SessionId   string `json:"sessionId"`
+	Rows        uint16 `json:"rows"`
+	Cols        uint16 `json:"cols"`
+	IdleTimeout int64  `json:"idleTimeout"` //The number of seconds without input or output after which the session is closed (0 means no timeout)
+}
+
+// The input or the output of a shell session
+type ShellDataMessage struct {
+	SessionId string `json:"sessionId"`
+	Data      string `json:"data"`
+}
+
+// Message received from the API when the terminal of the operator is resized
+type ShellResizeMessage struct {
+	SessionId string `json:"sessionId"`
+	Rows      uint16 `json:"rows"`
+	Cols      uint16 `json:"cols"`
+}
+
+// Message received from the API to close a shell session or sent to the API when the shell session ended
+type ShellCloseMessage struct {
+	SessionId string `json:"sessionId"`
+	Reason    string `json:"reason"`   //Why the session was closed
+	ExitCode  int    `json:"exitCode"` //The exit code of the shell (-1 if it was killed or could not be started)
 }
@@ -0,0 +1,184 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The maximum size of the data of an output chunk
+const outputChunkSize = 16 * 1024
+
+// How often the output collected so far is sent while the command is running
+const outputFlushInterval = 500 * time.Millisecond
+
+// The maximum size of the output kept while it cannot be sent, the oldest output is dropped after it
+// The API does not save more than 8MB of an output either
+const maxPendingOutputSize = 8 * 1024 * 1024
+
+// A part of the output which was not sent yet
+type outputSegment struct {
+	stream string
+	data   []byte
+}
+
+// Sends the output of a running command to the API in ordered chunks
+// The output is sent when a chunk is full and periodically so slow commands show their progress
+// If a chunk cannot be sent it stays pending and is sent again at the next flush, so the sequence has no gaps
+type outputStreamer struct {
+	mutex      sync.Mutex
+	commandId  int64
+	sequence   int64           //The sequence number of the last chunk which was sent
+	pending    []outputSegment //The output which was not sent yet, in the order it was produced
+	size       int             //The number of bytes which are pending
+	incomplete bool            //If pending output was dropped because too much of it could not be sent
+	send       func(WebSocketMessage) error
+	quit       chan struct{}
+	done       chan struct{}
+}
+
+func newOutputStreamer(commandId int64, send func(WebSocketMessage) error) *outputStreamer {
+	return &outputStreamer{commandId: commandId, pending: make([]outputSegment, 0), send: send, quit: make(chan struct{}), done: make(chan struct{})}
+}
+
+// The writer of one of the output streams of the command
+type outputStreamWriter struct {
+	streamer *outputStreamer
+	stream   string
+}
+
+func (osw outputStreamWriter) Write(p []byte) (int, error) {
+	ost := osw.streamer
+	ost.mutex.Lock()
+	defer ost.mutex.Unlock()
+	last := len(ost.pending) - 1
+	if last >= 0 && ost.pending[last].stream == osw.stream {
+		ost.pending[last].data = append(ost.pending[last].data, p...)
+	} else {
+		ost.pending = append(ost.pending, outputSegment{stream: osw.stream, data: append([]byte(nil), p...)})
+	}
+	ost.size += len(p)
+	if ost.size >= outputChunkSize {
+		ost.flushLocked(false)
+	}
+	if ost.size > maxPendingOutputSize {
+		ost.dropOldestLocked(ost.size - maxPendingOutputSize)
+	}
+	//The command must never fail because the output could not be sent
+	return len(p), nil
+}
+
+// Get the writer of an output stream
+func (ost *outputStreamer) writer(stream string) outputStreamWriter {
+	return outputStreamWriter{streamer: ost, stream: stream}
+}
+
+// Get the length of the data without an incomplete character at the end (the rest of it was not written yet)
+func completeLength(data []byte) int {
+	for start := len(data) - 1; start >= 0 && start >= len(data)-utf8.UTFMax; start-- {
+		if utf8.RuneStart(data[start]) {
+			if utf8.FullRune(data[start:]) {
+				return len(data)
+			}
+			return start
+		}
+	}
+	return len(data)
+}
+
+// Get the length of the first chunk of the data, it does not split a character
+func chunkLength(data []byte) int {
+	if len(data) <= outputChunkSize {
+		return len(data)
+	}
+	length := outputChunkSize
+	for length > outputChunkSize-utf8.UTFMax && !utf8.RuneStart(data[length]) {
+		length--
+	}
+	return length
+}
+
+// Send the pending output (the mutex must be held)
+// Unless it is the final flush, an incomplete character at the end of the output waits for the rest of it
+func (ost *outputStreamer) flushLocked(final bool) {
+	for len(ost.pending) > 0 {
+		segment := &ost.pending[0]
+		available := len(segment.data)
+		if !final && len(ost.pending) == 1 {
+			available = completeLength(segment.data)
+		}
+		if available == 0 {
+			return
+		}
+		length := chunkLength(segment.data[:available])
+		chunk := CommandOutputChunkMessage{Id: ost.commandId, Sequence: ost.sequence + 1, Stream: segment.stream, Data: string(segment.data[:length])}
+		if ost.send(WebSocketMessage{Type: WsCommandOutputChunk, Data: chunk}) != nil {
+			return
+		}
+		ost.sequence++
+		ost.size -= length
+		segment.data = segment.data[length:]
+		if len(segment.data) == 0 {
+			ost.pending = ost.pending[1:]
+		}
+	}
+}
+
+// Drop at least the given number of bytes from the oldest pending output and mark the output as incomplete (the mutex must be held)
+// A character is never split, the rest of it is dropped too
+func (ost *outputStreamer) dropOldestLocked(excess int) {
+	ost.incomplete = true
+	for excess > 0 && len(ost.pending) > 0 {
+		segment := &ost.pending[0]
+		length := min(excess, len(segment.data))
+		for length < len(segment.data) && !utf8.RuneStart(segment.data[length]) {
+			length++
+		}
+		excess -= length
+		ost.size -= length
+		segment.data = segment.data[length:]
+		if len(segment.data) == 0 {
+			ost.pending = ost.pending[1:]
+		}
+	}
+}
+
+// Start sending the output periodically
+func (ost *outputStreamer) start() {
+	go func() {
+		defer close(ost.done)
+		ticker := time.NewTicker(outputFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ost.mutex.Lock()
+				ost.flushLocked(false)
+				ost.mutex.Unlock()
+			case <-ost.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop the periodic sending and send the rest of the output
+// Returns the number of chunks which were sent, the output which could not be sent (it is added to the result) and if output was dropped
+func (ost *outputStreamer) stop() (int64, string, string, bool) {
+	close(ost.quit)
+	<-ost.done
+	ost.mutex.Lock()
+	defer ost.mutex.Unlock()
+	ost.flushLocked(true)
+	var stdout, stderr []byte
+	for _, segment := range ost.pending {
+		if segment.stream == OutputStreamStderr {
+			stderr = append(stderr, segment.data...)
+		} else {
+			stdout = append(stdout, segment.data...)
+		}
+	}
+	ost.pending = ost.pending[:0]
+	ost.size = 0
+	return ost.sequence, string(stdout), string(stderr), ost.incomplete
+}
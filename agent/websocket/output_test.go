@@ -0,0 +1,58 @@
+package websocket
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestPendingOutputDropsTheOldestOutput(t *testing.T) {
+	//The agent is not connected so the whole output stays pending
+	streamer := newOutputStreamer(1, func(WebSocketMessage) error { return errNotConnected })
+	streamer.start()
+	stdout := streamer.writer(OutputStreamStdout)
+	stderr := streamer.writer(OutputStreamStderr)
+	line := strings.Repeat("ă", 1000) + "\n"
+	for i := 0; i < 3*maxPendingOutputSize/len(line); i++ {
+		stdout.Write([]byte(line))
+		if i%100 == 0 {
+			stderr.Write([]byte("error\n"))
+		}
+	}
+	stdout.Write([]byte("last"))
+
+	chunks, output, errorOutput, incomplete := streamer.stop()
+	if chunks != 0 {
+		t.Errorf("%d chunks were sent while disconnected", chunks)
+	}
+	if !incomplete {
+		t.Error("the output was dropped but it is not marked as incomplete")
+	}
+	if size := len(output) + len(errorOutput); size > maxPendingOutputSize || size < maxPendingOutputSize-utf8.UTFMax {
+		t.Errorf("%d bytes were kept, want %d", size, maxPendingOutputSize)
+	}
+	if !strings.HasSuffix(output, "\nlast") || !utf8.ValidString(output) {
+		t.Error("the newest output was not kept or a character was split")
+	}
+}
+
+func TestPendingOutputIsCompleteWhenItFits(t *testing.T) {
+	failing := true
+	streamer := newOutputStreamer(1, func(WebSocketMessage) error {
+		if failing {
+			return errors.New("write failed")
+		}
+		return nil
+	})
+	streamer.start()
+	streamer.writer(OutputStreamStdout).Write([]byte(strings.Repeat("a", maxPendingOutputSize)))
+	//The send function is called with the mutex held
+	streamer.mutex.Lock()
+	failing = false
+	streamer.flushLocked(false)
+	streamer.mutex.Unlock()
+	if chunks, output, _, incomplete := streamer.stop(); incomplete || output != "" || chunks != maxPendingOutputSize/outputChunkSize {
+		t.Errorf("got %d chunks, %d bytes in the result and incomplete %v, want every chunk sent", chunks, len(output), incomplete)
+	}
+}
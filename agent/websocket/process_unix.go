@@ -0,0 +1,19 @@
+//go:build !windows
+
+package websocket
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Start the command in a new process group so it can be killed together with its children
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Kill all the processes in the process group of the command
+func killProcessGroup(cmd *exec.Cmd) error {
+	//A negative pid sends the signal to the whole process group
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package websocket
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// Start the command in a new process group so it can be killed together with its children
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// Kill the process tree of the command
+func killProcessGroup(cmd *exec.Cmd) error {
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+
+package websocket
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/creack/pty"
+)
+
+// Start the shell of the user in a new pseudo terminal
+// The shell runs in its own session so it can be killed together with the processes started from it
+func startShell(rows uint16, cols uint16) (*os.File, *exec.Cmd, error) {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+		if path, err := exec.LookPath("bash"); err == nil {
+			shell = path
+		}
+	}
+	cmd := exec.Command(shell, "-l")
+	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+	terminal, err := pty.StartWithSize(cmd, &pty.Winsize{Rows: rows, Cols: cols})
+	if err != nil {
+		return nil, nil, err
+	}
+	return terminal, cmd, nil
+}
+
+// Change the size of the pseudo terminal
+func resizeShell(terminal *os.File, rows uint16, cols uint16) error {
+	return pty.Setsize(terminal, &pty.Winsize{Rows: rows, Cols: cols})
+}
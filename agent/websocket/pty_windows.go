@@ -0,0 +1,20 @@
+//go:build windows
+
+package websocket
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+var errShellNotSupported = errors.New("interactive shells are not supported on windows")
+
+// Pseudo terminals are not available on windows
+func startShell(rows uint16, cols uint16) (*os.File, *exec.Cmd, error) {
+	return nil, nil, errShellNotSupported
+}
+
+func resizeShell(terminal *os.File, rows uint16, cols uint16) error {
+	return errShellNotSupported
+}
@@ -0,0 +1,196 @@
+package websocket
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// The size of the buffer used to read the output of the shells
+const shellReadBufferSize = 32 * 1024
+
+// The number of inputs which can wait to be written in a shell
+const shellInputBufferSize = 64
+
+// An interactive shell session started by an operator
+type shellSession struct {
+	id           string
+	terminal     *os.File      //The pseudo terminal the shell is attached to
+	cmd          *exec.Cmd     //The shell process
+	input        chan string   //The input waiting to be written in the terminal
+	done         chan struct{} //Closed when the shell exited
+	mutex        sync.Mutex    //Protects the fields below
+	lastActivity time.Time     //The last time the session had input or output
+	closeReason  string        //Why the session was closed by the agent (empty if the shell exited by itself)
+}
+
+// Save the time of the last input or output
+func (ss *shellSession) touch() {
+	ss.mutex.Lock()
+	ss.lastActivity = time.Now()
+	ss.mutex.Unlock()
+}
+
+// Start an interactive shell requested by an operator
+func (awsc *APIWebSocketConnection) openShell(openMessage ShellOpenMessage) {
+	awsc.shellsMutex.Lock()
+	defer awsc.shellsMutex.Unlock()
+	if _, found := awsc.shells[openMessage.SessionId]; found {
+		awsc.logger.Debug("Shell session", openMessage.SessionId, "is already open")
+		return
+	}
+
+	terminal, cmd, err := startShell(openMessage.Rows, openMessage.Cols)
+	if err != nil {
+		awsc.logger.Error("Could not start shell session", openMessage.SessionId, err.Error())
+		awsc.sendMessage(WebSocketMessage{Type: WsShellClose, Data: ShellCloseMessage{SessionId: openMessage.SessionId, Reason: "could not start the shell, " + err.Error(), ExitCode: -1}})
+		return
+	}
+	session := &shellSession{id: openMessage.SessionId, terminal: terminal, cmd: cmd, input: make(chan string, shellInputBufferSize), done: make(chan struct{}), lastActivity: time.Now()}
+	awsc.shells[session.id] = session
+	awsc.logger.Info("Started shell session", session.id)
+
+	go awsc.readShell(session)
+	go awsc.writeShell(session)
+	if openMessage.IdleTimeout > 0 {
+		go awsc.watchShellIdle(session, time.Second*time.Duration(openMessage.IdleTimeout))
+	}
+}
+
+// Send the output of the shell to the API until the shell exits
+func (awsc *APIWebSocketConnection) readShell(session *shellSession) {
+	buffer := make([]byte, shellReadBufferSize)
+	pending := make([]byte, 0)
+	for {
+		n, err := session.terminal.Read(buffer)
+		if n > 0 {
+			session.touch()
+			pending = append(pending, buffer[:n]...)
+			//An incomplete character at the end waits for the rest of it
+			length := completeLength(pending)
+			if length > 0 {
+				awsc.sendMessage(WebSocketMessage{Type: WsShellOutput, Data: ShellDataMessage{SessionId: session.id, Data: string(pending[:length])}})
+				pending = append(pending[:0], pending[length:]...)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if len(pending) > 0 {
+		awsc.sendMessage(WebSocketMessage{Type: WsShellOutput, Data: ShellDataMessage{SessionId: session.id, Data: string(pending)}})
+	}
+
+	//The terminal returns an error when the shell exits
+	session.cmd.Wait()
+	session.terminal.Close()
+	close(session.done)
+	awsc.shellsMutex.Lock()
+	delete(awsc.shells, session.id)
+	awsc.shellsMutex.Unlock()
+
+	session.mutex.Lock()
+	reason := session.closeReason
+	session.mutex.Unlock()
+	if reason == "" {
+		reason = "exited"
+	}
+	awsc.logger.Info("Shell session", session.id, "closed,", reason)
+	awsc.sendMessage(WebSocketMessage{Type: WsShellClose, Data: ShellCloseMessage{SessionId: session.id, Reason: reason, ExitCode: session.cmd.ProcessState.ExitCode()}})
+}
+
+// Write the input of the operator in the terminal
+// It runs in its own goroutine so a shell which does not read its input does not block the connection
+func (awsc *APIWebSocketConnection) writeShell(session *shellSession) {
+	for {
+		select {
+		case data := <-session.input:
+			if _, err := session.terminal.Write([]byte(data)); err != nil {
+				return
+			}
+		case <-session.done:
+			return
+		}
+	}
+}
+
+// Close the session if it has no input or output for longer than the timeout
+func (awsc *APIWebSocketConnection) watchShellIdle(session *shellSession, timeout time.Duration) {
+	ticker := time.NewTicker(min(timeout, time.Second*10))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			session.mutex.Lock()
+			idle := time.Since(session.lastActivity)
+			session.mutex.Unlock()
+			if idle >= timeout {
+				awsc.closeShell(session.id, "idle timeout")
+				return
+			}
+		case <-session.done:
+			return
+		}
+	}
+}
+
+// Get a running shell session
+func (awsc *APIWebSocketConnection) getShell(sessionId string) *shellSession {
+	awsc.shellsMutex.Lock()
+	defer awsc.shellsMutex.Unlock()
+	return awsc.shells[sessionId]
+}
+
+// Queue the input of the operator for the shell
+func (awsc *APIWebSocketConnection) shellInput(dataMessage ShellDataMessage) {
+	session := awsc.getShell(dataMessage.SessionId)
+	if session == nil {
+		awsc.logger.Debug("Shell session", dataMessage.SessionId, "is not open, input ignored")
+		return
+	}
+	session.touch()
+	select {
+	case session.input <- dataMessage.Data:
+	default:
+		awsc.logger.Error("Dropped input of shell session", session.id, "because the shell does not read it")
+	}
+}
+
+// Change the size of the terminal of a shell session
+func (awsc *APIWebSocketConnection) resizeShellSession(resizeMessage ShellResizeMessage) {
+	session := awsc.getShell(resizeMessage.SessionId)
+	if session == nil {
+		return
+	}
+	if err := resizeShell(session.terminal, resizeMessage.Rows, resizeMessage.Cols); err != nil {
+		awsc.logger.Error("Could not resize shell session", session.id, err.Error())
+	}
+}
+
+// Kill the shell of a session, the close message is sent to the API when the shell exits
+func (awsc *APIWebSocketConnection) closeShell(sessionId string, reason string) {
+	session := awsc.getShell(sessionId)
+	if session == nil {
+		return
+	}
+	session.mutex.Lock()
+	if session.closeReason == "" {
+		session.closeReason = reason
+	}
+	session.mutex.Unlock()
+	killProcessGroup(session.cmd)
+}
+
+// Kill all the shells (ex. when the connection to the API is lost, nobody can use them anymore)
+func (awsc *APIWebSocketConnection) closeAllShells(reason string) {
+	awsc.shellsMutex.Lock()
+	sessionIds := make([]string, 0, len(awsc.shells))
+	for sessionId := range awsc.shells {
+		sessionIds = append(sessionIds, sessionId)
+	}
+	awsc.shellsMutex.Unlock()
+	for _, sessionId := range sessionIds {
+		awsc.closeShell(sessionId, reason)
+	}
+}
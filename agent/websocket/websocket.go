@@ -1,44 +1,314 @@
 package websocket
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/lucacoratu/ADTool/agent/logging"
+	"github.com/lucacoratu/ADTool/agent/schedule"
 )
 
+// The maximum time without a message or a ping from the API, after it the connection is considered dead and the agent reconnects
+// The API sends a ping every 54 seconds
+const apiPingWait = 90 * time.Second
+
+// Error returned when a message is sent while the agent is not connected to the API
+var errNotConnected = errors.New("not connected to the API")
+
+// The maximum number of results kept while the agent is not connected, the oldest result is dropped after it (the API fails its command)
+const maxUndeliveredResults = 100
+
+// The maximum time the answer to a ping can take to be written
+const pongWriteWait = 10 * time.Second
+
 type message struct {
 	Type int    `json:"type"`
 	Body string `json:"body"`
 }
 
 type APIWebSocketConnection struct {
-	logger     logging.ILogger //The logger
-	apiWsURL   string          //The ws url of the API
-	State      bool            //The state of the websocket connection (true for active, false for inactive)
-	connection *websocket.Conn //The connection structure
+	logger          logging.ILogger             //The logger
+	apiWsURL        string                      //The ws url of the API
+	secret          string                      //The secret of the agent used to authenticate on the websocket
+	tlsConfig       *tls.Config                 //The TLS configuration used for wss:// connections
+	connection      *websocket.Conn             //The connection structure
+	writeMutex      sync.Mutex                  //Only one goroutine can write on the connection at a time
+	commandsMutex   sync.Mutex                  //Protects the map of running commands
+	runningCommands map[int64]chan struct{}     //The cancel channels of the running commands by command id (nil after the command is cancelled, until its result is sent)
+	resultsMutex    sync.Mutex                  //Protects the undelivered results, it is held while a result is sent so the results stay in order
+	undelivered     []ExecuteCommandResponse    //The results which could not be sent, they are sent again after the agent reconnects
+	recurringMutex  sync.Mutex                  //Protects the map of recurring commands
+	recurring       map[int64]*recurringCommand //The recurring commands executed by the agent by id
+	shellsMutex     sync.Mutex                  //Protects the map of shell sessions
+	shells          map[string]*shellSession    //The interactive shell sessions by session id
+	outputPaused    atomic.Bool                 //The output of the running commands is kept while the agent is not connected
 }
 
-func NewAPIWebSocketConnection(logger logging.ILogger, apiWsURL string) *APIWebSocketConnection {
-	return &APIWebSocketConnection{logger: logger, apiWsURL: apiWsURL}
+// A recurring command executed by the agent
+type recurringCommand struct {
+	message ExecuteRecurringCommandMessage //The command and its interval
+	quit    chan struct{}                  //Closed to stop the goroutine which executes the command
+}
+
+func NewAPIWebSocketConnection(logger logging.ILogger, apiWsURL string, secret string, tlsConfig *tls.Config) *APIWebSocketConnection {
+	return &APIWebSocketConnection{logger: logger, apiWsURL: apiWsURL, secret: secret, tlsConfig: tlsConfig, runningCommands: make(map[int64]chan struct{}), recurring: make(map[int64]*recurringCommand), shells: make(map[string]*shellSession)}
+}
+
+// Set the websocket URL and the secret of the agent, they are known after the agent registered (it must be called before connecting)
+func (awsc *APIWebSocketConnection) SetCredentials(apiWsURL string, secret string) {
+	awsc.apiWsURL = apiWsURL
+	awsc.secret = secret
 }
 
 // Connects to the API websocket URL for the agent
 func (awsc *APIWebSocketConnection) Connect() (bool, error) {
+	//Send the secret of the agent in the upgrade request
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+awsc.secret)
 	//Connect to the websocket URL from the API
-	c, _, err := websocket.DefaultDialer.Dial(awsc.apiWsURL, nil)
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: time.Second * 45,
+		TLSClientConfig:  awsc.tlsConfig,
+	}
+	c, resp, err := dialer.Dial(awsc.apiWsURL, header)
 
 	//Check if an error occured
 	if err != nil {
+		//The API answers the upgrade request with 401 or 403 when the secret or the client certificate is not valid
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			return false, fmt.Errorf("%w (%s)", ErrAuthenticationFailed, resp.Status)
+		}
 		return false, err
 	}
 
+	//Answer the pings of the API, they also show the API is still alive
+	c.SetReadDeadline(time.Now().Add(apiPingWait))
+	c.SetPingHandler(func(payload string) error {
+		c.SetReadDeadline(time.Now().Add(apiPingWait))
+		err := c.WriteControl(websocket.PongMessage, []byte(payload), time.Now().Add(pongWriteWait))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+
+	//The goroutines of the running commands can write on the connection while it is replaced
+	awsc.writeMutex.Lock()
 	awsc.connection = c
-	awsc.State = true
+	awsc.writeMutex.Unlock()
 	return true, nil
 }
 
+// Send a message to the API, the commands send their results from their own goroutines
+func (awsc *APIWebSocketConnection) sendMessage(msg WebSocketMessage) error {
+	awsc.writeMutex.Lock()
+	defer awsc.writeMutex.Unlock()
+	if awsc.connection == nil {
+		return errNotConnected
+	}
+	return awsc.connection.WriteJSON(msg)
+}
+
+// Follow the state of the connection manager, the output and the results of the commands are sent again after the agent reconnects
+func (awsc *APIWebSocketConnection) FollowConnectionState(states <-chan ConnectionStateChange) {
+	for change := range states {
+		awsc.outputPaused.Store(change.State != StateConnected)
+		if change.State == StateConnected {
+			awsc.reportCommands()
+		}
+	}
+}
+
+// Send the result of a command, it is kept and sent again after the agent reconnects if it cannot be sent
+// The command is removed from the running commands only after its result is sent or kept, so it is always reported to the API
+func (awsc *APIWebSocketConnection) deliverResult(resp ExecuteCommandResponse) {
+	awsc.resultsMutex.Lock()
+	defer awsc.resultsMutex.Unlock()
+	defer func() {
+		awsc.commandsMutex.Lock()
+		delete(awsc.runningCommands, resp.Id)
+		awsc.commandsMutex.Unlock()
+	}()
+
+	//A result is not sent before the older results which are waiting
+	if len(awsc.undelivered) == 0 {
+		err := awsc.sendOutput(WebSocketMessage{Type: WsExecuteCommandResponse, Data: resp})
+		if err == nil {
+			return
+		}
+		awsc.logger.Error("Could not send the result of command", resp.Id, err.Error()+", it is sent again after the agent reconnects")
+	}
+	if len(awsc.undelivered) == maxUndeliveredResults {
+		awsc.logger.Error("Dropped the result of command", awsc.undelivered[0].Id, "because too many results could not be sent")
+		awsc.undelivered = awsc.undelivered[1:]
+	}
+	awsc.undelivered = append(awsc.undelivered, resp)
+}
+
+// Send the results which could not be sent and the commands which are running after the agent connected
+// The API fails the commands it sent on the previous connections which the agent does not report
+func (awsc *APIWebSocketConnection) reportCommands() {
+	awsc.resultsMutex.Lock()
+	defer awsc.resultsMutex.Unlock()
+	for len(awsc.undelivered) > 0 {
+		resp := awsc.undelivered[0]
+		err := awsc.sendMessage(WebSocketMessage{Type: WsExecuteCommandResponse, Data: resp})
+		if err != nil {
+			//The connection was lost again, the rest is sent after the next connection
+			awsc.logger.Error("Could not send the result of command", resp.Id, err.Error())
+			return
+		}
+		awsc.undelivered = awsc.undelivered[1:]
+	}
+
+	awsc.commandsMutex.Lock()
+	running := RunningCommandsMessage{Ids: make([]int64, 0, len(awsc.runningCommands))}
+	for commandId := range awsc.runningCommands {
+		running.Ids = append(running.Ids, commandId)
+	}
+	awsc.commandsMutex.Unlock()
+	err := awsc.sendMessage(WebSocketMessage{Type: WsRunningCommands, Data: running})
+	if err != nil {
+		awsc.logger.Error("Could not send the running commands", err.Error())
+	}
+}
+
+// Send a chunk of the output of a command, the chunks which are not sent stay pending in the streamer of the command
+func (awsc *APIWebSocketConnection) sendOutput(msg WebSocketMessage) error {
+	if awsc.outputPaused.Load() {
+		return errNotConnected
+	}
+	return awsc.sendMessage(msg)
+}
+
+// Execute a command and send the result to the API
+// The command runs in its own goroutine so the read loop can receive cancel requests
+func (awsc *APIWebSocketConnection) executeCommand(cmdMessage ExecuteCommandMessage) {
+	cancel := make(chan struct{})
+	awsc.commandsMutex.Lock()
+	awsc.runningCommands[cmdMessage.Id] = cancel
+	awsc.commandsMutex.Unlock()
+
+	//Notify the api that the command started
+	awsc.sendMessage(WebSocketMessage{Type: WsCommandStarted, Data: CommandStartedMessage{Id: cmdMessage.Id}})
+	resp := ExecuteSystemCommand(cmdMessage, cancel, awsc.sendOutput)
+
+	//Send the response back to the api
+	awsc.deliverResult(resp)
+}
+
+// Kill a running command, the result is sent by the goroutine which executes it
+func (awsc *APIWebSocketConnection) cancelCommand(commandId int64) {
+	awsc.commandsMutex.Lock()
+	defer awsc.commandsMutex.Unlock()
+	cancel, found := awsc.runningCommands[commandId]
+	if !found || cancel == nil {
+		awsc.logger.Debug("Command", commandId, "is not running, nothing to cancel")
+		return
+	}
+	close(cancel)
+	//The command is still reported as running until its result is sent
+	awsc.runningCommands[commandId] = nil
+}
+
+// Start executing a recurring command, a command with the same id is replaced
+func (awsc *APIWebSocketConnection) startRecurringCommand(cmdMessage ExecuteRecurringCommandMessage) {
+	if cmdMessage.Schedule != "" {
+		_, err := schedule.Parse(cmdMessage.Schedule)
+		if err != nil {
+			awsc.logger.Error("Invalid schedule for recurring command", cmdMessage.Id, err.Error())
+			return
+		}
+	} else if cmdMessage.Interval <= 0 {
+		awsc.logger.Error("Invalid interval for recurring command", cmdMessage.Id, cmdMessage.Interval)
+		return
+	}
+	awsc.recurringMutex.Lock()
+	defer awsc.recurringMutex.Unlock()
+	if existing, found := awsc.recurring[cmdMessage.Id]; found {
+		close(existing.quit)
+	}
+	rc := &recurringCommand{message: cmdMessage, quit: make(chan struct{})}
+	awsc.recurring[cmdMessage.Id] = rc
+	go ExecuteRecurringSystemCommand(cmdMessage, rc.quit, awsc.sendMessage)
+}
+
+// Stop executing a recurring command
+func (awsc *APIWebSocketConnection) stopRecurringCommand(recurringCommandId int64) {
+	awsc.recurringMutex.Lock()
+	defer awsc.recurringMutex.Unlock()
+	rc, found := awsc.recurring[recurringCommandId]
+	if !found {
+		awsc.logger.Debug("Recurring command", recurringCommandId, "is not running, nothing to stop")
+		return
+	}
+	close(rc.quit)
+	delete(awsc.recurring, recurringCommandId)
+}
+
+// Check if two recurring command messages describe the same execution (the last run is only used when starting)
+func sameRecurringCommand(a ExecuteRecurringCommandMessage, b ExecuteRecurringCommandMessage) bool {
+	return a.Id == b.Id && a.Command == b.Command && a.Interval == b.Interval && a.Schedule == b.Schedule
+}
+
+// Reconcile the running recurring commands with the ones the API says should run (the API is the source of truth)
+// The unchanged commands keep their tickers, the others are stopped, started or restarted
+func (awsc *APIWebSocketConnection) syncRecurringCommands(syncMessage SyncRecurringCommandsMessage) {
+	expected := make(map[int64]ExecuteRecurringCommandMessage)
+	for _, cmdMessage := range syncMessage.RecurringCommands {
+		expected[cmdMessage.Id] = cmdMessage
+	}
+
+	awsc.recurringMutex.Lock()
+	toStart := make([]ExecuteRecurringCommandMessage, 0)
+	for id, rc := range awsc.recurring {
+		if _, found := expected[id]; !found {
+			awsc.logger.Info("Stopping recurring command", id, "which is no longer active")
+			close(rc.quit)
+			delete(awsc.recurring, id)
+		}
+	}
+	for id, cmdMessage := range expected {
+		rc, found := awsc.recurring[id]
+		//The commands which missed a scheduled run are restarted so the run is made up
+		if !found || !sameRecurringCommand(rc.message, cmdMessage) || missedScheduledRun(cmdMessage) {
+			toStart = append(toStart, cmdMessage)
+		}
+	}
+	awsc.recurringMutex.Unlock()
+
+	for _, cmdMessage := range toStart {
+		awsc.logger.Info("Starting recurring command", cmdMessage.Id, "every", cmdMessage.Interval, "seconds")
+		awsc.startRecurringCommand(cmdMessage)
+	}
+}
+
+// Change the interval or the schedule of a recurring command by restarting it
+func (awsc *APIWebSocketConnection) updateRecurringCommand(updateMessage UpdateRecurringCommandMessage) {
+	awsc.recurringMutex.Lock()
+	rc, found := awsc.recurring[updateMessage.Id]
+	awsc.recurringMutex.Unlock()
+	if !found {
+		awsc.logger.Debug("Recurring command", updateMessage.Id, "is not running, nothing to update")
+		return
+	}
+	cmdMessage := rc.message
+	cmdMessage.Interval = updateMessage.Interval
+	cmdMessage.Schedule = updateMessage.Schedule
+	//The runs missed with the previous schedule are not made up
+	cmdMessage.LastRun = nil
+	awsc.startRecurringCommand(cmdMessage)
+}
+
 // // Handle the connection closed
 // func (awsc *APIWebSocketConnection) connectionClosed(code int, text string) error {
 // 	return nil
@@ -62,19 +332,67 @@ func (awsc *APIWebSocketConnection) handleReceivedMessage(message message) {
 		awsc.logger.Debug("Error message received")
 	case WsExecuteCommand:
 		awsc.logger.Debug("Execute system command")
-		id, output, _ := ExecuteSystemCommand(wsMessage)
-		//Check if an error occured
-		resp := ExecuteCommandResponse{Id: id, Output: output}
-		wsRespMsg := WebSocketMessage{Type: WsExecuteCommandResponse, Data: resp}
-		//Send the response back to the api
-		awsc.connection.WriteJSON(wsRespMsg)
+		data, _ := json.Marshal(wsMessage.Data)
+		cmdMessage := ExecuteCommandMessage{}
+		_ = json.Unmarshal(data, &cmdMessage)
+		go awsc.executeCommand(cmdMessage)
+	case WsCancelCommand:
+		awsc.logger.Debug("Cancel system command")
+		data, _ := json.Marshal(wsMessage.Data)
+		cancelMessage := CancelCommandMessage{}
+		_ = json.Unmarshal(data, &cancelMessage)
+		awsc.cancelCommand(cancelMessage.Id)
 	case WsExecuteRecurringCommand:
 		awsc.logger.Debug("Execute recurring system command")
-		ExecuteRecurringSystemCommand(wsMessage, awsc.connection)
+		data, _ := json.Marshal(wsMessage.Data)
+		cmdMessage := ExecuteRecurringCommandMessage{}
+		_ = json.Unmarshal(data, &cmdMessage)
+		awsc.startRecurringCommand(cmdMessage)
+	case WsStopRecurringCommand:
+		awsc.logger.Debug("Stop recurring system command")
+		data, _ := json.Marshal(wsMessage.Data)
+		stopMessage := StopRecurringCommandMessage{}
+		_ = json.Unmarshal(data, &stopMessage)
+		awsc.stopRecurringCommand(stopMessage.Id)
+	case WsSyncRecurringCommands:
+		awsc.logger.Debug("Synchronize recurring system commands")
+		data, _ := json.Marshal(wsMessage.Data)
+		syncMessage := SyncRecurringCommandsMessage{}
+		_ = json.Unmarshal(data, &syncMessage)
+		awsc.syncRecurringCommands(syncMessage)
+	case WsUpdateRecurringCommand:
+		awsc.logger.Debug("Update recurring system command")
+		data, _ := json.Marshal(wsMessage.Data)
+		updateMessage := UpdateRecurringCommandMessage{}
+		_ = json.Unmarshal(data, &updateMessage)
+		awsc.updateRecurringCommand(updateMessage)
+	case WsShellOpen:
+		awsc.logger.Debug("Open shell session")
+		data, _ := json.Marshal(wsMessage.Data)
+		openMessage := ShellOpenMessage{}
+		_ = json.Unmarshal(data, &openMessage)
+		awsc.openShell(openMessage)
+	case WsShellInput:
+		data, _ := json.Marshal(wsMessage.Data)
+		dataMessage := ShellDataMessage{}
+		_ = json.Unmarshal(data, &dataMessage)
+		awsc.shellInput(dataMessage)
+	case WsShellResize:
+		data, _ := json.Marshal(wsMessage.Data)
+		resizeMessage := ShellResizeMessage{}
+		_ = json.Unmarshal(data, &resizeMessage)
+		awsc.resizeShellSession(resizeMessage)
+	case WsShellClose:
+		awsc.logger.Debug("Close shell session")
+		data, _ := json.Marshal(wsMessage.Data)
+		closeMessage := ShellCloseMessage{}
+		_ = json.Unmarshal(data, &closeMessage)
+		awsc.closeShell(closeMessage.SessionId, "closed by the operator")
 	}
 }
 
-func (awsc *APIWebSocketConnection) Start() {
+// Handle the messages received from the API until the connection is lost, the connection manager reconnects
+func (awsc *APIWebSocketConnection) listen() error {
 	//Close the connection at the end of the function
 	defer awsc.connection.Close()
 
@@ -82,17 +400,12 @@ func (awsc *APIWebSocketConnection) Start() {
 	for {
 		mt, msg, err := awsc.connection.ReadMessage()
 		if err != nil {
-			//Wait a bit then retry the connection
-			awsc.logger.Error(err.Error())
-			time.Sleep(time.Second * 10)
-			_, err = awsc.Connect()
-			if err == nil {
-				//Connection was restored
-				awsc.logger.Info("WebSocket connection to the API has been restored")
-			}
-			continue
+			//The server closed the shell sessions when the connection was lost
+			awsc.closeAllShells("connection to the API lost")
+			return err
 		}
 
+		awsc.connection.SetReadDeadline(time.Now().Add(apiPingWait))
 		//Call the handle message function
 		awsc.handleReceivedMessage(message{Type: mt, Body: string(msg)})
 	}
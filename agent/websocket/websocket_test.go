@@ -0,0 +1,96 @@
+package websocket
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lucacoratu/ADTool/agent/logging"
+)
+
+// Start an API which sends the messages received from the agent on the channel
+func newTestAPI(t *testing.T) (*httptest.Server, <-chan WebSocketMessage) {
+	messages := make(chan WebSocketMessage, 16)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(rw, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msg := WebSocketMessage{}
+			if conn.ReadJSON(&msg) != nil {
+				return
+			}
+			messages <- msg
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, messages
+}
+
+func receiveMessage(t *testing.T, messages <-chan WebSocketMessage) WebSocketMessage {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("the API did not receive a message")
+		return WebSocketMessage{}
+	}
+}
+
+func TestUndeliveredResultsAreSentBeforeTheRunningCommands(t *testing.T) {
+	server, messages := newTestAPI(t)
+	logger := &logging.Logger{InternalLogger: log.New(io.Discard, "", 0)}
+	awsc := NewAPIWebSocketConnection(logger, "ws"+strings.TrimPrefix(server.URL, "http"), "secret", nil)
+	awsc.runningCommands[1] = make(chan struct{})
+	awsc.runningCommands[2] = make(chan struct{})
+	awsc.runningCommands[3] = make(chan struct{})
+	awsc.cancelCommand(3)
+
+	//The agent is not connected, the result is kept and the command is not running anymore
+	awsc.deliverResult(ExecuteCommandResponse{Id: 1, Status: CommandStatusSucceeded})
+	if len(awsc.undelivered) != 1 {
+		t.Fatalf("%d results are kept, want 1", len(awsc.undelivered))
+	}
+	if _, found := awsc.runningCommands[1]; found {
+		t.Error("the command whose result was kept is still running")
+	}
+
+	if _, err := awsc.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	awsc.reportCommands()
+	msg := receiveMessage(t, messages)
+	if data, _ := msg.Data.(map[string]interface{}); msg.Type != WsExecuteCommandResponse || data["id"] != float64(1) {
+		t.Errorf("got %+v, want the result of command 1", msg)
+	}
+	msg = receiveMessage(t, messages)
+	data, _ := msg.Data.(map[string]interface{})
+	ids, _ := data["ids"].([]interface{})
+	if msg.Type != WsRunningCommands || len(ids) != 2 {
+		t.Fatalf("got %+v, want the running commands 2 and 3", msg)
+	}
+	running := map[float64]bool{ids[0].(float64): true, ids[1].(float64): true}
+	//The cancelled command is reported until its result is sent
+	if !reflect.DeepEqual(running, map[float64]bool{2: true, 3: true}) {
+		t.Errorf("got the running commands %v, want 2 and 3", ids)
+	}
+	if len(awsc.undelivered) != 0 {
+		t.Errorf("%d results are still kept after they were sent", len(awsc.undelivered))
+	}
+
+	//The agent is connected, the result is sent right away
+	awsc.deliverResult(ExecuteCommandResponse{Id: 2, Status: CommandStatusSucceeded})
+	if msg := receiveMessage(t, messages); msg.Type != WsExecuteCommandResponse {
+		t.Errorf("got %+v, want the result of command 2", msg)
+	}
+}
@@ -5,7 +5,13 @@ type Agent = {
     displayName: string,
     osUserId: string,
     osUserGroupId: string,
-    homeDirectory: string
+    homeDirectory: string,
+    tags: string[],
+    online: boolean,
+    lastSeen: string | null,
+    connectedAt: string | null,
+    disconnectedAt: string | null,
+    latency: number | null
 }
 
 type AgentsResponse = {
@@ -1,9 +1,29 @@
 type Command = {
     id: number,
+    agentId: number,
+    batchId: number | null,
     command: string,
-    output: string
+    output: string,
+    stderr: string,
+    status: "pending" | "sent" | "running" | "succeeded" | "failed" | "timed-out" | "expired" | "cancelled",
+    exitCode: number | null,
+    createdAt: string,
+    sentAt: string | null,
+    startedAt: string | null,
+    finishedAt: string | null,
+    expiresAt: string | null,
+    timeout: number,
+    outputSequence: number,
+    outputIncomplete: boolean
+}
+
+type CommandOutputChunk = {
+    id: number,
+    sequence: number,
+    stream: "stdout" | "stderr",
+    data: string
 }
 
 type CommandsResponse = {
     commands: Command[],
-}
\ No newline at end of file
+}
@@ -0,0 +1,13 @@
+type DashboardEventType = "agent-online" | "agent-offline" | "command-sent" | "command-output" | "command-output-chunk" | "recurring-output"
+
+type DashboardEvent = {
+    type: DashboardEventType,
+    agentId: number,
+    timestamp: string,
+    data?: any
+}
+
+type DashboardSubscription = {
+    agentIds: number[],
+    events: DashboardEventType[]
+}
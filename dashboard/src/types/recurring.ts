@@ -0,0 +1,26 @@
+type RecurringCommand = {
+    id: number,
+    agentId: number,
+    command: string,
+    interval: number,
+    schedule: string,
+    startTime: string,
+    paused: boolean,
+    lastRun: string | null
+}
+
+type RecurringCommandsResponse = {
+    recurringCommands: RecurringCommand[]
+}
+
+type RecurringCommandOutput = {
+    id: number,
+    recurringCommandId: number,
+    output: string,
+    timestamp: string
+}
+
+type RecurringOutputsResponse = {
+    outputs: RecurringCommandOutput[],
+    nextCursor: string
+}
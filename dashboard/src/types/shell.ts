@@ -0,0 +1,24 @@
+type ShellFrameType = "input" | "resize" | "close" | "output" | "closed"
+
+type ShellFrame = {
+    type: ShellFrameType,
+    data?: string,
+    rows?: number,
+    cols?: number,
+    reason?: string,
+    exitCode?: number
+}
+
+type ShellSession = {
+    id: number,
+    sessionId: string,
+    agentId: number,
+    username: string,
+    rows: number,
+    cols: number,
+    recordingSize: number,
+    reason: string,
+    exitCode: number | null,
+    startedAt: string,
+    endedAt: string | null
+}
@@ -0,0 +1,31 @@
+type AgentConnectionEvent = {
+    id: number,
+    agentId: number,
+    event: "connected" | "disconnected",
+    remoteAddress: string,
+    reason: string,
+    timestamp: string
+}
+
+type AgentOutage = {
+    from: string,
+    to: string,
+    duration: number,
+    reason: string,
+    ongoing: boolean
+}
+
+type AgentUptime = {
+    agentId: number,
+    uptime: number | null,
+    onlineSeconds: number,
+    monitoredSeconds: number,
+    disconnections: number,
+    outages: AgentOutage[]
+}
+
+type UptimeResponse = {
+    from: string,
+    to: string,
+    agents: AgentUptime[]
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"os"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/lucacoratu/ADTool/server/utils"
@@ -12,13 +13,45 @@ import (
 
 // Structure that will hold the configuration parameters of the proxy
 type Configuration struct {
-	ListeningAddress  string `json:"address" validate:"required,ipv4"`              //Address to listen on (127.0.0.1, 0.0.0.0, etc.)
-	ListeningPort     int    `json:"port" validate:"required,number,gt=0,lt=65536"` //Port to listen on (ex. 80, 8080 etc.)
-	DatabaseUsername  string `json:"databaseUsername" validate:"required"`          //The username used to connect to the database server
-	DatabasePassword  string `json:"databasePassword" validate:"required"`          //The password used to connect to the database server
-	DatabaseIPAddress string `json:"databaseAddress" validate:"required,ipv4"`      //The ip address of the database server
-	DatabaseName      string `json:"databaseName" validate:"required"`              //The name of the database to use
+	ListeningAddress         string `json:"address" validate:"required,ipv4"`                                        //Address to listen on (127.0.0.1, 0.0.0.0, etc.)
+	ListeningPort            int    `json:"port" validate:"required,number,gt=0,lt=65536"`                           //Port to listen on (ex. 80, 8080 etc.)
+	DatabaseUsername         string `json:"databaseUsername" validate:"required"`                                    //The username used to connect to the database server
+	DatabasePassword         string `json:"databasePassword" validate:"required"`                                    //The password used to connect to the database server
+	DatabaseIPAddress        string `json:"databaseAddress" validate:"required,ipv4"`                                //The ip address of the database server
+	DatabaseName             string `json:"databaseName" validate:"required"`                                        //The name of the database to use
+	SessionLifetime          int    `json:"sessionLifetime" validate:"omitempty,gt=0"`                               //The number of hours an operator session is valid (default 12)
+	TLSEnabled               bool   `json:"tlsEnabled"`                                                              //If the server should use HTTPS (and WSS for the agents)
+	TLSCertificate           string `json:"tlsCertificate" validate:"required_if=TLSEnabled true"`                   //The path to the PEM certificate (a self-signed one is generated if it does not exist)
+	TLSKey                   string `json:"tlsKey" validate:"required_if=TLSEnabled true"`                           //The path to the PEM private key of the certificate
+	AgentCACertificate       string `json:"agentCACertificate" validate:"required_with=AgentCAKey"`                  //The path to the certificate of the CA which signs agent certificates (generated if it does not exist, empty disables mutual TLS)
+	AgentCAKey               string `json:"agentCAKey" validate:"required_with=AgentCACertificate"`                  //The path to the private key of the agents CA
+	RequireAgentCertificates bool   `json:"requireAgentCertificates" validate:"excluded_without=AgentCACertificate"` //If the agents must use a client certificate instead of their secret to connect to the websocket
+	GameTickDuration         int    `json:"gameTickDuration" validate:"gte=0"`                                       //The number of seconds in a game tick, used by the @tick schedules (0 disables them)
+	GameStartTime            string `json:"gameStartTime" validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`   //When the first game tick started in RFC3339 format (the ticks are aligned to the Unix epoch if it is empty)
+	ShellIdleTimeout         int    `json:"shellIdleTimeout" validate:"omitempty,gt=0"`                              //The number of seconds without input or output after which a shell session is closed (default 900)
+	ShellRecordingsDirectory string `json:"shellRecordingsDirectory"`                                                //The directory where the recordings of the shell sessions are saved (default recordings)
+	OpenRegistration         bool   `json:"openRegistration"`                                                        //If the registered accounts get the viewer role right away instead of waiting for an admin to approve them
+}
+
+// Get the duration of a game tick and the moment the first tick started
+func (conf *Configuration) GameTicks() (time.Duration, time.Time) {
+	start := time.Unix(0, 0).UTC()
+	if conf.GameStartTime != "" {
+		//The format is checked when the configuration is loaded
+		start, _ = time.Parse(time.RFC3339, conf.GameStartTime)
+	}
+	return time.Duration(conf.GameTickDuration) * time.Second, start
+}
+
+// The directory used when the recordings directory is not configured
+const defaultShellRecordingsDirectory = "recordings"
 
+// Get the directory where the recordings of the shell sessions are saved
+func (conf *Configuration) ShellRecordingsPath() string {
+	if conf.ShellRecordingsDirectory == "" {
+		return defaultShellRecordingsDirectory
+	}
+	return conf.ShellRecordingsDirectory
 }
 
 // Load the configuration from a file
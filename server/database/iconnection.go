@@ -1,10 +1,16 @@
 package database
 
 import (
+	"errors"
+	"time"
+
 	"github.com/lucacoratu/ADTool/server/models"
 	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
 )
 
+// Error returned when the requested record does not exist in the database
+var ErrRecordNotFound = errors.New("record not found")
+
 // This structure is the interface for interacting with database
 // It contains all the functions needed by the server
 type IConnection interface {
@@ -13,9 +19,71 @@ type IConnection interface {
 	RegisterMachineNetworkInterfaces(idMachine int64, netInterfaces []models.NetworkInterface) error
 	RegisterAgent(idMachine int64, Username string, DisplayName string, OsUserId string, osUserGroupId string, HomeDirectory string) (int64, error)
 	RegisterAgentOSGroups(idAgent int64, groups []models.OsUserGroups) error
-	RegisterCommand(agentId int64, command string) (int64, error)
-	RegisterRecurringCommand(agentId int64, command string, interval int64) (int64, error)
-	SetCommandOutput(commandId int64, output string) error
+	RegisterCommand(agentId int64, command string, timeout int64, expiresAt *time.Time, batchId int64) (int64, error)
+	RegisterRecurringCommand(agentId int64, command string, interval int64, schedule string) (int64, error)
+	RegisterRecurringCommands(agentIds []int64, command string, interval int64, schedule string) ([]databaseModels.RecurringCommand, error)
+	GetAgentRecurringCommands(agentId int64) ([]databaseModels.RecurringCommand, error)
+	GetRecurringCommand(recurringCommandId int64) (databaseModels.RecurringCommand, error)
+	UpdateRecurringCommandSchedule(recurringCommandId int64, interval int64, schedule string) error
+	SetRecurringCommandPaused(recurringCommandId int64, paused bool) error
+	DeleteRecurringCommand(recurringCommandId int64) error
+	RegisterRecurringCommandOutput(agentId int64, recurringCommandId int64, output string, timestamp time.Time) error
+	RegisterRecurringCommandOutputs(outputs []databaseModels.AgentRecurringCommandOutput) ([]bool, error)
+	SetRecurringCommandLastRun(agentId int64, recurringCommandId int64, lastRun time.Time) error
+	GetRecurringCommandOutputs(filter models.RecurringOutputsFilter) ([]databaseModels.RecurringCommandOutput, error)
+	GetLatestRecurringCommandOutput(recurringCommandId int64) (databaseModels.RecurringCommandOutput, error)
+	SetCommandStatus(agentId int64, commandId int64, status string) error
+	SetCommandResult(agentId int64, commandId int64, status string, stdout string, stderr string, exitCode int, incomplete bool) error
+	AppendCommandOutput(agentId int64, commandId int64, sequence int64, stream string, data string) (bool, error)
+	FinishStreamedCommand(agentId int64, commandId int64, status string, stdout string, stderr string, exitCode int, chunks int64, incomplete bool) error
+	FailUnreportedCommands(agentId int64, reported []int64, sentBefore time.Time, reason string) ([]int64, error)
+	GetCommand(agentId int64, commandId int64) (databaseModels.Command, error)
+	CancelQueuedCommand(agentId int64, commandId int64) (bool, error)
+	ClaimPendingCommand(agentId int64, commandId int64) (bool, error)
+	RequeueCommand(agentId int64, commandId int64) error
+	ExpirePendingCommands(agentId int64) (int64, error)
+	GetPendingCommands(agentId int64) ([]databaseModels.Command, error)
 	GetAgents() ([]models.AgentsResponse, error)
+	GetAgentsInventory() ([]models.AgentInventory, error)
 	GetAgentCommands(agentId int64) ([]databaseModels.Command, error)
+	RegisterUser(username string, passwordHash string, role string) (int64, string, error)
+	GetUserByUsername(username string) (databaseModels.User, error)
+	CreateSession(userId int64, tokenHash string, expiresAt time.Time) error
+	GetUserBySession(tokenHash string) (databaseModels.User, error)
+	DeleteSession(tokenHash string) error
+	GetUsers() ([]databaseModels.User, error)
+	UpdateUserRole(userId int64, role string) error
+	DeleteUser(userId int64) error
+	DeleteAgent(agentId int64) ([]string, error)
+	DeleteMachine(machineId int64) error
+	SetAgentSecretHash(agentId int64, secretHash string) error
+	GetAgentSecretHash(agentId int64) (string, error)
+	SetAgentConnected(agentId int64, connectedAt time.Time) error
+	SetAgentDisconnected(agentId int64, lastSeen time.Time, disconnectedAt time.Time) error
+	SetAgentLastSeen(agentId int64, lastSeen time.Time) error
+	RegisterAgentConnectionEvent(event databaseModels.AgentConnectionEvent) error
+	FinishInterruptedAgentConnections() (int64, error)
+	GetAgentConnectionEvents(agentIds []int64, from time.Time, to time.Time) ([]databaseModels.AgentConnectionEvent, []databaseModels.AgentConnectionEvent, error)
+	CreateEnrollmentToken(token databaseModels.EnrollmentToken, tokenHash string) (int64, error)
+	GetEnrollmentTokens() ([]databaseModels.EnrollmentToken, error)
+	UseEnrollmentToken(tokenHash string) (databaseModels.EnrollmentToken, error)
+	ReleaseEnrollmentToken(tokenId int64) error
+	DeleteEnrollmentToken(tokenId int64) error
+	AgentExists(agentId int64) (bool, error)
+	AddAgentTags(agentId int64, tags []string) error
+	GetAgentTags(agentId int64) ([]string, error)
+	RemoveAgentTag(agentId int64, tag string) error
+	CreateCommandBatch(batch databaseModels.CommandBatch) (int64, error)
+	GetCommandBatch(batchId int64) (databaseModels.CommandBatch, error)
+	GetBatchCommands(batchId int64) ([]databaseModels.Command, error)
+	RegisterAgentCertificate(agentId int64, serialNumber string, expiresAt time.Time) error
+	IsAgentCertificateValid(agentId int64, serialNumber string) (bool, error)
+	RevokeAgentCertificates(agentId int64) (int64, error)
+	RegisterAuditEntry(entry databaseModels.AuditEntry) error
+	GetAuditEntries(filter models.AuditFilter) ([]databaseModels.AuditEntry, int64, error)
+	CreateShellSession(session databaseModels.ShellSession) (int64, error)
+	FinishShellSession(sessionId string, reason string, exitCode *int, recordingSize int64, endedAt time.Time) error
+	FinishInterruptedShellSessions() (int64, error)
+	GetAgentShellSessions(agentId int64) ([]databaseModels.ShellSession, error)
+	GetShellSession(agentId int64, sessionId string) (databaseModels.ShellSession, error)
 }
@@ -2,7 +2,10 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -143,12 +146,338 @@ func (mysql *MysqlConnection) createTables() error {
 		return err
 	}
 
+	//Create the table for the operator accounts
+	query = `
+		CREATE TABLE IF NOT EXISTS users (
+			id INT PRIMARY KEY AUTO_INCREMENT,
+			username VARCHAR(64) NOT NULL UNIQUE,
+			password_hash VARCHAR(255) NOT NULL,
+			role VARCHAR(16) NOT NULL DEFAULT 'viewer',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`
+	//Execute the query to create the users table
+	_, err = mysql.conn.Exec(query)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return err
+	}
+
+	//Create the table for the operator sessions (only the hash of the token is stored)
+	query = `
+		CREATE TABLE IF NOT EXISTS sessions (
+			id INT PRIMARY KEY AUTO_INCREMENT,
+			id_user INT NOT NULL,
+			token_hash CHAR(64) NOT NULL UNIQUE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME NOT NULL
+		)
+	`
+	//Execute the query to create the sessions table
+	_, err = mysql.conn.Exec(query)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return err
+	}
+
+	//Create the table for the enrollment tokens used to register the agents (only the hash of the token is stored)
+	query = `
+		CREATE TABLE IF NOT EXISTS enrollment_tokens (
+			id INT PRIMARY KEY AUTO_INCREMENT,
+			token_hash CHAR(64) NOT NULL UNIQUE,
+			description VARCHAR(255),
+			max_uses INT NOT NULL DEFAULT 1,
+			uses INT NOT NULL DEFAULT 0,
+			expires_at DATETIME NULL,
+			tags TEXT,
+			created_by INT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`
+	//Execute the query to create the enrollment_tokens table
+	_, err = mysql.conn.Exec(query)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return err
+	}
+
+	//Create the table for the client certificates issued to the agents
+	query = `
+		CREATE TABLE IF NOT EXISTS agent_certificates (
+			id INT PRIMARY KEY AUTO_INCREMENT,
+			id_agent INT NOT NULL,
+			serial_number VARCHAR(64) NOT NULL UNIQUE,
+			expires_at DATETIME NOT NULL,
+			revoked BOOLEAN NOT NULL DEFAULT FALSE,
+			revoked_at DATETIME NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`
+	//Execute the query to create the agent_certificates table
+	_, err = mysql.conn.Exec(query)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return err
+	}
+
+	//Create the table for the audit log of the operator actions
+	query = `
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id INT PRIMARY KEY AUTO_INCREMENT,
+			id_user INT NOT NULL DEFAULT 0,
+			username VARCHAR(64),
+			action VARCHAR(64) NOT NULL,
+			method VARCHAR(8) NOT NULL,
+			path TEXT NOT NULL,
+			source_ip VARCHAR(64),
+			id_agent INT NULL,
+			payload MEDIUMTEXT,
+			status_code INT NOT NULL,
+			created_at DATETIME(3) NOT NULL,
+			INDEX audit_created_at (created_at),
+			INDEX audit_agent (id_agent, created_at),
+			INDEX audit_username (username, created_at)
+		)
+	`
+	//Execute the query to create the audit_log table
+	_, err = mysql.conn.Exec(query)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return err
+	}
+
+	//Create the table for the tags of the agents
+	query = `
+		CREATE TABLE IF NOT EXISTS agent_tags (
+			id INT PRIMARY KEY AUTO_INCREMENT,
+			id_agent INT NOT NULL,
+			tag VARCHAR(64) NOT NULL,
+			UNIQUE KEY agent_tag (id_agent, tag)
+		)
+	`
+	//Execute the query to create the agent_tags table
+	_, err = mysql.conn.Exec(query)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return err
+	}
+
+	//Create the table for the commands executed on multiple agents at once
+	query = `
+		CREATE TABLE IF NOT EXISTS command_batches (
+			id INT PRIMARY KEY AUTO_INCREMENT,
+			command TEXT NOT NULL,
+			target TEXT,
+			created_by VARCHAR(64),
+			created_at DATETIME(3) NOT NULL
+		)
+	`
+	//Execute the query to create the command_batches table
+	_, err = mysql.conn.Exec(query)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return err
+	}
+
+	//Create the table for the interactive shell sessions (the input and output are saved in recording files)
+	query = `
+		CREATE TABLE IF NOT EXISTS shell_sessions (
+			id INT PRIMARY KEY AUTO_INCREMENT,
+			session_id CHAR(32) NOT NULL UNIQUE,
+			id_agent INT NOT NULL,
+			username VARCHAR(64) NOT NULL,
+			terminal_rows INT NOT NULL,
+			terminal_cols INT NOT NULL,
+			recording VARCHAR(255) NOT NULL,
+			recording_size BIGINT NOT NULL DEFAULT 0,
+			reason TEXT,
+			exit_code INT NULL,
+			started_at DATETIME(3) NOT NULL,
+			ended_at DATETIME(3) NULL,
+			INDEX shell_sessions_agent (id_agent, started_at)
+		)
+	`
+	//Execute the query to create the shell_sessions table
+	_, err = mysql.conn.Exec(query)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return err
+	}
+
+	//Create the table for the history of the connections of the agents to the websocket
+	query = `
+		CREATE TABLE IF NOT EXISTS agent_connections (
+			id INT PRIMARY KEY AUTO_INCREMENT,
+			id_agent INT NOT NULL,
+			event VARCHAR(16) NOT NULL,
+			remote_address VARCHAR(64),
+			reason TEXT,
+			created_at DATETIME(3) NOT NULL,
+			INDEX agent_connections_agent (id_agent, created_at)
+		)
+	`
+	//Execute the query to create the agent_connections table
+	_, err = mysql.conn.Exec(query)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Add a column to an existing table if it does not exist already
+// This is used to update the tables created by older versions of the server
+func (mysql *MysqlConnection) addColumnIfNotExists(table string, column string, definition string) error {
+	query := `
+		SELECT COUNT(*)
+		FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?
+	`
+	var count int64
+	//Execute the query
+	err := mysql.conn.QueryRow(query, table, column).Scan(&count)
+	if err != nil || count != 0 {
+		return err
+	}
+	_, err = mysql.conn.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// Change the type of a column if it has a different type, the table is not rebuilt on every start
+func (mysql *MysqlConnection) changeColumnTypeIfDifferent(table string, column string, dataType string, definition string) error {
+	query := `
+		SELECT DATA_TYPE
+		FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?
+	`
+	var currentType string
+	//Execute the query
+	err := mysql.conn.QueryRow(query, table, column).Scan(&currentType)
+	if err != nil || strings.EqualFold(currentType, dataType) {
+		return err
+	}
+	_, err = mysql.conn.Exec(fmt.Sprintf("ALTER TABLE %s MODIFY %s %s", table, column, definition))
+	return err
+}
+
+// Add an index to an existing table if it does not exist already
+func (mysql *MysqlConnection) addIndexIfNotExists(table string, index string, columns string) error {
+	query := `
+		SELECT COUNT(*)
+		FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?
+	`
+	var count int64
+	//Execute the query
+	err := mysql.conn.QueryRow(query, table, index).Scan(&count)
+	if err != nil || count != 0 {
+		return err
+	}
+	_, err = mysql.conn.Exec(fmt.Sprintf("CREATE INDEX %s ON %s (%s)", index, table, columns))
+	return err
+}
+
+// Add the columns which were introduced after the tables were first created
+func (mysql *MysqlConnection) migrateTables() error {
+	//The hash of the secret the agent uses to authenticate on the websocket
+	err := mysql.addColumnIfNotExists("agents", "secret_hash", "CHAR(64)")
+	if err != nil {
+		return err
+	}
+	//When the agent was last seen, connected and disconnected
+	for _, column := range []string{"last_seen", "connected_at", "disconnected_at"} {
+		err = mysql.addColumnIfNotExists("agents", column, "DATETIME(3) NULL")
+		if err != nil {
+			return err
+		}
+	}
+
+	//The lifecycle of the commands (status, timestamps, exit code and standard error)
+	commandColumns := [][2]string{
+		{"status", "VARCHAR(16) NOT NULL DEFAULT 'pending'"},
+		{"stderr", "MEDIUMTEXT"},
+		{"exit_code", "INT NULL"},
+		{"created_at", "DATETIME(3) NULL"},
+		{"sent_at", "DATETIME(3) NULL"},
+		{"started_at", "DATETIME(3) NULL"},
+		{"finished_at", "DATETIME(3) NULL"},
+	}
+	for _, column := range commandColumns {
+		err = mysql.addColumnIfNotExists("commands", column[0], column[1])
+		if err != nil {
+			return err
+		}
+	}
+	//The commands created before the lifecycle was tracked must not be treated as queued commands
+	_, err = mysql.conn.Exec("UPDATE commands SET status = IF(output <> '', 'succeeded', 'sent') WHERE created_at IS NULL AND status = 'pending'")
+	if err != nil {
+		return err
+	}
+	//The moment after which a queued command is not sent anymore
+	err = mysql.addColumnIfNotExists("commands", "expires_at", "DATETIME(3) NULL")
+	if err != nil {
+		return err
+	}
+	//The number of seconds after which the agent kills the command
+	err = mysql.addColumnIfNotExists("commands", "timeout", "INT NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	//The batch the command is part of (if it was executed on multiple agents at once)
+	err = mysql.addColumnIfNotExists("commands", "id_batch", "INT NULL")
+	if err != nil {
+		return err
+	}
+	err = mysql.addIndexIfNotExists("commands", "commands_batch", "id_batch")
+	if err != nil {
+		return err
+	}
+	//The output of the commands is streamed in chunks, the sequence of the last chunk is kept so the chunks are applied in order
+	err = mysql.addColumnIfNotExists("commands", "output_sequence", "INT NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	//The streamed outputs can be larger than a TEXT column
+	err = mysql.changeColumnTypeIfDifferent("commands", "output", "mediumtext", "MEDIUMTEXT")
+	if err != nil {
+		return err
+	}
+	//If chunks of the output are missing (they could not be saved or the output is too large) the output is marked as incomplete
+	err = mysql.addColumnIfNotExists("commands", "output_incomplete", "BOOLEAN NOT NULL DEFAULT FALSE")
+	if err != nil {
+		return err
+	}
+
+	//The recurring commands can be paused by the operators
+	err = mysql.addColumnIfNotExists("recurring_commands", "paused", "BOOLEAN NOT NULL DEFAULT FALSE")
+	if err != nil {
+		return err
+	}
+	//The recurring commands can run on a schedule instead of a fixed interval
+	err = mysql.addColumnIfNotExists("recurring_commands", "schedule", "VARCHAR(255) NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	//The last time a recurring command ran, the failed runs do not produce an output but they are still runs
+	err = mysql.addColumnIfNotExists("recurring_commands", "last_run", "DATETIME(3) NULL")
+	if err != nil {
+		return err
+	}
+
+	//The outputs of a recurring command are queried by time range
+	err = mysql.addIndexIfNotExists("recurring_commands_outputs", "recurring_outputs_timestamp", "id_recurring_command, output_timestamp")
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
 func (mysql *MysqlConnection) Init() error {
 	//Create the connection string
-	connString := fmt.Sprintf("%s:%s@tcp(%s)/%s", mysql.config.DatabaseUsername, mysql.config.DatabasePassword, mysql.config.DatabaseIPAddress, mysql.config.DatabaseName)
+	connString := fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true", mysql.config.DatabaseUsername, mysql.config.DatabasePassword, mysql.config.DatabaseIPAddress, mysql.config.DatabaseName)
 	//Initialize the database connection
 	dbConn, err := sql.Open("mysql", connString)
 	//Check if an error occured when initializing the connection
@@ -163,6 +492,12 @@ func (mysql *MysqlConnection) Init() error {
 
 	//Create the tables of the database if they do not exist
 	err = mysql.createTables()
+	if err != nil {
+		return err
+	}
+
+	//Add the new columns to the existing tables
+	err = mysql.migrateTables()
 
 	return err
 }
@@ -230,13 +565,19 @@ func (mysql *MysqlConnection) RegisterAgentOSGroups(idAgent int64, groups []mode
 	return nil
 }
 
-func (mysql *MysqlConnection) RegisterCommand(agentId int64, command string) (int64, error) {
+func (mysql *MysqlConnection) RegisterCommand(agentId int64, command string, timeout int64, expiresAt *time.Time, batchId int64) (int64, error) {
 	query := `
-		INSERT INTO commands (id_agent, command, output)
-		VALUES (?,?,?)
+		INSERT INTO commands (id_agent, command, output, status, created_at, expires_at, timeout, id_batch)
+		VALUES (?,?,?,?,?,?,?,?)
 	`
+	var expires sql.NullTime
+	if expiresAt != nil {
+		expires = sql.NullTime{Time: expiresAt.UTC(), Valid: true}
+	}
+	//The commands executed on a single agent are not part of a batch
+	batch := sql.NullInt64{Int64: batchId, Valid: batchId != 0}
 	//Execute the query
-	res, err := mysql.conn.Exec(query, agentId, command, "")
+	res, err := mysql.conn.Exec(query, agentId, command, "", databaseModels.CommandStatusPending, time.Now().UTC(), expires, timeout, batch)
 	if err != nil {
 		return -1, err
 	}
@@ -244,82 +585,1591 @@ func (mysql *MysqlConnection) RegisterCommand(agentId int64, command string) (in
 	return commandId, err
 }
 
-func (mysql *MysqlConnection) SetCommandOutput(commandId int64, output string) error {
+func (mysql *MysqlConnection) SetCommandStatus(agentId int64, commandId int64, status string) error {
+	//The status can only move forward (the running message of the agent can arrive before the command is marked as sent)
+	var query string
+	switch status {
+	case databaseModels.CommandStatusSent:
+		query = `
+			UPDATE commands SET status = ?, sent_at = ?
+			WHERE id_agent = ? AND id = ? AND status = 'pending'
+		`
+	case databaseModels.CommandStatusRunning:
+		query = `
+			UPDATE commands SET status = ?, sent_at = COALESCE(sent_at, ?), started_at = ?
+			WHERE id_agent = ? AND id = ? AND status IN ('pending', 'sent')
+		`
+	default:
+		return errors.New("invalid intermediate command status " + status)
+	}
+	now := time.Now().UTC()
+	args := []any{status, now}
+	if status == databaseModels.CommandStatusRunning {
+		args = append(args, now)
+	}
+	//Execute the query
+	_, err := mysql.conn.Exec(query, append(args, agentId, commandId)...)
+	return err
+}
+
+func (mysql *MysqlConnection) GetCommand(agentId int64, commandId int64) (databaseModels.Command, error) {
 	query := `
-		UPDATE commands SET output = ?
-		WHERE id = ?
+		SELECT id, id_agent, id_batch, command, output, stderr, status, exit_code, created_at, sent_at, started_at, finished_at, expires_at, timeout, output_sequence, output_incomplete
+		FROM commands
+		WHERE id_agent = ? AND id = ?
+	`
+	//Execute the query
+	command, err := scanCommand(mysql.conn.QueryRow(query, agentId, commandId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return databaseModels.Command{}, ErrRecordNotFound
+	}
+	return command, err
+}
+
+func (mysql *MysqlConnection) CancelQueuedCommand(agentId int64, commandId int64) (bool, error) {
+	//Only the commands which were not sent yet can be cancelled without the agent
+	query := `
+		UPDATE commands SET status = ?, finished_at = ?
+		WHERE id_agent = ? AND id = ? AND status = 'pending'
+	`
+	//Execute the query
+	res, err := mysql.conn.Exec(query, databaseModels.CommandStatusCancelled, time.Now().UTC(), agentId, commandId)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
+
+func (mysql *MysqlConnection) ClaimPendingCommand(agentId int64, commandId int64) (bool, error) {
+	//Only one caller can move the command out of the queue so it is not sent twice
+	query := `
+		UPDATE commands SET status = ?, sent_at = ?
+		WHERE id_agent = ? AND id = ? AND status = 'pending'
+	`
+	//Execute the query
+	res, err := mysql.conn.Exec(query, databaseModels.CommandStatusSent, time.Now().UTC(), agentId, commandId)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
+
+func (mysql *MysqlConnection) RequeueCommand(agentId int64, commandId int64) error {
+	query := `
+		UPDATE commands SET status = ?, sent_at = NULL
+		WHERE id_agent = ? AND id = ? AND status = 'sent'
 	`
 	//Execute the query
-	_, err := mysql.conn.Exec(query, output, commandId)
+	_, err := mysql.conn.Exec(query, databaseModels.CommandStatusPending, agentId, commandId)
 	return err
 }
 
-func (mysql *MysqlConnection) RegisterRecurringCommand(agentId int64, command string, interval int64) (int64, error) {
+func (mysql *MysqlConnection) ExpirePendingCommands(agentId int64) (int64, error) {
 	query := `
-	INSERT INTO recurring_commands (id_agent, command, recurring_interval)
-	VALUES (?,?,?)
+		UPDATE commands SET status = ?, finished_at = ?
+		WHERE id_agent = ? AND status = 'pending' AND expires_at IS NOT NULL AND expires_at <= ?
 	`
+	now := time.Now().UTC()
 	//Execute the query
-	res, err := mysql.conn.Exec(query, agentId, command, interval)
+	res, err := mysql.conn.Exec(query, databaseModels.CommandStatusExpired, now, agentId, now)
 	if err != nil {
-		return -1, err
+		return 0, err
 	}
-	commandId, err := res.LastInsertId()
-	return commandId, err
+	return res.RowsAffected()
 }
 
-func (mysql *MysqlConnection) GetAgents() ([]models.AgentsResponse, error) {
-	//Prepare the query to get the agents
+func (mysql *MysqlConnection) GetPendingCommands(agentId int64) ([]databaseModels.Command, error) {
+	//The queued commands are returned in the order they were created
 	query := `
-		SELECT id, name, username, display_name, os_user_id, os_user_group_id, home_directory
-		FROM agents
+		SELECT id, id_agent, id_batch, command, output, stderr, status, exit_code, created_at, sent_at, started_at, finished_at, expires_at, timeout, output_sequence, output_incomplete
+		FROM commands
+		WHERE id_agent = ? AND status = 'pending' AND (expires_at IS NULL OR expires_at > ?)
+		ORDER BY id ASC
 	`
 	//Execute the query
-	rows, err := mysql.conn.Query(query)
+	rows, err := mysql.conn.Query(query, agentId, time.Now().UTC())
 	//Check if an error occured when executing the query
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	aux := models.AgentsResponse{}
-	returnData := make([]models.AgentsResponse, 0)
+	returnData := make([]databaseModels.Command, 0)
 	for rows.Next() {
-		var name sql.NullString
-		var os_user_group_id sql.NullString
-		err := rows.Scan(&aux.Id, &name, &aux.Username, &aux.DisplayName, &aux.OsUserId, &os_user_group_id, &aux.HomeDirectory)
+		aux, err := scanCommand(rows)
 		if err != nil {
 			return nil, err
 		}
-		aux.Name = name.String
-		aux.OsUserGroupId = os_user_group_id.String
 		returnData = append(returnData, aux)
 	}
 	return returnData, nil
 }
 
-func (mysql *MysqlConnection) GetAgentCommands(agentId int64) ([]databaseModels.Command, error) {
+// The output is marked as incomplete if the agent dropped a part of it
+func (mysql *MysqlConnection) SetCommandResult(agentId int64, commandId int64, status string, stdout string, stderr string, exitCode int, incomplete bool) error {
+	//Only the commands of the agent which are not finished can be updated (an agent cannot overwrite the commands of others)
 	query := `
-		SELECT id, command, output
-		FROM commands
-		WHERE id_agent = ?
-		ORDER BY id DESC
+		UPDATE commands SET status = ?, output = ?, stderr = ?, exit_code = ?, output_incomplete = output_incomplete OR ?, finished_at = ?
+		WHERE id_agent = ? AND id = ? AND status IN ('pending', 'sent', 'running')
 	`
 	//Execute the query
-	rows, err := mysql.conn.Query(query, agentId)
-	//Check if an error occured when executing the query
+	_, err := mysql.conn.Exec(query, status, stdout, stderr, exitCode, incomplete, time.Now().UTC(), agentId, commandId)
+	return err
+}
+
+// The maximum size of the output and of the standard error of a command saved from the chunks (a MEDIUMTEXT holds 16MB)
+// The output after it is not saved and the output is marked as incomplete
+const maxStreamedOutputSize = 8 * 1024 * 1024
+
+// Append a chunk of the output streamed by the agent to the command
+// A chunk is applied if it is newer than the last applied chunk, false is returned for duplicated or older chunks
+// If chunks are missing before it (they could not be saved) or the output is too large the output is marked as incomplete
+func (mysql *MysqlConnection) AppendCommandOutput(agentId int64, commandId int64, sequence int64, stream string, data string) (bool, error) {
+	column := "output"
+	if stream == "stderr" {
+		column = "stderr"
+	}
+	//MySQL assigns the columns from left to right, the incomplete flag is computed from the values before the chunk
+	query := `
+		UPDATE commands SET
+			output_incomplete = output_incomplete OR ? <> output_sequence + 1 OR LENGTH(COALESCE(` + column + `, '')) + LENGTH(?) > ?,
+			` + column + ` = IF(LENGTH(COALESCE(` + column + `, '')) + LENGTH(?) > ?, ` + column + `, CONCAT(COALESCE(` + column + `, ''), ?)),
+			output_sequence = ?
+		WHERE id_agent = ? AND id = ? AND output_sequence < ? AND status IN ('sent', 'running')
+	`
+	//Execute the query
+	res, err := mysql.conn.Exec(query, sequence, data, maxStreamedOutputSize, data, maxStreamedOutputSize, data, sequence, agentId, commandId, sequence)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
+
+// Set the final state of a command whose output was streamed in chunks
+// The output which the agent could not stream is appended to the output saved from the chunks
+// The output is marked as incomplete if the last chunk saved is not the last chunk the agent sent or if the agent dropped a part of it
+func (mysql *MysqlConnection) FinishStreamedCommand(agentId int64, commandId int64, status string, stdout string, stderr string, exitCode int, chunks int64, incomplete bool) error {
+	query := `
+		UPDATE commands SET status = ?,
+			output_incomplete = output_incomplete OR ? OR output_sequence <> ? OR LENGTH(COALESCE(output, '')) + LENGTH(?) > ? OR LENGTH(COALESCE(stderr, '')) + LENGTH(?) > ?,
+			output = IF(LENGTH(COALESCE(output, '')) + LENGTH(?) > ?, output, CONCAT(COALESCE(output, ''), ?)),
+			stderr = IF(LENGTH(COALESCE(stderr, '')) + LENGTH(?) > ?, stderr, CONCAT(COALESCE(stderr, ''), ?)),
+			exit_code = ?, finished_at = ?
+		WHERE id_agent = ? AND id = ? AND status IN ('pending', 'sent', 'running')
+	`
+	args := []any{status, incomplete, chunks, stdout, maxStreamedOutputSize, stderr, maxStreamedOutputSize}
+	args = append(args, stdout, maxStreamedOutputSize, stdout, stderr, maxStreamedOutputSize, stderr)
+	args = append(args, exitCode, time.Now().UTC(), agentId, commandId)
+	//Execute the query
+	_, err := mysql.conn.Exec(query, args...)
+	return err
+}
+
+// Fail the commands which were sent to the agent before it connected and which it does not report after it connected again
+// The agent lost these commands or their results, the ids of the failed commands are returned
+func (mysql *MysqlConnection) FailUnreportedCommands(agentId int64, reported []int64, sentBefore time.Time, reason string) ([]int64, error) {
+	reportedCondition := ""
+	args := []any{agentId, sentBefore.UTC()}
+	if len(reported) != 0 {
+		reportedCondition = " AND id NOT IN (?" + strings.Repeat(",?", len(reported)-1) + ")"
+		for _, commandId := range reported {
+			args = append(args, commandId)
+		}
+	}
+
+	tx, err := mysql.conn.Begin()
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	aux := databaseModels.Command{}
-	returnData := make([]databaseModels.Command, 0)
+	defer tx.Rollback()
+
+	//The commands are locked so a result saved at the same time is not overwritten
+	query := `
+		SELECT id
+		FROM commands
+		WHERE id_agent = ? AND status IN ('sent', 'running') AND sent_at < ?` + reportedCondition + `
+		FOR UPDATE
+	`
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	failed := make([]int64, 0)
+	failedArgs := make([]any, 0)
+	for rows.Next() {
+		var commandId int64
+		err = rows.Scan(&commandId)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		failed = append(failed, commandId)
+		failedArgs = append(failedArgs, commandId)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(failed) == 0 {
+		return failed, nil
+	}
+
+	//The output streamed before the command was lost is kept, MySQL assigns the columns from left to right so the incomplete flag uses the old status
+	query = `
+		UPDATE commands SET
+			output_incomplete = output_incomplete OR status = 'running',
+			status = ?, stderr = CONCAT_WS('\n', NULLIF(stderr, ''), ?), exit_code = ?, finished_at = ?
+		WHERE id_agent = ? AND id IN (?` + strings.Repeat(",?", len(failed)-1) + `)
+	`
+	//Execute the query
+	_, err = tx.Exec(query, append([]any{databaseModels.CommandStatusFailed, reason, -1, time.Now().UTC(), agentId}, failedArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	return failed, tx.Commit()
+}
+
+func (mysql *MysqlConnection) RegisterRecurringCommand(agentId int64, command string, interval int64, schedule string) (int64, error) {
+	query := `
+	INSERT INTO recurring_commands (id_agent, command, recurring_interval, schedule)
+	VALUES (?,?,?,?)
+	`
+	//Execute the query
+	res, err := mysql.conn.Exec(query, agentId, command, interval, schedule)
+	if err != nil {
+		return -1, err
+	}
+	commandId, err := res.LastInsertId()
+	return commandId, err
+}
+
+// Create the same recurring command on several agents in a single transaction, either all the commands are created or none
+func (mysql *MysqlConnection) RegisterRecurringCommands(agentIds []int64, command string, interval int64, schedule string) ([]databaseModels.RecurringCommand, error) {
+	query := `
+	INSERT INTO recurring_commands (id_agent, command, recurring_interval, schedule)
+	VALUES (?,?,?,?)
+	`
+	tx, err := mysql.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	recurringCommands := make([]databaseModels.RecurringCommand, 0, len(agentIds))
+	for _, agentId := range agentIds {
+		//Execute the query
+		res, err := tx.Exec(query, agentId, command, interval, schedule)
+		if err != nil {
+			return nil, err
+		}
+		commandId, err := res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		aux, err := scanRecurringCommand(tx.QueryRow(getRecurringCommandQuery, commandId))
+		if err != nil {
+			return nil, err
+		}
+		recurringCommands = append(recurringCommands, aux)
+	}
+	return recurringCommands, tx.Commit()
+}
+
+func (mysql *MysqlConnection) GetAgentRecurringCommands(agentId int64) ([]databaseModels.RecurringCommand, error) {
+	query := `
+		SELECT id, id_agent, command, recurring_interval, schedule, start_time, paused,
+			COALESCE(last_run, (SELECT MAX(output_timestamp) FROM recurring_commands_outputs WHERE id_recurring_command = recurring_commands.id))
+		FROM recurring_commands
+		WHERE id_agent = ?
+		ORDER BY id ASC
+	`
+	//Execute the query
+	rows, err := mysql.conn.Query(query, agentId)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	returnData := make([]databaseModels.RecurringCommand, 0)
+	for rows.Next() {
+		aux, err := scanRecurringCommand(rows)
+		if err != nil {
+			return nil, err
+		}
+		returnData = append(returnData, aux)
+	}
+	return returnData, nil
+}
+
+// The query which gets a recurring command with the columns scanned by scanRecurringCommand
+const getRecurringCommandQuery = `
+	SELECT id, id_agent, command, recurring_interval, schedule, start_time, paused,
+		COALESCE(last_run, (SELECT MAX(output_timestamp) FROM recurring_commands_outputs WHERE id_recurring_command = recurring_commands.id))
+	FROM recurring_commands
+	WHERE id = ?
+`
+
+func (mysql *MysqlConnection) GetRecurringCommand(recurringCommandId int64) (databaseModels.RecurringCommand, error) {
+	//Execute the query
+	aux, err := scanRecurringCommand(mysql.conn.QueryRow(getRecurringCommandQuery, recurringCommandId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return aux, ErrRecordNotFound
+	}
+	return aux, err
+}
+
+// Scan a recurring command from a row which contains the columns selected by GetAgentRecurringCommands and GetRecurringCommand
+func scanRecurringCommand(row interface{ Scan(dest ...any) error }) (databaseModels.RecurringCommand, error) {
+	aux := databaseModels.RecurringCommand{}
+	var lastRun sql.NullTime
+	err := row.Scan(&aux.Id, &aux.AgentId, &aux.Command, &aux.Interval, &aux.Schedule, &aux.StartTime, &aux.Paused, &lastRun)
+	aux.LastRun = nullTimePointer(lastRun)
+	return aux, err
+}
+
+func (mysql *MysqlConnection) UpdateRecurringCommandSchedule(recurringCommandId int64, interval int64, schedule string) error {
+	query := `
+		UPDATE recurring_commands SET recurring_interval = ?, schedule = ?
+		WHERE id = ?
+	`
+	//Execute the query
+	_, err := mysql.conn.Exec(query, interval, schedule, recurringCommandId)
+	return err
+}
+
+func (mysql *MysqlConnection) SetRecurringCommandPaused(recurringCommandId int64, paused bool) error {
+	query := `
+		UPDATE recurring_commands SET paused = ?
+		WHERE id = ?
+	`
+	//Execute the query
+	_, err := mysql.conn.Exec(query, paused, recurringCommandId)
+	return err
+}
+
+func (mysql *MysqlConnection) DeleteRecurringCommand(recurringCommandId int64) error {
+	//Delete the outputs together with the recurring command
+	tx, err := mysql.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM recurring_commands WHERE id = ?", recurringCommandId)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrRecordNotFound
+	}
+
+	_, err = tx.Exec("DELETE FROM recurring_commands_outputs WHERE id_recurring_command = ?", recurringCommandId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (mysql *MysqlConnection) RegisterRecurringCommandOutput(agentId int64, recurringCommandId int64, output string, timestamp time.Time) error {
+	//The output is saved only if the recurring command belongs to the agent which sent it
+	query := `
+		INSERT INTO recurring_commands_outputs (id_recurring_command, output, output_timestamp)
+		SELECT id, ?, ? FROM recurring_commands
+		WHERE id = ? AND id_agent = ?
+	`
+	//Execute the query
+	res, err := mysql.conn.Exec(query, output, timestamp.UTC(), recurringCommandId, agentId)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Save multiple outputs in a single transaction
+// Returns if every output was saved, an output is not saved if the recurring command does not belong to the agent which sent it
+func (mysql *MysqlConnection) RegisterRecurringCommandOutputs(outputs []databaseModels.AgentRecurringCommandOutput) ([]bool, error) {
+	query := `
+		INSERT INTO recurring_commands_outputs (id_recurring_command, output, output_timestamp)
+		SELECT id, ?, ? FROM recurring_commands
+		WHERE id = ? AND id_agent = ?
+	`
+	tx, err := mysql.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	lastRunStmt, err := tx.Prepare(setRecurringCommandLastRunQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer lastRunStmt.Close()
+
+	saved := make([]bool, len(outputs))
+	for i, output := range outputs {
+		//Execute the query
+		res, err := stmt.Exec(output.Output, output.Timestamp.UTC(), output.RecurringCommandId, output.AgentId)
+		if err != nil {
+			return nil, err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		saved[i] = affected != 0
+		if saved[i] {
+			_, err = lastRunStmt.Exec(output.Timestamp.UTC(), output.RecurringCommandId, output.AgentId, output.Timestamp.UTC())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return saved, tx.Commit()
+}
+
+// The query which moves the last run of a recurring command forward (the runs can be saved out of order)
+const setRecurringCommandLastRunQuery = `
+	UPDATE recurring_commands SET last_run = ?
+	WHERE id = ? AND id_agent = ? AND (last_run IS NULL OR last_run < ?)
+`
+
+// Save a run of a recurring command which did not produce an output (it failed, timed out or was killed)
+func (mysql *MysqlConnection) SetRecurringCommandLastRun(agentId int64, recurringCommandId int64, lastRun time.Time) error {
+	//Execute the query
+	_, err := mysql.conn.Exec(setRecurringCommandLastRunQuery, lastRun.UTC(), recurringCommandId, agentId, lastRun.UTC())
+	return err
+}
+
+func (mysql *MysqlConnection) GetRecurringCommandOutputs(filter models.RecurringOutputsFilter) ([]databaseModels.RecurringCommandOutput, error) {
+	//Build the WHERE clause based on the filters which are set
+	conditions := []string{"id_recurring_command = ?"}
+	args := []any{filter.RecurringCommandId}
+	if filter.From != nil {
+		conditions = append(conditions, "output_timestamp >= ?")
+		args = append(args, filter.From.UTC())
+	}
+	if filter.To != nil {
+		conditions = append(conditions, "output_timestamp <= ?")
+		args = append(args, filter.To.UTC())
+	}
+	if filter.After != nil {
+		conditions = append(conditions, "(output_timestamp > ? OR (output_timestamp = ? AND id > ?))")
+		args = append(args, filter.After.Timestamp.UTC(), filter.After.Timestamp.UTC(), filter.After.Id)
+	}
+
+	query := `
+		SELECT id, id_recurring_command, output, output_timestamp
+		FROM recurring_commands_outputs
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY output_timestamp ASC, id ASC
+		LIMIT ?
+	`
+	//Execute the query
+	rows, err := mysql.conn.Query(query, append(args, filter.Limit)...)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	returnData := make([]databaseModels.RecurringCommandOutput, 0)
+	for rows.Next() {
+		aux, err := scanRecurringCommandOutput(rows)
+		if err != nil {
+			return nil, err
+		}
+		returnData = append(returnData, aux)
+	}
+	return returnData, nil
+}
+
+func (mysql *MysqlConnection) GetLatestRecurringCommandOutput(recurringCommandId int64) (databaseModels.RecurringCommandOutput, error) {
+	query := `
+		SELECT id, id_recurring_command, output, output_timestamp
+		FROM recurring_commands_outputs
+		WHERE id_recurring_command = ?
+		ORDER BY output_timestamp DESC, id DESC
+		LIMIT 1
+	`
+	//Execute the query
+	output, err := scanRecurringCommandOutput(mysql.conn.QueryRow(query, recurringCommandId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return output, ErrRecordNotFound
+	}
+	return output, err
+}
+
+// Scan a recurring command output from a row which contains the columns selected by GetRecurringCommandOutputs
+func scanRecurringCommandOutput(row interface{ Scan(dest ...any) error }) (databaseModels.RecurringCommandOutput, error) {
+	aux := databaseModels.RecurringCommandOutput{}
+	var output sql.NullString
+	err := row.Scan(&aux.Id, &aux.RecurringCommandId, &output, &aux.Timestamp)
+	aux.Output = output.String
+	return aux, err
+}
+
+func (mysql *MysqlConnection) GetAgents() ([]models.AgentsResponse, error) {
+	//Prepare the query to get the agents
+	query := `
+		SELECT id, name, username, display_name, os_user_id, os_user_group_id, home_directory, last_seen, connected_at, disconnected_at
+		FROM agents
+	`
+	//Execute the query
+	rows, err := mysql.conn.Query(query)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	aux := models.AgentsResponse{}
+	returnData := make([]models.AgentsResponse, 0)
+	for rows.Next() {
+		var name sql.NullString
+		var os_user_group_id sql.NullString
+		var lastSeen, connectedAt, disconnectedAt sql.NullTime
+		err := rows.Scan(&aux.Id, &name, &aux.Username, &aux.DisplayName, &aux.OsUserId, &os_user_group_id, &aux.HomeDirectory, &lastSeen, &connectedAt, &disconnectedAt)
+		if err != nil {
+			return nil, err
+		}
+		aux.Name = name.String
+		aux.OsUserGroupId = os_user_group_id.String
+		aux.LastSeen = nullTimePointer(lastSeen)
+		aux.ConnectedAt = nullTimePointer(connectedAt)
+		aux.DisconnectedAt = nullTimePointer(disconnectedAt)
+		aux.Tags = make([]string, 0)
+		returnData = append(returnData, aux)
+	}
+	rows.Close()
+
+	//Add the tags of every agent
+	tagRows, err := mysql.conn.Query("SELECT id_agent, tag FROM agent_tags ORDER BY tag ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer tagRows.Close()
+	agentIndex := make(map[int64]int, len(returnData))
+	for index, agent := range returnData {
+		agentIndex[agent.Id] = index
+	}
+	for tagRows.Next() {
+		var agentId int64
+		var tag string
+		err := tagRows.Scan(&agentId, &tag)
+		if err != nil {
+			return nil, err
+		}
+		if index, found := agentIndex[agentId]; found {
+			returnData[index].Tags = append(returnData[index].Tags, tag)
+		}
+	}
+	return returnData, nil
+}
+
+// Get the agents together with their machine, interfaces and OS groups
+func (mysql *MysqlConnection) GetAgentsInventory() ([]models.AgentInventory, error) {
+	agents, err := mysql.GetAgents()
+	if err != nil {
+		return nil, err
+	}
+	returnData := make([]models.AgentInventory, 0, len(agents))
+	agentIndex := make(map[int64]int, len(agents))
+	for index, agent := range agents {
+		returnData = append(returnData, models.AgentInventory{Agent: agent, IpAddresses: make([]string, 0), Interfaces: make([]string, 0), Groups: make([]string, 0)})
+		agentIndex[agent.Id] = index
+	}
+
+	//Add the machine of every agent
+	query := `
+		SELECT a.id, m.hostname, m.os
+		FROM agents a
+		INNER JOIN machines m ON m.id = a.id_machine
+	`
+	//Execute the query
+	rows, err := mysql.conn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var agentId int64
+		var hostname, os sql.NullString
+		err := rows.Scan(&agentId, &hostname, &os)
+		if err != nil {
+			return nil, err
+		}
+		if index, found := agentIndex[agentId]; found {
+			returnData[index].Hostname = hostname.String
+			returnData[index].Os = os.String
+		}
+	}
+	rows.Close()
+
+	//Add the interfaces of the machine of every agent
+	query = `
+		SELECT a.id, i.name, i.ip_address
+		FROM agents a
+		INNER JOIN interfaces i ON i.id_machine = a.id_machine
+	`
+	//Execute the query
+	interfaceRows, err := mysql.conn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer interfaceRows.Close()
+	for interfaceRows.Next() {
+		var agentId int64
+		var name, ipAddress sql.NullString
+		err := interfaceRows.Scan(&agentId, &name, &ipAddress)
+		if err != nil {
+			return nil, err
+		}
+		if index, found := agentIndex[agentId]; found {
+			if name.String != "" {
+				returnData[index].Interfaces = append(returnData[index].Interfaces, name.String)
+			}
+			if ipAddress.String != "" {
+				returnData[index].IpAddresses = append(returnData[index].IpAddresses, ipAddress.String)
+			}
+		}
+	}
+	interfaceRows.Close()
+
+	//Add the OS groups of every agent
+	groupRows, err := mysql.conn.Query("SELECT id_agent, os_group_name FROM os_groups")
+	if err != nil {
+		return nil, err
+	}
+	defer groupRows.Close()
+	for groupRows.Next() {
+		var agentId int64
+		var name sql.NullString
+		err := groupRows.Scan(&agentId, &name)
+		if err != nil {
+			return nil, err
+		}
+		if index, found := agentIndex[agentId]; found && name.String != "" {
+			returnData[index].Groups = append(returnData[index].Groups, name.String)
+		}
+	}
+	return returnData, nil
+}
+
+func (mysql *MysqlConnection) GetAgentCommands(agentId int64) ([]databaseModels.Command, error) {
+	query := `
+		SELECT id, id_agent, id_batch, command, output, stderr, status, exit_code, created_at, sent_at, started_at, finished_at, expires_at, timeout, output_sequence, output_incomplete
+		FROM commands
+		WHERE id_agent = ?
+		ORDER BY id DESC
+	`
+	//Execute the query
+	rows, err := mysql.conn.Query(query, agentId)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	returnData := make([]databaseModels.Command, 0)
+	for rows.Next() {
+		aux, err := scanCommand(rows)
+		if err != nil {
+			return nil, err
+		}
+		returnData = append(returnData, aux)
+	}
+	return returnData, nil
+}
+
+// Scan a command from a row which contains the columns selected by GetAgentCommands, GetPendingCommands, GetCommand and GetBatchCommands
+func scanCommand(row interface{ Scan(dest ...any) error }) (databaseModels.Command, error) {
+	aux := databaseModels.Command{}
+	var output, stderr sql.NullString
+	var exitCode sql.NullInt64
+	var createdAt, sentAt, startedAt, finishedAt, expiresAt sql.NullTime
+	var batchId sql.NullInt64
+	err := row.Scan(&aux.Id, &aux.AgentId, &batchId, &aux.Command, &output, &stderr, &aux.Status, &exitCode, &createdAt, &sentAt, &startedAt, &finishedAt, &expiresAt, &aux.Timeout, &aux.OutputSequence, &aux.OutputIncomplete)
+	if err != nil {
+		return aux, err
+	}
+	aux.Output = output.String
+	aux.Stderr = stderr.String
+	if exitCode.Valid {
+		code := int(exitCode.Int64)
+		aux.ExitCode = &code
+	}
+	//Commands created before the lifecycle was tracked do not have a creation time
+	aux.CreatedAt = createdAt.Time
+	aux.SentAt = nullTimePointer(sentAt)
+	aux.StartedAt = nullTimePointer(startedAt)
+	aux.FinishedAt = nullTimePointer(finishedAt)
+	aux.ExpiresAt = nullTimePointer(expiresAt)
+	if batchId.Valid {
+		aux.BatchId = &batchId.Int64
+	}
+	return aux, nil
+}
+
+// Convert a nullable time from the database to a pointer (nil if the value is NULL)
+func nullTimePointer(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// Save a new user, the first user of the server gets the admin role and the others get the role passed as parameter
+// The role is chosen by the insert so two registrations on an empty table cannot both become admin (one of them fails)
+func (mysql *MysqlConnection) RegisterUser(username string, passwordHash string, role string) (int64, string, error) {
+	query := `
+		INSERT INTO users (username, password_hash, role)
+		SELECT ?, ?, IF(COUNT(*) = 0, ?, ?) FROM users
+	`
+	//Execute the query
+	res, err := mysql.conn.Exec(query, username, passwordHash, models.RoleAdmin, role)
+	if err != nil {
+		return -1, "", err
+	}
+	userId, err := res.LastInsertId()
+	if err != nil {
+		return -1, "", err
+	}
+	//Get the role which was given to the user
+	query = `
+		SELECT role
+		FROM users
+		WHERE id = ?
+	`
+	err = mysql.conn.QueryRow(query, userId).Scan(&role)
+	return userId, role, err
+}
+
+func (mysql *MysqlConnection) GetUserByUsername(username string) (databaseModels.User, error) {
+	query := `
+		SELECT id, username, password_hash, role
+		FROM users
+		WHERE username = ?
+	`
+	user := databaseModels.User{}
+	//Execute the query
+	err := mysql.conn.QueryRow(query, username).Scan(&user.Id, &user.Username, &user.PasswordHash, &user.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, ErrRecordNotFound
+	}
+	return user, err
+}
+
+func (mysql *MysqlConnection) CreateSession(userId int64, tokenHash string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO sessions (id_user, token_hash, expires_at)
+		VALUES (?,?,?)
+	`
+	//Execute the query
+	_, err := mysql.conn.Exec(query, userId, tokenHash, expiresAt.UTC())
+	return err
+}
+
+func (mysql *MysqlConnection) GetUserBySession(tokenHash string) (databaseModels.User, error) {
+	//Expired sessions are ignored
+	query := `
+		SELECT u.id, u.username, u.password_hash, u.role
+		FROM sessions s
+		INNER JOIN users u ON u.id = s.id_user
+		WHERE s.token_hash = ? AND s.expires_at > UTC_TIMESTAMP()
+	`
+	user := databaseModels.User{}
+	//Execute the query
+	err := mysql.conn.QueryRow(query, tokenHash).Scan(&user.Id, &user.Username, &user.PasswordHash, &user.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, ErrRecordNotFound
+	}
+	return user, err
+}
+
+func (mysql *MysqlConnection) DeleteSession(tokenHash string) error {
+	query := `
+		DELETE FROM sessions
+		WHERE token_hash = ?
+	`
+	//Execute the query
+	_, err := mysql.conn.Exec(query, tokenHash)
+	return err
+}
+
+func (mysql *MysqlConnection) GetUsers() ([]databaseModels.User, error) {
+	query := `
+		SELECT id, username, role
+		FROM users
+		ORDER BY id
+	`
+	//Execute the query
+	rows, err := mysql.conn.Query(query)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	aux := databaseModels.User{}
+	returnData := make([]databaseModels.User, 0)
+	for rows.Next() {
+		err := rows.Scan(&aux.Id, &aux.Username, &aux.Role)
+		if err != nil {
+			return nil, err
+		}
+		returnData = append(returnData, aux)
+	}
+	return returnData, nil
+}
+
+func (mysql *MysqlConnection) UpdateUserRole(userId int64, role string) error {
+	query := `
+		UPDATE users SET role = ?
+		WHERE id = ?
+	`
+	//Execute the query
+	res, err := mysql.conn.Exec(query, role, userId)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		//Check if the user exists (MySQL does not count the row as affected if the role did not change)
+		err = mysql.conn.QueryRow("SELECT id FROM users WHERE id = ?", userId).Scan(&userId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRecordNotFound
+		}
+	}
+	return err
+}
+
+func (mysql *MysqlConnection) DeleteUser(userId int64) error {
+	//Delete the sessions of the user so the tokens cannot be used anymore
+	_, err := mysql.conn.Exec("DELETE FROM sessions WHERE id_user = ?", userId)
+	if err != nil {
+		return err
+	}
+	res, err := mysql.conn.Exec("DELETE FROM users WHERE id = ?", userId)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		return ErrRecordNotFound
+	}
+	return err
+}
+
+// Delete an agent and everything associated with it
+// The recording files of the deleted shell sessions are returned, they are removed by the caller after the commit
+func (mysql *MysqlConnection) DeleteAgent(agentId int64) ([]string, error) {
+	//Delete everything associated with the agent in a single transaction
+	tx, err := mysql.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM agents WHERE id = ?", agentId)
+	if err != nil {
+		return nil, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	//Get the recordings before the shell sessions are deleted
+	query := `
+		SELECT recording
+		FROM shell_sessions
+		WHERE id_agent = ?
+	`
+	rows, err := tx.Query(query, agentId)
+	if err != nil {
+		return nil, err
+	}
+	recordings := make([]string, 0)
+	for rows.Next() {
+		var recording string
+		err = rows.Scan(&recording)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		recordings = append(recordings, recording)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	queries := []string{
+		"DELETE FROM os_groups WHERE id_agent = ?",
+		"DELETE FROM agent_tags WHERE id_agent = ?",
+		"DELETE FROM agent_certificates WHERE id_agent = ?",
+		"DELETE FROM agent_connections WHERE id_agent = ?",
+		"DELETE FROM commands WHERE id_agent = ?",
+		"DELETE FROM recurring_commands_outputs WHERE id_recurring_command IN (SELECT id FROM recurring_commands WHERE id_agent = ?)",
+		"DELETE FROM recurring_commands WHERE id_agent = ?",
+		"DELETE FROM shell_sessions WHERE id_agent = ?",
+	}
+	for _, query := range queries {
+		_, err = tx.Exec(query, agentId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return recordings, tx.Commit()
+}
+
+// Delete a machine and its network interfaces (used when the registration of its agent failed)
+func (mysql *MysqlConnection) DeleteMachine(machineId int64) error {
+	tx, err := mysql.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM interfaces WHERE id_machine = ?", machineId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM machines WHERE id = ?", machineId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (mysql *MysqlConnection) SetAgentSecretHash(agentId int64, secretHash string) error {
+	query := `
+		UPDATE agents SET secret_hash = ?
+		WHERE id = ?
+	`
+	//Execute the query
+	_, err := mysql.conn.Exec(query, secretHash, agentId)
+	return err
+}
+
+func (mysql *MysqlConnection) SetAgentConnected(agentId int64, connectedAt time.Time) error {
+	query := `
+		UPDATE agents SET connected_at = ?, last_seen = ?
+		WHERE id = ?
+	`
+	//Execute the query
+	_, err := mysql.conn.Exec(query, connectedAt.UTC(), connectedAt.UTC(), agentId)
+	return err
+}
+
+func (mysql *MysqlConnection) SetAgentDisconnected(agentId int64, lastSeen time.Time, disconnectedAt time.Time) error {
+	query := `
+		UPDATE agents SET disconnected_at = ?, last_seen = ?
+		WHERE id = ?
+	`
+	//Execute the query
+	_, err := mysql.conn.Exec(query, disconnectedAt.UTC(), lastSeen.UTC(), agentId)
+	return err
+}
+
+func (mysql *MysqlConnection) SetAgentLastSeen(agentId int64, lastSeen time.Time) error {
+	query := `
+		UPDATE agents SET last_seen = ?
+		WHERE id = ?
+	`
+	//Execute the query
+	_, err := mysql.conn.Exec(query, lastSeen.UTC(), agentId)
+	return err
+}
+
+func (mysql *MysqlConnection) GetAgentSecretHash(agentId int64) (string, error) {
+	query := `
+		SELECT secret_hash
+		FROM agents
+		WHERE id = ?
+	`
+	var secretHash sql.NullString
+	//Execute the query
+	err := mysql.conn.QueryRow(query, agentId).Scan(&secretHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrRecordNotFound
+	}
+	return secretHash.String, err
+}
+
+func (mysql *MysqlConnection) CreateEnrollmentToken(token databaseModels.EnrollmentToken, tokenHash string) (int64, error) {
+	query := `
+		INSERT INTO enrollment_tokens (token_hash, description, max_uses, expires_at, tags, created_by)
+		VALUES (?,?,?,?,?,?)
+	`
+	//The tags are saved as a JSON array
+	tags, err := json.Marshal(token.Tags)
+	if err != nil {
+		return -1, err
+	}
+	var expiresAt sql.NullTime
+	if token.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: token.ExpiresAt.UTC(), Valid: true}
+	}
+	//Execute the query
+	res, err := mysql.conn.Exec(query, tokenHash, token.Description, token.MaxUses, expiresAt, string(tags), token.CreatedBy)
+	if err != nil {
+		return -1, err
+	}
+	tokenId, err := res.LastInsertId()
+	return tokenId, err
+}
+
+// Scan an enrollment token from a row which contains all the columns except the hash
+func scanEnrollmentToken(row interface{ Scan(dest ...any) error }) (databaseModels.EnrollmentToken, error) {
+	token := databaseModels.EnrollmentToken{}
+	var description sql.NullString
+	var expiresAt sql.NullTime
+	var tags sql.NullString
+	err := row.Scan(&token.Id, &description, &token.MaxUses, &token.Uses, &expiresAt, &tags, &token.CreatedBy, &token.CreatedAt)
+	if err != nil {
+		return token, err
+	}
+	token.Description = description.String
+	if expiresAt.Valid {
+		token.ExpiresAt = &expiresAt.Time
+	}
+	token.Tags = make([]string, 0)
+	if tags.String != "" {
+		err = json.Unmarshal([]byte(tags.String), &token.Tags)
+	}
+	return token, err
+}
+
+func (mysql *MysqlConnection) GetEnrollmentTokens() ([]databaseModels.EnrollmentToken, error) {
+	query := `
+		SELECT id, description, max_uses, uses, expires_at, tags, created_by, created_at
+		FROM enrollment_tokens
+		ORDER BY id DESC
+	`
+	//Execute the query
+	rows, err := mysql.conn.Query(query)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	returnData := make([]databaseModels.EnrollmentToken, 0)
+	for rows.Next() {
+		token, err := scanEnrollmentToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		returnData = append(returnData, token)
+	}
+	return returnData, nil
+}
+
+func (mysql *MysqlConnection) UseEnrollmentToken(tokenHash string) (databaseModels.EnrollmentToken, error) {
+	//Increment the uses only if the token is still valid, this way two agents cannot use the last use of the token at the same time
+	query := `
+		UPDATE enrollment_tokens SET uses = uses + 1
+		WHERE token_hash = ? AND uses < max_uses AND (expires_at IS NULL OR expires_at > UTC_TIMESTAMP())
+	`
+	//Execute the query
+	res, err := mysql.conn.Exec(query, tokenHash)
+	if err != nil {
+		return databaseModels.EnrollmentToken{}, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return databaseModels.EnrollmentToken{}, err
+	}
+	if affected == 0 {
+		return databaseModels.EnrollmentToken{}, ErrRecordNotFound
+	}
+
+	query = `
+		SELECT id, description, max_uses, uses, expires_at, tags, created_by, created_at
+		FROM enrollment_tokens
+		WHERE token_hash = ?
+	`
+	return scanEnrollmentToken(mysql.conn.QueryRow(query, tokenHash))
+}
+
+// Give back a use of the enrollment token when the registration of the agent failed
+func (mysql *MysqlConnection) ReleaseEnrollmentToken(tokenId int64) error {
+	query := `
+		UPDATE enrollment_tokens SET uses = uses - 1
+		WHERE id = ? AND uses > 0
+	`
+	//Execute the query
+	_, err := mysql.conn.Exec(query, tokenId)
+	return err
+}
+
+func (mysql *MysqlConnection) DeleteEnrollmentToken(tokenId int64) error {
+	res, err := mysql.conn.Exec("DELETE FROM enrollment_tokens WHERE id = ?", tokenId)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		return ErrRecordNotFound
+	}
+	return err
+}
+
+func (mysql *MysqlConnection) AgentExists(agentId int64) (bool, error) {
+	var count int64
+	//Execute the query
+	err := mysql.conn.QueryRow("SELECT COUNT(*) FROM agents WHERE id = ?", agentId).Scan(&count)
+	return count != 0, err
+}
+
+func (mysql *MysqlConnection) GetAgentTags(agentId int64) ([]string, error) {
+	query := `
+		SELECT tag
+		FROM agent_tags
+		WHERE id_agent = ?
+		ORDER BY tag ASC
+	`
+	//Execute the query
+	rows, err := mysql.conn.Query(query, agentId)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	returnData := make([]string, 0)
+	for rows.Next() {
+		var tag string
+		err := rows.Scan(&tag)
+		if err != nil {
+			return nil, err
+		}
+		returnData = append(returnData, tag)
+	}
+	return returnData, nil
+}
+
+func (mysql *MysqlConnection) RemoveAgentTag(agentId int64, tag string) error {
+	query := `
+		DELETE FROM agent_tags
+		WHERE id_agent = ? AND tag = ?
+	`
+	//Execute the query
+	res, err := mysql.conn.Exec(query, agentId, tag)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (mysql *MysqlConnection) CreateCommandBatch(batch databaseModels.CommandBatch) (int64, error) {
+	query := `
+		INSERT INTO command_batches (command, target, created_by, created_at)
+		VALUES (?,?,?,?)
+	`
+	//Execute the query
+	res, err := mysql.conn.Exec(query, batch.Command, batch.Target, batch.CreatedBy, batch.CreatedAt.UTC())
+	if err != nil {
+		return -1, err
+	}
+	return res.LastInsertId()
+}
+
+func (mysql *MysqlConnection) GetCommandBatch(batchId int64) (databaseModels.CommandBatch, error) {
+	query := `
+		SELECT id, command, target, created_by, created_at
+		FROM command_batches
+		WHERE id = ?
+	`
+	aux := databaseModels.CommandBatch{}
+	var target, createdBy sql.NullString
+	//Execute the query
+	err := mysql.conn.QueryRow(query, batchId).Scan(&aux.Id, &aux.Command, &target, &createdBy, &aux.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return aux, ErrRecordNotFound
+	}
+	aux.Target = target.String
+	aux.CreatedBy = createdBy.String
+	return aux, err
+}
+
+func (mysql *MysqlConnection) GetBatchCommands(batchId int64) ([]databaseModels.Command, error) {
+	query := `
+		SELECT id, id_agent, id_batch, command, output, stderr, status, exit_code, created_at, sent_at, started_at, finished_at, expires_at, timeout, output_sequence, output_incomplete
+		FROM commands
+		WHERE id_batch = ?
+		ORDER BY id_agent ASC
+	`
+	//Execute the query
+	rows, err := mysql.conn.Query(query, batchId)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	returnData := make([]databaseModels.Command, 0)
+	for rows.Next() {
+		aux, err := scanCommand(rows)
+		if err != nil {
+			return nil, err
+		}
+		returnData = append(returnData, aux)
+	}
+	return returnData, nil
+}
+
+func (mysql *MysqlConnection) AddAgentTags(agentId int64, tags []string) error {
+	for _, tag := range tags {
+		//Prepare the query to insert the tag (duplicate tags are ignored)
+		query := `
+			INSERT IGNORE INTO agent_tags (id_agent, tag)
+			VALUES (?,?)
+		`
+		//Execute the query
+		_, err := mysql.conn.Exec(query, agentId, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mysql *MysqlConnection) RegisterAgentCertificate(agentId int64, serialNumber string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO agent_certificates (id_agent, serial_number, expires_at)
+		VALUES (?,?,?)
+	`
+	//Execute the query
+	_, err := mysql.conn.Exec(query, agentId, serialNumber, expiresAt.UTC())
+	return err
+}
+
+func (mysql *MysqlConnection) IsAgentCertificateValid(agentId int64, serialNumber string) (bool, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM agent_certificates
+		WHERE id_agent = ? AND serial_number = ? AND revoked = FALSE AND expires_at > UTC_TIMESTAMP()
+	`
+	var count int64
+	//Execute the query
+	err := mysql.conn.QueryRow(query, agentId, serialNumber).Scan(&count)
+	return count == 1, err
+}
+
+func (mysql *MysqlConnection) RevokeAgentCertificates(agentId int64) (int64, error) {
+	query := `
+		UPDATE agent_certificates SET revoked = TRUE, revoked_at = UTC_TIMESTAMP()
+		WHERE id_agent = ? AND revoked = FALSE
+	`
+	//Execute the query
+	res, err := mysql.conn.Exec(query, agentId)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (mysql *MysqlConnection) RegisterAuditEntry(entry databaseModels.AuditEntry) error {
+	query := `
+		INSERT INTO audit_log (id_user, username, action, method, path, source_ip, id_agent, payload, status_code, created_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?)
+	`
+	var agentId sql.NullInt64
+	if entry.AgentId != nil {
+		agentId = sql.NullInt64{Int64: *entry.AgentId, Valid: true}
+	}
+	//Execute the query
+	_, err := mysql.conn.Exec(query, entry.UserId, entry.Username, entry.Action, entry.Method, entry.Path, entry.SourceIP, agentId, entry.Payload, entry.StatusCode, entry.CreatedAt.UTC())
+	return err
+}
+
+func (mysql *MysqlConnection) GetAuditEntries(filter models.AuditFilter) ([]databaseModels.AuditEntry, int64, error) {
+	//Build the WHERE clause based on the filters which are set
+	conditions := []string{"1 = 1"}
+	args := []any{}
+	if filter.Username != "" {
+		conditions = append(conditions, "username = ?")
+		args = append(args, filter.Username)
+	}
+	if filter.AgentId != 0 {
+		conditions = append(conditions, "id_agent = ?")
+		args = append(args, filter.AgentId)
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, filter.Action)
+	}
+	if filter.From != nil {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.From.UTC())
+	}
+	if filter.To != nil {
+		conditions = append(conditions, "created_at <= ?")
+		args = append(args, filter.To.UTC())
+	}
+	where := strings.Join(conditions, " AND ")
+
+	//Count all the entries which match the filters
+	var total int64
+	err := mysql.conn.QueryRow("SELECT COUNT(*) FROM audit_log WHERE "+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT id, id_user, username, action, method, path, source_ip, id_agent, payload, status_code, created_at
+		FROM audit_log
+		WHERE ` + where + `
+		ORDER BY created_at DESC, id DESC
+		LIMIT ? OFFSET ?
+	`
+	//Execute the query
+	rows, err := mysql.conn.Query(query, append(args, filter.Limit, filter.Offset)...)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	returnData := make([]databaseModels.AuditEntry, 0)
+	for rows.Next() {
+		aux := databaseModels.AuditEntry{}
+		var username, sourceIP, payload sql.NullString
+		var agentId sql.NullInt64
+		err := rows.Scan(&aux.Id, &aux.UserId, &username, &aux.Action, &aux.Method, &aux.Path, &sourceIP, &agentId, &payload, &aux.StatusCode, &aux.CreatedAt)
+		if err != nil {
+			return nil, 0, err
+		}
+		aux.Username = username.String
+		aux.SourceIP = sourceIP.String
+		aux.Payload = payload.String
+		if agentId.Valid {
+			aux.AgentId = &agentId.Int64
+		}
+		returnData = append(returnData, aux)
+	}
+	return returnData, total, nil
+}
+
+func (mysql *MysqlConnection) CreateShellSession(session databaseModels.ShellSession) (int64, error) {
+	query := `
+		INSERT INTO shell_sessions (session_id, id_agent, username, terminal_rows, terminal_cols, recording, started_at)
+		VALUES (?,?,?,?,?,?,?)
+	`
+	//Execute the query
+	res, err := mysql.conn.Exec(query, session.SessionId, session.AgentId, session.Username, session.Rows, session.Cols, session.Recording, session.StartedAt.UTC())
+	if err != nil {
+		return -1, err
+	}
+	return res.LastInsertId()
+}
+
+func (mysql *MysqlConnection) FinishShellSession(sessionId string, reason string, exitCode *int, recordingSize int64, endedAt time.Time) error {
+	query := `
+		UPDATE shell_sessions SET reason = ?, exit_code = ?, recording_size = ?, ended_at = ?
+		WHERE session_id = ? AND ended_at IS NULL
+	`
+	var code sql.NullInt64
+	if exitCode != nil {
+		code = sql.NullInt64{Int64: int64(*exitCode), Valid: true}
+	}
+	//Execute the query
+	_, err := mysql.conn.Exec(query, reason, code, recordingSize, endedAt.UTC(), sessionId)
+	return err
+}
+
+// The sessions which were open when the server stopped cannot end normally anymore
+func (mysql *MysqlConnection) FinishInterruptedShellSessions() (int64, error) {
+	query := `
+		UPDATE shell_sessions SET reason = 'the server stopped', ended_at = UTC_TIMESTAMP(3)
+		WHERE ended_at IS NULL
+	`
+	//Execute the query
+	res, err := mysql.conn.Exec(query)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Convert a row of the shell_sessions table to a shell session
+func scanShellSession(row interface{ Scan(dest ...any) error }) (databaseModels.ShellSession, error) {
+	aux := databaseModels.ShellSession{}
+	var reason sql.NullString
+	var exitCode sql.NullInt64
+	var endedAt sql.NullTime
+	err := row.Scan(&aux.Id, &aux.SessionId, &aux.AgentId, &aux.Username, &aux.Rows, &aux.Cols, &aux.Recording, &aux.RecordingSize, &reason, &exitCode, &aux.StartedAt, &endedAt)
+	if err != nil {
+		return aux, err
+	}
+	aux.Reason = reason.String
+	if exitCode.Valid {
+		code := int(exitCode.Int64)
+		aux.ExitCode = &code
+	}
+	aux.EndedAt = nullTimePointer(endedAt)
+	return aux, nil
+}
+
+func (mysql *MysqlConnection) GetAgentShellSessions(agentId int64) ([]databaseModels.ShellSession, error) {
+	query := `
+		SELECT id, session_id, id_agent, username, terminal_rows, terminal_cols, recording, recording_size, reason, exit_code, started_at, ended_at
+		FROM shell_sessions
+		WHERE id_agent = ?
+		ORDER BY started_at DESC
+	`
+	//Execute the query
+	rows, err := mysql.conn.Query(query, agentId)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	returnData := make([]databaseModels.ShellSession, 0)
+	for rows.Next() {
+		aux, err := scanShellSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		returnData = append(returnData, aux)
+	}
+	return returnData, nil
+}
+
+func (mysql *MysqlConnection) GetShellSession(agentId int64, sessionId string) (databaseModels.ShellSession, error) {
+	query := `
+		SELECT id, session_id, id_agent, username, terminal_rows, terminal_cols, recording, recording_size, reason, exit_code, started_at, ended_at
+		FROM shell_sessions
+		WHERE id_agent = ? AND session_id = ?
+	`
+	//Execute the query
+	aux, err := scanShellSession(mysql.conn.QueryRow(query, agentId, sessionId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return aux, ErrRecordNotFound
+	}
+	return aux, err
+}
+
+func (mysql *MysqlConnection) RegisterAgentConnectionEvent(event databaseModels.AgentConnectionEvent) error {
+	//The event is not saved if the agent was deleted in the meantime
+	query := `
+		INSERT INTO agent_connections (id_agent, event, remote_address, reason, created_at)
+		SELECT id, ?, ?, ?, ? FROM agents
+		WHERE id = ?
+	`
+	//Execute the query
+	_, err := mysql.conn.Exec(query, event.Event, event.RemoteAddress, event.Reason, event.Timestamp.UTC(), event.AgentId)
+	return err
+}
+
+// The agents which were connected when the server stopped are disconnected at the last time they were seen
+func (mysql *MysqlConnection) FinishInterruptedAgentConnections() (int64, error) {
+	query := `
+		INSERT INTO agent_connections (id_agent, event, remote_address, reason, created_at)
+		SELECT c.id_agent, 'disconnected', c.remote_address, 'the server stopped', GREATEST(c.created_at, COALESCE(a.last_seen, c.created_at))
+		FROM agent_connections c
+		INNER JOIN agents a ON a.id = c.id_agent
+		INNER JOIN (SELECT id_agent, MAX(id) AS id FROM agent_connections GROUP BY id_agent) l ON l.id = c.id
+		WHERE c.event = 'connected'
+	`
+	//Execute the query
+	res, err := mysql.conn.Exec(query)
+	if err != nil {
+		return 0, err
+	}
+	_, err = mysql.conn.Exec("UPDATE agents SET disconnected_at = last_seen WHERE connected_at IS NOT NULL AND (disconnected_at IS NULL OR disconnected_at < connected_at)")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Convert a row of the agent_connections table to an event
+func scanAgentConnectionEvent(row interface{ Scan(dest ...any) error }) (databaseModels.AgentConnectionEvent, error) {
+	aux := databaseModels.AgentConnectionEvent{}
+	var remoteAddress, reason sql.NullString
+	err := row.Scan(&aux.Id, &aux.AgentId, &aux.Event, &remoteAddress, &reason, &aux.Timestamp)
+	aux.RemoteAddress = remoteAddress.String
+	aux.Reason = reason.String
+	return aux, err
+}
+
+// Get the connection events of the agents between two moments (all the agents if the list of ids is empty)
+// The last event of every agent before the start is also returned, it is the state the agent was in at the start
+func (mysql *MysqlConnection) GetAgentConnectionEvents(agentIds []int64, from time.Time, to time.Time) ([]databaseModels.AgentConnectionEvent, []databaseModels.AgentConnectionEvent, error) {
+	agentCondition := ""
+	agentArgs := make([]any, 0, len(agentIds))
+	if len(agentIds) != 0 {
+		agentCondition = " AND id_agent IN (?" + strings.Repeat(",?", len(agentIds)-1) + ")"
+		for _, agentId := range agentIds {
+			agentArgs = append(agentArgs, agentId)
+		}
+	}
+
+	query := `
+		SELECT id, id_agent, event, remote_address, reason, created_at
+		FROM agent_connections
+		WHERE created_at >= ? AND created_at <= ?` + agentCondition + `
+		ORDER BY id_agent ASC, created_at ASC, id ASC
+	`
+	//Execute the query
+	events, err := mysql.queryAgentConnectionEvents(query, append([]any{from.UTC(), to.UTC()}, agentArgs...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query = `
+		SELECT c.id, c.id_agent, c.event, c.remote_address, c.reason, c.created_at
+		FROM agent_connections c
+		INNER JOIN (
+			SELECT id_agent, MAX(id) AS id FROM agent_connections
+			WHERE created_at < ?` + agentCondition + `
+			GROUP BY id_agent
+		) l ON l.id = c.id
+	`
+	//Execute the query
+	previous, err := mysql.queryAgentConnectionEvents(query, append([]any{from.UTC()}, agentArgs...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return events, previous, nil
+}
+
+// Execute a query which returns connection events
+func (mysql *MysqlConnection) queryAgentConnectionEvents(query string, args ...any) ([]databaseModels.AgentConnectionEvent, error) {
+	rows, err := mysql.conn.Query(query, args...)
+	//Check if an error occured when executing the query
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	returnData := make([]databaseModels.AgentConnectionEvent, 0)
 	for rows.Next() {
-		var output sql.NullString
-		err := rows.Scan(&aux.Id, &aux.Command, &output)
+		aux, err := scanAgentConnectionEvent(rows)
 		if err != nil {
 			return nil, err
 		}
-		aux.Output = output.String
 		returnData = append(returnData, aux)
 	}
 	return returnData, nil
@@ -1,33 +1,53 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
+	"time"
 
+	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
 	"github.com/lucacoratu/ADTool/server/configuration"
 	"github.com/lucacoratu/ADTool/server/database"
 	"github.com/lucacoratu/ADTool/server/logging"
 	"github.com/lucacoratu/ADTool/server/models"
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+	"github.com/lucacoratu/ADTool/server/selector"
+	"github.com/lucacoratu/ADTool/server/utils"
 	"github.com/lucacoratu/ADTool/server/websocket"
 )
 
 type AgentsHandler struct {
-	logger logging.ILogger
-	config configuration.Configuration
-	dbConn database.IConnection
-	wsPool *websocket.Pool
+	logger   logging.ILogger
+	config   configuration.Configuration
+	dbConn   database.IConnection
+	wsPool   *websocket.Pool
+	ca       *utils.CertificateAuthority //The CA which signs the agent certificates (nil if mutual TLS is disabled)
+	validate *validator.Validate
 }
 
-func NewAgentsHandler(logger logging.ILogger, config configuration.Configuration, dbConn database.IConnection, wsPool *websocket.Pool) *AgentsHandler {
-	return &AgentsHandler{logger: logger, config: config, dbConn: dbConn, wsPool: wsPool}
+func NewAgentsHandler(logger logging.ILogger, config configuration.Configuration, dbConn database.IConnection, wsPool *websocket.Pool, ca *utils.CertificateAuthority) *AgentsHandler {
+	return &AgentsHandler{logger: logger, config: config, dbConn: dbConn, wsPool: wsPool, ca: ca, validate: validator.New(validator.WithRequiredStructEnabled())}
 }
 
 func (ah *AgentsHandler) CreateAgent(rw http.ResponseWriter, r *http.Request) {
+	//Check the enrollment token sent by the agent in the Authorization header
+	enrollmentToken := GetBearerToken(r)
+	if enrollmentToken == "" {
+		apiErr := models.NewAuthenticationError("Missing enrollment token")
+		rw.WriteHeader(http.StatusUnauthorized)
+		apiErr.ToJSON(rw)
+		return
+	}
+
 	//Create the structure which will hold the data from the agent
-	machineInfo := models.MachineInformation{}
+	registerReq := models.AgentRegisterRequest{}
 	//Get the machine information from the request body
-	err := machineInfo.FromJSON(r.Body)
+	err := registerReq.FromJSON(r.Body)
 	//Check if an error occured when parsing the request body from the agent
 	if err != nil {
 		//Send an APIError back to the client
@@ -37,12 +57,55 @@ func (ah *AgentsHandler) CreateAgent(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	machineInfo := registerReq.MachineInformation
+
 	//TO DO.... Validate input provided by the client
 
+	//Check if the agent can receive a client certificate before registering it
+	if registerReq.CertificateRequest == "" && ah.config.RequireAgentCertificates {
+		apiErr := models.NewValidationError("A certificate signing request is required to register")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if registerReq.CertificateRequest != "" && ah.ca == nil {
+		apiErr := models.NewValidationError("Client certificates are not enabled on the server")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//Consume one use of the enrollment token
+	token, err := ah.dbConn.UseEnrollmentToken(utils.HashToken(enrollmentToken))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		ah.logger.Warning("Rejected agent registration with invalid enrollment token from", r.RemoteAddr)
+		apiErr := models.NewAuthenticationError("Invalid, expired or exhausted enrollment token")
+		rw.WriteHeader(http.StatusUnauthorized)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not verify the enrollment token")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//If the registration fails from now on the partial records are deleted and the use of the token is given back
+	var machineId, agentId int64
+	registered := false
+	defer func() {
+		if !registered {
+			ah.rollbackRegistration(token.Id, machineId, agentId)
+		}
+	}()
+
 	//Register the machine in the database
-	machineId, err := ah.dbConn.RegisterMachine(machineInfo.Hostname, machineInfo.Os)
+	machineId, err = ah.dbConn.RegisterMachine(machineInfo.Hostname, machineInfo.Os)
 	//Check if an error occured when inserting the machine in the database
 	if err != nil {
+		ah.logger.Error(err.Error())
 		//Send an APIError back to the client
 		apiErr := models.NewDatabaseError("Could not insert machine in the database")
 		rw.WriteHeader(http.StatusInternalServerError)
@@ -54,6 +117,7 @@ func (ah *AgentsHandler) CreateAgent(rw http.ResponseWriter, r *http.Request) {
 	err = ah.dbConn.RegisterMachineNetworkInterfaces(machineId, machineInfo.NetInterfaces)
 	//Check if an error occured when inserting the network interfaces for the machine
 	if err != nil {
+		ah.logger.Error(err.Error())
 		apiErr := models.NewDatabaseError("Could not insert machine network interfaces in the database")
 		rw.WriteHeader(http.StatusInternalServerError)
 		apiErr.ToJSON(rw)
@@ -61,9 +125,10 @@ func (ah *AgentsHandler) CreateAgent(rw http.ResponseWriter, r *http.Request) {
 	}
 
 	//Register the agent in the database
-	agentId, err := ah.dbConn.RegisterAgent(machineId, machineInfo.OsCurrentUser.Username, machineInfo.OsCurrentUser.DisplayName, machineInfo.OsCurrentUser.UID, machineInfo.OsCurrentUser.GID, machineInfo.OsCurrentUser.HomeDirectory)
+	agentId, err = ah.dbConn.RegisterAgent(machineId, machineInfo.OsCurrentUser.Username, machineInfo.OsCurrentUser.DisplayName, machineInfo.OsCurrentUser.UID, machineInfo.OsCurrentUser.GID, machineInfo.OsCurrentUser.HomeDirectory)
 	//Check if an error occured when inserting the agent in the database
 	if err != nil {
+		ah.logger.Error(err.Error())
 		apiErr := models.NewDatabaseError("Could not insert agent in the database")
 		rw.WriteHeader(http.StatusInternalServerError)
 		apiErr.ToJSON(rw)
@@ -74,24 +139,117 @@ func (ah *AgentsHandler) CreateAgent(rw http.ResponseWriter, r *http.Request) {
 	err = ah.dbConn.RegisterAgentOSGroups(agentId, machineInfo.OsCurrentUser.Groups)
 	//Check if an error occured
 	if err != nil {
+		ah.logger.Error(err.Error())
 		apiErr := models.NewDatabaseError("Could not insert the agent user groups in the database")
 		rw.WriteHeader(http.StatusInternalServerError)
 		apiErr.ToJSON(rw)
 		return
 	}
 
+	//Assign the default tags of the enrollment token to the agent
+	err = ah.dbConn.AddAgentTags(agentId, token.Tags)
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not insert the agent tags in the database")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//Generate the secret of the agent, only the hash of it is saved in the database
+	secret, err := utils.GenerateRandomToken(32)
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewAuthenticationError("Could not generate the agent secret")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+	err = ah.dbConn.SetAgentSecretHash(agentId, utils.HashToken(secret))
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not save the agent secret in the database")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
 	//Create the return structure
-	resp := models.AgentRegisterResponse{Status: "ok", AgentId: agentId}
+	resp := models.AgentRegisterResponse{Status: "ok", AgentId: agentId, Secret: secret}
+
+	//Sign the client certificate of the agent
+	if registerReq.CertificateRequest != "" {
+		certPEM, certificate, err := ah.ca.SignAgentCertificate(registerReq.CertificateRequest, agentId)
+		if err != nil {
+			ah.logger.Error("Could not sign the certificate of agent", agentId, err.Error())
+			apiErr := models.NewValidationError("Invalid certificate signing request")
+			rw.WriteHeader(http.StatusBadRequest)
+			apiErr.ToJSON(rw)
+			return
+		}
+		err = ah.dbConn.RegisterAgentCertificate(agentId, certificate.SerialNumber.Text(16), certificate.NotAfter)
+		if err != nil {
+			ah.logger.Error(err.Error())
+			apiErr := models.NewDatabaseError("Could not save the agent certificate in the database")
+			rw.WriteHeader(http.StatusInternalServerError)
+			apiErr.ToJSON(rw)
+			return
+		}
+		resp.Certificate = certPEM
+	}
 
+	//Save the registration in the audit log (the agent is not an operator so only the enrollment token is known)
+	entry := NewAuditEntry(r, "register-agent")
+	entry.AgentId = &agentId
+	payload, _ := json.Marshal(map[string]any{"hostname": machineInfo.Hostname, "os": machineInfo.Os, "username": machineInfo.OsCurrentUser.Username, "enrollmentTokenId": token.Id})
+	entry.Payload = string(payload)
+	entry.StatusCode = http.StatusOK
+	RecordAuditEntry(ah.logger, ah.dbConn, entry)
+
+	registered = true
 	//Return the success message
 	rw.WriteHeader(http.StatusOK)
 	resp.ToJSON(rw)
 }
 
+// Undo a registration which failed after the enrollment token was used so the failure does not consume a use of the token
+func (ah *AgentsHandler) rollbackRegistration(tokenId int64, machineId int64, agentId int64) {
+	if agentId > 0 {
+		_, err := ah.dbConn.DeleteAgent(agentId)
+		if err != nil {
+			ah.logger.Error("Could not delete the partially registered agent", agentId, err.Error())
+		}
+	}
+	if machineId > 0 {
+		err := ah.dbConn.DeleteMachine(machineId)
+		if err != nil {
+			ah.logger.Error("Could not delete the machine of the partially registered agent", machineId, err.Error())
+		}
+	}
+	err := ah.dbConn.ReleaseEnrollmentToken(tokenId)
+	if err != nil {
+		ah.logger.Error("Could not give back the use of enrollment token", tokenId, err.Error())
+	}
+}
+
 // Handler to get all the agents registered in the database
 func (ah *AgentsHandler) GetAgents(rw http.ResponseWriter, r *http.Request) {
-	//Get the agents from the database
-	agents, err := ah.dbConn.GetAgents()
+	var agents []models.AgentsResponse
+	var err error
+	//The agents can be filtered by a selector (?selector=os=linux AND online)
+	if expr := r.URL.Query().Get("selector"); expr != "" {
+		sel, parseErr := selector.Parse(expr)
+		if parseErr != nil {
+			apiErr := models.NewValidationError("Invalid selector, " + parseErr.Error())
+			rw.WriteHeader(http.StatusBadRequest)
+			apiErr.ToJSON(rw)
+			return
+		}
+		agents, err = selectAgents(ah.dbConn, ah.wsPool, sel)
+	} else {
+		//Get the agents from the database
+		agents, err = ah.dbConn.GetAgents()
+	}
 	ah.logger.Debug(agents)
 	if err != nil {
 		ah.logger.Error(err.Error())
@@ -101,11 +259,142 @@ func (ah *AgentsHandler) GetAgents(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//The agents can be filtered by tags (?tag=web&tag=team-1 returns the agents which have both tags)
+	tags := r.URL.Query()["tag"]
+	if len(tags) != 0 {
+		agents = filterAgents(agents, nil, tags)
+	}
+	addConnectionState(agents, ah.wsPool)
+
 	resp := models.AgentsApiResponse{Agents: agents}
 	rw.WriteHeader(http.StatusOK)
 	resp.ToJSON(rw)
 }
 
+// Add the connection state of the agents which are connected to the websocket
+func addConnectionState(agents []models.AgentsResponse, wsPool *websocket.Pool) {
+	for index := range agents {
+		lastSeen, latency, online := wsPool.AgentHeartbeat(agents[index].Id)
+		if !online {
+			continue
+		}
+		//The last time saved in the database can be older than the last heartbeat
+		agents[index].Online = true
+		agents[index].LastSeen = &lastSeen
+		if latency > 0 {
+			milliseconds := float64(latency) / float64(time.Millisecond)
+			agents[index].Latency = &milliseconds
+		}
+	}
+}
+
+// Check if the agent exists, the error response is sent if it does not
+func (ah *AgentsHandler) checkAgentExists(rw http.ResponseWriter, agentId int64) bool {
+	exists, err := ah.dbConn.AgentExists(agentId)
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get the agent")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return false
+	}
+	if !exists {
+		apiErr := models.NewNotFoundError("Agent not found")
+		rw.WriteHeader(http.StatusNotFound)
+		apiErr.ToJSON(rw)
+		return false
+	}
+	return true
+}
+
+// Handler to get the tags of an agent
+func (ah *AgentsHandler) GetAgentTags(rw http.ResponseWriter, r *http.Request) {
+	//Get the agent id from the URL
+	vars := mux.Vars(r)
+	agent_id, _ := strconv.Atoi(vars["id"])
+
+	if !ah.checkAgentExists(rw, int64(agent_id)) {
+		return
+	}
+
+	tags, err := ah.dbConn.GetAgentTags(int64(agent_id))
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get the tags of the agent")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	resp := models.AgentTagsApiResponse{Tags: tags}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
+
+// Handler to add tags to an agent, the tags it already has are ignored
+func (ah *AgentsHandler) AddAgentTags(rw http.ResponseWriter, r *http.Request) {
+	//Get the agent id from the URL
+	vars := mux.Vars(r)
+	agent_id, _ := strconv.Atoi(vars["id"])
+
+	tagsReq := models.AgentTagsRequest{}
+	err := tagsReq.FromJSON(r.Body)
+	if err != nil {
+		apiErr := models.NewRequestParseError("Invalid JSON request, check the fields and try again")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+	err = ah.validate.Struct(tagsReq)
+	if err != nil {
+		apiErr := models.NewValidationError("At least one tag is required and the tags must have at most 64 characters")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	if !ah.checkAgentExists(rw, int64(agent_id)) {
+		return
+	}
+
+	err = ah.dbConn.AddAgentTags(int64(agent_id), tagsReq.Tags)
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not add the tags to the agent")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//Send back all the tags of the agent
+	ah.GetAgentTags(rw, r)
+}
+
+// Handler to remove a tag from an agent
+func (ah *AgentsHandler) RemoveAgentTag(rw http.ResponseWriter, r *http.Request) {
+	//Get the agent id and the tag from the URL (the tag is the rest of the path so it can contain /)
+	vars := mux.Vars(r)
+	agent_id, _ := strconv.Atoi(vars["id"])
+
+	err := ah.dbConn.RemoveAgentTag(int64(agent_id), vars["tag"])
+	if errors.Is(err, database.ErrRecordNotFound) {
+		apiErr := models.NewNotFoundError("The agent does not have the tag")
+		rw.WriteHeader(http.StatusNotFound)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not remove the tag from the agent")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("ok"))
+}
+
 func (ah *AgentsHandler) GetCommands(rw http.ResponseWriter, r *http.Request) {
 	//Get the agent id from the URL
 	vars := mux.Vars(r)
@@ -126,6 +415,44 @@ func (ah *AgentsHandler) GetCommands(rw http.ResponseWriter, r *http.Request) {
 	resp.ToJSON(rw)
 }
 
+// The results of sending a command to an agent
+const (
+	commandDispatchSent   = "ok"     //The command was sent to the agent
+	commandDispatchQueued = "queued" //The agent is offline, the command is sent when it reconnects
+)
+
+// Save a command and send it to the agent, the command stays in the queue if the agent is not connected
+// The id of the command and the result of the dispatch are returned (the errors come from the database)
+func dispatchCommand(logger logging.ILogger, dbConn database.IConnection, wsPool *websocket.Pool, agentId int64, cmdMsg models.ExecuteCommand, batchId int64) (int64, string, error) {
+	//Commands for offline agents stay in the queue until this moment
+	var expiresAt *time.Time
+	if cmdMsg.ExpiresIn > 0 {
+		t := time.Now().Add(time.Duration(cmdMsg.ExpiresIn) * time.Second)
+		expiresAt = &t
+	}
+
+	//Save the command in the database to get the id, it is queued until it is sent to the agent
+	commandId, err := dbConn.RegisterCommand(agentId, cmdMsg.Command, cmdMsg.Timeout, expiresAt, batchId)
+	if err != nil {
+		return -1, "", err
+	}
+
+	//Take the command out of the queue before sending it, the agent can answer before this function continues
+	//If the agent reconnected in the meantime the pool could have already sent the command
+	claimed, err := dbConn.ClaimPendingCommand(agentId, commandId)
+	if err != nil || !claimed {
+		return commandId, commandDispatchSent, err
+	}
+
+	err = wsPool.SendExecuteCommandToAgent(agentId, commandId, cmdMsg.Command, cmdMsg.Timeout)
+	if err != nil {
+		//The command is put back in the queue and it will be sent when the agent reconnects
+		logger.Info("Queued command", commandId, "for agent", agentId, err.Error())
+		return commandId, commandDispatchQueued, dbConn.RequeueCommand(agentId, commandId)
+	}
+	return commandId, commandDispatchSent, nil
+}
+
 func (ah *AgentsHandler) ExecuteCommandOnAgent(rw http.ResponseWriter, r *http.Request) {
 	//Get the agent id from the URL
 	vars := mux.Vars(r)
@@ -142,19 +469,95 @@ func (ah *AgentsHandler) ExecuteCommandOnAgent(rw http.ResponseWriter, r *http.R
 		return
 	}
 
-	//Save the command in the database to get the id
-	commandId, err := ah.dbConn.RegisterCommand(int64(agent_id), cmdMsg.Command)
+	err = ah.validate.Struct(cmdMsg)
+	if err != nil {
+		apiErr := models.NewValidationError("The command cannot be empty and the expiry and timeout must be positive numbers of seconds")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//The command would wait in the queue for an agent which does not exist
+	if !ah.checkAgentExists(rw, int64(agent_id)) {
+		return
+	}
+
+	commandId, status, err := dispatchCommand(ah.logger, ah.dbConn, ah.wsPool, int64(agent_id), cmdMsg, 0)
 	if err != nil {
 		ah.logger.Error(err.Error())
-		apiErr := models.NewDatabaseError("Could not insert the command")
+		apiErr := models.NewDatabaseError("Could not execute the command")
 		rw.WriteHeader(http.StatusInternalServerError)
 		apiErr.ToJSON(rw)
 		return
 	}
 
-	ah.wsPool.SendExecuteCommandToAgent(int64(agent_id), commandId, cmdMsg.Command)
-	rw.WriteHeader(http.StatusOK)
-	rw.Write([]byte("ok"))
+	resp := models.ExecuteCommandApiResponse{Status: status, CommandId: commandId}
+	if status == commandDispatchQueued {
+		rw.WriteHeader(http.StatusAccepted)
+	} else {
+		rw.WriteHeader(http.StatusOK)
+	}
+	resp.ToJSON(rw)
+}
+
+// Handler to cancel a command, queued commands are cancelled directly and running commands are killed by the agent
+func (ah *AgentsHandler) CancelCommand(rw http.ResponseWriter, r *http.Request) {
+	//Get the agent id and the command id from the URL
+	vars := mux.Vars(r)
+	agent_id, _ := strconv.Atoi(vars["id"])
+	command_id, _ := strconv.ParseInt(vars["cmdId"], 10, 64)
+
+	command, err := ah.dbConn.GetCommand(int64(agent_id), command_id)
+	if errors.Is(err, database.ErrRecordNotFound) {
+		apiErr := models.NewNotFoundError("Command not found")
+		rw.WriteHeader(http.StatusNotFound)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get the command")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	if databaseModels.IsFinalCommandStatus(command.Status) {
+		apiErr := models.NewValidationError("The command already finished with status " + command.Status)
+		rw.WriteHeader(http.StatusConflict)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//The command is still in the queue so it is never sent to the agent
+	cancelled, err := ah.dbConn.CancelQueuedCommand(int64(agent_id), command_id)
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not cancel the command")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if cancelled {
+		resp := models.ExecuteCommandApiResponse{Status: databaseModels.CommandStatusCancelled, CommandId: command_id}
+		rw.WriteHeader(http.StatusOK)
+		resp.ToJSON(rw)
+		return
+	}
+
+	//The agent kills the command and reports the cancelled status with the partial output
+	err = ah.wsPool.SendCancelCommandToAgent(int64(agent_id), command_id)
+	if err != nil {
+		ah.logger.Error("Could not send the cancel request for command", command_id, "to agent", agent_id, err.Error())
+		apiErr := models.NewAgentError("Could not send the cancel request to the agent, " + err.Error())
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	resp := models.ExecuteCommandApiResponse{Status: "cancelling", CommandId: command_id}
+	rw.WriteHeader(http.StatusAccepted)
+	resp.ToJSON(rw)
 }
 
 func (ah *AgentsHandler) ExecuteRecurringCommandOnAgent(rw http.ResponseWriter, r *http.Request) {
@@ -173,8 +576,22 @@ func (ah *AgentsHandler) ExecuteRecurringCommandOnAgent(rw http.ResponseWriter,
 		return
 	}
 
-	//Save the command in the database to get the id
-	commandId, err := ah.dbConn.RegisterRecurringCommand(int64(agent_id), cmdMsg.Command, cmdMsg.Interval)
+	err = ah.validate.Struct(cmdMsg)
+	if err != nil {
+		apiErr := models.NewValidationError("The command cannot be empty and the interval must be a positive number of seconds")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+	cmdMsg.Schedule, err = resolveRecurringSchedule(ah.config, cmdMsg.Interval, cmdMsg.Schedule)
+	if err != nil {
+		apiErr := models.NewValidationError("Invalid schedule, " + err.Error())
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	resp, err := createRecurringCommand(ah.logger, ah.dbConn, ah.wsPool, int64(agent_id), cmdMsg)
 	if err != nil {
 		ah.logger.Error(err.Error())
 		apiErr := models.NewDatabaseError("Could not insert the command")
@@ -182,8 +599,71 @@ func (ah *AgentsHandler) ExecuteRecurringCommandOnAgent(rw http.ResponseWriter,
 		apiErr.ToJSON(rw)
 		return
 	}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
+
+// Handler to delete an agent and everything associated with it
+func (ah *AgentsHandler) DeleteAgent(rw http.ResponseWriter, r *http.Request) {
+	//Get the agent id from the URL
+	vars := mux.Vars(r)
+	agent_id, _ := strconv.Atoi(vars["id"])
+
+	recordings, err := ah.dbConn.DeleteAgent(int64(agent_id))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		apiErr := models.NewNotFoundError("Agent not found")
+		rw.WriteHeader(http.StatusNotFound)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not delete the agent")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//Close the websocket connection of the agent, it cannot authenticate anymore
+	ah.wsPool.DisconnectAgent(int64(agent_id), "the agent was deleted")
+
+	//The shell sessions of the agent were deleted with it, their recordings are not needed anymore
+	for _, recording := range recordings {
+		err = os.Remove(filepath.Join(ah.config.ShellRecordingsPath(), recording))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			ah.logger.Error("Could not remove the shell recording", recording, "of the deleted agent", agent_id, err.Error())
+		}
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("ok"))
+}
+
+// Handler to revoke the client certificates of an agent
+func (ah *AgentsHandler) RevokeAgentCertificate(rw http.ResponseWriter, r *http.Request) {
+	//Get the agent id from the URL
+	vars := mux.Vars(r)
+	agent_id, _ := strconv.Atoi(vars["id"])
+
+	revoked, err := ah.dbConn.RevokeAgentCertificates(int64(agent_id))
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not revoke the agent certificate")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if revoked == 0 {
+		apiErr := models.NewNotFoundError("The agent does not have a valid certificate")
+		rw.WriteHeader(http.StatusNotFound)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//Close the websocket connection so the agent has to authenticate again
+	ah.wsPool.DisconnectAgent(int64(agent_id), "the certificate of the agent was revoked")
+	ah.logger.Info("Revoked the certificates of agent", agent_id)
 
-	ah.wsPool.SendExecuteRecurringCommandToAgent(int64(agent_id), commandId, cmdMsg.Command, cmdMsg.Interval)
 	rw.WriteHeader(http.StatusOK)
 	rw.Write([]byte("ok"))
 }
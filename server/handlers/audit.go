@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lucacoratu/ADTool/server/database"
+	"github.com/lucacoratu/ADTool/server/logging"
+	"github.com/lucacoratu/ADTool/server/models"
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+)
+
+// Limits of the page size for the audit log
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 500
+)
+
+type AuditHandler struct {
+	logger logging.ILogger
+	dbConn database.IConnection
+}
+
+func NewAuditHandler(logger logging.ILogger, dbConn database.IConnection) *AuditHandler {
+	return &AuditHandler{logger: logger, dbConn: dbConn}
+}
+
+// Get the IP address the request came from (without the port)
+func GetSourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Create an audit entry for the request, the operator is taken from the request context if it is authenticated
+func NewAuditEntry(r *http.Request, action string) databaseModels.AuditEntry {
+	entry := databaseModels.AuditEntry{
+		Action:    action,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		SourceIP:  GetSourceIP(r),
+		CreatedAt: time.Now(),
+	}
+	if user, found := UserFromRequest(r); found {
+		entry.UserId = user.Id
+		entry.Username = user.Username
+	}
+	return entry
+}
+
+// Save an audit entry, a failure is only logged so it does not block the action of the operator
+func RecordAuditEntry(logger logging.ILogger, dbConn database.IConnection, entry databaseModels.AuditEntry) {
+	err := dbConn.RegisterAuditEntry(entry)
+	if err != nil {
+		logger.Error("Could not save the audit entry for action", entry.Action, "of", entry.Username, err.Error())
+	}
+}
+
+// Parse a time from the query parameters (RFC3339 format)
+func parseQueryTime(r *http.Request, name string) (*time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Handler to get the audit log filtered by operator, agent, action and time range
+func (ah *AuditHandler) GetAuditLog(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := models.AuditFilter{
+		Username: query.Get("user"),
+		Action:   query.Get("action"),
+		Limit:    defaultAuditPageSize,
+	}
+
+	var err error
+	if value := query.Get("agent"); value != "" {
+		filter.AgentId, err = strconv.ParseInt(value, 10, 64)
+	}
+	if value := query.Get("limit"); value != "" && err == nil {
+		filter.Limit, err = strconv.ParseInt(value, 10, 64)
+	}
+	if value := query.Get("offset"); value != "" && err == nil {
+		filter.Offset, err = strconv.ParseInt(value, 10, 64)
+	}
+	if err == nil {
+		filter.From, err = parseQueryTime(r, "from")
+	}
+	if err == nil {
+		filter.To, err = parseQueryTime(r, "to")
+	}
+	if err != nil || filter.Limit <= 0 || filter.Limit > maxAuditPageSize || filter.Offset < 0 {
+		apiErr := models.NewValidationError("Invalid query parameters, limit must be between 1 and 500 and the times must be in RFC3339 format")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	entries, total, err := ah.dbConn.GetAuditEntries(filter)
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get the audit log")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	resp := models.AuditApiResponse{Entries: entries, Total: total, Limit: filter.Limit, Offset: filter.Offset}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
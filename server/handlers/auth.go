@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+)
+
+// Type of the keys stored in the request context (unexported so other packages cannot collide with them)
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+)
+
+// Get the bearer token from the Authorization header of the request
+// An empty string is returned if the header is missing or malformed
+func GetBearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	token, found := strings.CutPrefix(header, "Bearer ")
+	if !found {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// Save the authenticated user in the context of the request
+func ContextWithUser(ctx context.Context, user databaseModels.User) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// Get the authenticated user from the context of the request
+func UserFromRequest(r *http.Request) (databaseModels.User, bool) {
+	user, ok := r.Context().Value(userContextKey).(databaseModels.User)
+	return user, ok
+}
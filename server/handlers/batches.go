@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/lucacoratu/ADTool/server/database"
+	"github.com/lucacoratu/ADTool/server/logging"
+	"github.com/lucacoratu/ADTool/server/models"
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+	"github.com/lucacoratu/ADTool/server/selector"
+	"github.com/lucacoratu/ADTool/server/websocket"
+)
+
+type BatchesHandler struct {
+	logger   logging.ILogger
+	dbConn   database.IConnection
+	wsPool   *websocket.Pool
+	validate *validator.Validate
+}
+
+func NewBatchesHandler(logger logging.ILogger, dbConn database.IConnection, wsPool *websocket.Pool) *BatchesHandler {
+	return &BatchesHandler{logger: logger, dbConn: dbConn, wsPool: wsPool, validate: validator.New(validator.WithRequiredStructEnabled())}
+}
+
+// Keep only the agents which have one of the ids (if ids are specified) and all the tags
+func filterAgents(agents []models.AgentsResponse, agentIds []int64, tags []string) []models.AgentsResponse {
+	ids := make(map[int64]bool, len(agentIds))
+	for _, id := range agentIds {
+		ids[id] = true
+	}
+	filtered := make([]models.AgentsResponse, 0)
+	for _, agent := range agents {
+		if len(ids) != 0 && !ids[agent.Id] {
+			continue
+		}
+		agentTags := make(map[string]bool, len(agent.Tags))
+		for _, tag := range agent.Tags {
+			agentTags[tag] = true
+		}
+		hasTags := true
+		for _, tag := range tags {
+			if !agentTags[tag] {
+				hasTags = false
+				break
+			}
+		}
+		if hasTags {
+			filtered = append(filtered, agent)
+		}
+	}
+	return filtered
+}
+
+// Describe the target of a batch so it can be shown together with the results
+func describeBatchTarget(batchReq models.BatchCommandRequest) string {
+	parts := make([]string, 0, 2)
+	if len(batchReq.AgentIds) != 0 {
+		ids := make([]string, 0, len(batchReq.AgentIds))
+		for _, id := range batchReq.AgentIds {
+			ids = append(ids, strconv.FormatInt(id, 10))
+		}
+		parts = append(parts, "agents="+strings.Join(ids, ","))
+	}
+	if len(batchReq.Tags) != 0 {
+		parts = append(parts, "tags="+strings.Join(batchReq.Tags, ","))
+	}
+	if batchReq.Selector != "" {
+		parts = append(parts, "selector="+batchReq.Selector)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Handler to execute a command on all the agents which match the target
+func (bh *BatchesHandler) ExecuteBatchCommand(rw http.ResponseWriter, r *http.Request) {
+	batchReq := models.BatchCommandRequest{}
+	err := batchReq.FromJSON(r.Body)
+	if err != nil {
+		apiErr := models.NewRequestParseError("Invalid JSON request, check the fields and try again")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+	err = bh.validate.Struct(batchReq)
+	if err != nil {
+		apiErr := models.NewValidationError("Invalid batch command, " + err.Error())
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+	//A batch without a target would run on every agent, it has to be requested explicitly
+	if len(batchReq.AgentIds) == 0 && len(batchReq.Tags) == 0 && batchReq.Selector == "" {
+		apiErr := models.NewValidationError("The agent ids, the tags or the selector of the target agents are required")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	var agents []models.AgentsResponse
+	if batchReq.Selector != "" {
+		sel, parseErr := selector.Parse(batchReq.Selector)
+		if parseErr != nil {
+			apiErr := models.NewValidationError("Invalid selector, " + parseErr.Error())
+			rw.WriteHeader(http.StatusBadRequest)
+			apiErr.ToJSON(rw)
+			return
+		}
+		agents, err = selectAgents(bh.dbConn, bh.wsPool, sel)
+	} else {
+		agents, err = bh.dbConn.GetAgents()
+	}
+	if err != nil {
+		bh.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get agents")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+	agents = filterAgents(agents, batchReq.AgentIds, batchReq.Tags)
+	if len(agents) == 0 {
+		apiErr := models.NewNotFoundError("No agent matches the target")
+		rw.WriteHeader(http.StatusNotFound)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	batch := databaseModels.CommandBatch{Command: batchReq.Command, Target: describeBatchTarget(batchReq), CreatedAt: time.Now()}
+	if user, found := UserFromRequest(r); found {
+		batch.CreatedBy = user.Username
+	}
+	batchId, err := bh.dbConn.CreateCommandBatch(batch)
+	if err != nil {
+		bh.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not create the batch")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//Send the command to every agent, the offline agents get it when they reconnect
+	resp := models.BatchCommandApiResponse{BatchId: batchId, Results: make([]models.BatchDispatchResult, 0, len(agents))}
+	for _, agent := range agents {
+		commandId, status, err := dispatchCommand(bh.logger, bh.dbConn, bh.wsPool, agent.Id, batchReq.ExecuteCommand, batchId)
+		if err != nil {
+			bh.logger.Error("Could not execute the command of batch", batchId, "on agent", agent.Id, err.Error())
+			status = fmt.Sprintf("error: %s", err.Error())
+			resp.Failed++
+		}
+		resp.Results = append(resp.Results, models.BatchDispatchResult{AgentId: agent.Id, CommandId: commandId, Status: status})
+	}
+
+	//The results are sent even if the command could not be created for some agents
+	status, statusCode := models.MultiAgentStatus(len(agents), resp.Failed)
+	resp.Status = status
+	rw.WriteHeader(statusCode)
+	resp.ToJSON(rw)
+}
+
+// Handler to get the results of all the agents of a batch
+func (bh *BatchesHandler) GetBatch(rw http.ResponseWriter, r *http.Request) {
+	//Get the batch id from the URL
+	vars := mux.Vars(r)
+	batch_id, _ := strconv.ParseInt(vars["id"], 10, 64)
+
+	batch, err := bh.dbConn.GetCommandBatch(batch_id)
+	if errors.Is(err, database.ErrRecordNotFound) {
+		apiErr := models.NewNotFoundError("Batch not found")
+		rw.WriteHeader(http.StatusNotFound)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if err != nil {
+		bh.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get the batch")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	commands, err := bh.dbConn.GetBatchCommands(batch_id)
+	if err != nil {
+		bh.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get the commands of the batch")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	resp := models.BatchApiResponse{Batch: batch, Summary: make(map[string]int), Commands: commands}
+	for _, command := range commands {
+		resp.Summary[command.Status]++
+	}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/lucacoratu/ADTool/server/database"
+	"github.com/lucacoratu/ADTool/server/logging"
+	"github.com/lucacoratu/ADTool/server/models"
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+	"github.com/lucacoratu/ADTool/server/utils"
+)
+
+type EnrollmentHandler struct {
+	logger   logging.ILogger
+	dbConn   database.IConnection
+	validate *validator.Validate
+}
+
+func NewEnrollmentHandler(logger logging.ILogger, dbConn database.IConnection) *EnrollmentHandler {
+	return &EnrollmentHandler{logger: logger, dbConn: dbConn, validate: validator.New(validator.WithRequiredStructEnabled())}
+}
+
+// Handler to create a new enrollment token which agents can use to register
+func (eh *EnrollmentHandler) CreateEnrollmentToken(rw http.ResponseWriter, r *http.Request) {
+	tokenReq := models.CreateEnrollmentTokenRequest{}
+	err := tokenReq.FromJSON(r.Body)
+	if err != nil {
+		apiErr := models.NewRequestParseError("Invalid JSON request, check the fields and try again")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+	err = eh.validate.Struct(tokenReq)
+	if err != nil {
+		apiErr := models.NewValidationError("Invalid enrollment token parameters, " + err.Error())
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//Generate the token, only the hash of it is saved in the database
+	token, err := utils.GenerateRandomToken(32)
+	if err != nil {
+		eh.logger.Error(err.Error())
+		apiErr := models.NewAuthenticationError("Could not generate the enrollment token")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	user, _ := UserFromRequest(r)
+	enrollmentToken := databaseModels.EnrollmentToken{
+		Description: tokenReq.Description,
+		MaxUses:     tokenReq.MaxUses,
+		Tags:        tokenReq.Tags,
+		CreatedBy:   user.Id,
+		CreatedAt:   time.Now(),
+	}
+	//Single use tokens by default
+	if enrollmentToken.MaxUses == 0 {
+		enrollmentToken.MaxUses = 1
+	}
+	if enrollmentToken.Tags == nil {
+		enrollmentToken.Tags = make([]string, 0)
+	}
+	if tokenReq.ExpiresIn != 0 {
+		expiresAt := time.Now().Add(time.Second * time.Duration(tokenReq.ExpiresIn))
+		enrollmentToken.ExpiresAt = &expiresAt
+	}
+
+	enrollmentToken.Id, err = eh.dbConn.CreateEnrollmentToken(enrollmentToken, utils.HashToken(token))
+	if err != nil {
+		eh.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not insert the enrollment token")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	resp := models.CreateEnrollmentTokenResponse{Status: "ok", Token: token, EnrollmentToken: enrollmentToken}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
+
+// Handler to get all the enrollment tokens (the tokens themselves cannot be retrieved)
+func (eh *EnrollmentHandler) GetEnrollmentTokens(rw http.ResponseWriter, r *http.Request) {
+	tokens, err := eh.dbConn.GetEnrollmentTokens()
+	if err != nil {
+		eh.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get enrollment tokens")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	resp := models.EnrollmentTokensApiResponse{EnrollmentTokens: tokens}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
+
+// Handler to revoke an enrollment token
+func (eh *EnrollmentHandler) DeleteEnrollmentToken(rw http.ResponseWriter, r *http.Request) {
+	//Get the token id from the URL
+	vars := mux.Vars(r)
+	token_id, _ := strconv.Atoi(vars["id"])
+
+	err := eh.dbConn.DeleteEnrollmentToken(int64(token_id))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		apiErr := models.NewNotFoundError("Enrollment token not found")
+		rw.WriteHeader(http.StatusNotFound)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if err != nil {
+		eh.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not delete the enrollment token")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("ok"))
+}
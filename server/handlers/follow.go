@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lucacoratu/ADTool/server/database"
+	"github.com/lucacoratu/ADTool/server/models"
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+	"github.com/lucacoratu/ADTool/server/websocket"
+)
+
+// How often the status of a followed command is checked (it can change without a message from the agent, ex. when it is cancelled from the queue)
+// The check also keeps the connection alive
+const followStatusInterval = 5 * time.Second
+
+// The maximum time a write of an event to a follower can take
+const followWriteWait = 15 * time.Second
+
+// Handler to get a command of an agent
+// With ?follow=true (or Accept: text/event-stream) the output is streamed as server-sent events until the command finishes:
+//   - command: the command with the output received so far (sent first and again if the follower fell behind)
+//   - output: a chunk of the output ({id, sequence, stream, data})
+//   - end: the finished command
+func (ah *AgentsHandler) GetCommand(rw http.ResponseWriter, r *http.Request) {
+	//Get the agent id and the command id from the URL
+	vars := mux.Vars(r)
+	agent_id, _ := strconv.Atoi(vars["id"])
+	command_id, _ := strconv.ParseInt(vars["cmdId"], 10, 64)
+
+	follow := r.URL.Query().Get("follow") == "true" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	//Follow the command before reading it so no chunk is missed between the two
+	var events <-chan websocket.DashboardEvent
+	stop := func() {}
+	if follow {
+		events, stop = ah.wsPool.FollowCommand(command_id)
+	}
+	defer func() {
+		stop()
+	}()
+
+	command, err := ah.dbConn.GetCommand(int64(agent_id), command_id)
+	if errors.Is(err, database.ErrRecordNotFound) {
+		apiErr := models.NewNotFoundError("Command not found")
+		rw.WriteHeader(http.StatusNotFound)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get the command")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	if !follow {
+		rw.WriteHeader(http.StatusOK)
+		command.ToJSON(rw)
+		return
+	}
+
+	rc := http.NewResponseController(rw)
+	writeEvent := func(name string, data interface{}) error {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		rc.SetWriteDeadline(time.Now().Add(followWriteWait))
+		_, err = fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", name, payload)
+		if err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	if writeEvent("command", command) != nil {
+		return
+	}
+	if databaseModels.IsFinalCommandStatus(command.Status) {
+		writeEvent("end", command)
+		return
+	}
+
+	lastSequence := command.OutputSequence
+	ticker := time.NewTicker(followStatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if ok {
+				chunk, isChunk := event.Data.(websocket.CommandOutputChunkMessage)
+				if !isChunk || chunk.Sequence <= lastSequence {
+					continue
+				}
+				lastSequence = chunk.Sequence
+				if writeEvent("output", chunk) != nil {
+					return
+				}
+				continue
+			}
+			//The command finished or the follower fell behind, follow it again and send the current state
+			events, stop = ah.wsPool.FollowCommand(command_id)
+			command, err = ah.dbConn.GetCommand(int64(agent_id), command_id)
+			if err != nil {
+				ah.logger.Error("Could not get command", command_id, "while following it,", err.Error())
+				return
+			}
+			if databaseModels.IsFinalCommandStatus(command.Status) {
+				writeEvent("end", command)
+				return
+			}
+			lastSequence = command.OutputSequence
+			if writeEvent("command", command) != nil {
+				return
+			}
+		case <-ticker.C:
+			command, err = ah.dbConn.GetCommand(int64(agent_id), command_id)
+			if err != nil {
+				ah.logger.Error("Could not get command", command_id, "while following it,", err.Error())
+				return
+			}
+			if databaseModels.IsFinalCommandStatus(command.Status) {
+				writeEvent("end", command)
+				return
+			}
+			rc.SetWriteDeadline(time.Now().Add(followWriteWait))
+			if _, err := fmt.Fprint(rw, ": keep-alive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
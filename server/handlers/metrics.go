@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/lucacoratu/ADTool/server/logging"
+	"github.com/lucacoratu/ADTool/server/models"
+	"github.com/lucacoratu/ADTool/server/websocket"
+)
+
+type MetricsHandler struct {
+	logger logging.ILogger
+	wsPool *websocket.Pool
+}
+
+func NewMetricsHandler(logger logging.ILogger, wsPool *websocket.Pool) *MetricsHandler {
+	return &MetricsHandler{logger: logger, wsPool: wsPool}
+}
+
+// Handler to get the metrics of the server (ex. how far behind the database writes of the agent messages are)
+func (mh *MetricsHandler) GetMetrics(rw http.ResponseWriter, r *http.Request) {
+	resp := models.MetricsApiResponse{Persistence: mh.wsPool.PersistenceMetrics()}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
@@ -0,0 +1,403 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/lucacoratu/ADTool/server/configuration"
+	"github.com/lucacoratu/ADTool/server/database"
+	"github.com/lucacoratu/ADTool/server/logging"
+	"github.com/lucacoratu/ADTool/server/models"
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+	"github.com/lucacoratu/ADTool/server/schedule"
+	"github.com/lucacoratu/ADTool/server/selector"
+	"github.com/lucacoratu/ADTool/server/websocket"
+)
+
+// Limits of the page size for the recurring command outputs
+const (
+	defaultRecurringOutputsPageSize = 100
+	maxRecurringOutputsPageSize     = 1000
+)
+
+type RecurringCommandsHandler struct {
+	logger   logging.ILogger
+	config   configuration.Configuration
+	dbConn   database.IConnection
+	wsPool   *websocket.Pool
+	validate *validator.Validate
+}
+
+func NewRecurringCommandsHandler(logger logging.ILogger, config configuration.Configuration, dbConn database.IConnection, wsPool *websocket.Pool) *RecurringCommandsHandler {
+	return &RecurringCommandsHandler{logger: logger, config: config, dbConn: dbConn, wsPool: wsPool, validate: validator.New(validator.WithRequiredStructEnabled())}
+}
+
+// Check that a recurring command has either an interval or a schedule and return the schedule which is sent to the agent
+func resolveRecurringSchedule(config configuration.Configuration, interval int64, spec string) (string, error) {
+	if spec == "" {
+		if interval <= 0 {
+			return "", errors.New("a positive interval or a schedule is required")
+		}
+		return "", nil
+	}
+	if interval != 0 {
+		return "", errors.New("the interval and the schedule cannot be used together")
+	}
+	tickDuration, gameStart := config.GameTicks()
+	return schedule.Normalize(spec, tickDuration, gameStart)
+}
+
+// Save a recurring command of an agent and send it to the agent if it is connected
+func createRecurringCommand(logger logging.ILogger, dbConn database.IConnection, wsPool *websocket.Pool, agentId int64, cmdMsg models.ExecuteRecurringCommand) (models.RecurringCommandApiResponse, error) {
+	resp := models.RecurringCommandApiResponse{Status: "ok"}
+	//Save the command in the database to get the id
+	commandId, err := dbConn.RegisterRecurringCommand(agentId, cmdMsg.Command, cmdMsg.Interval, cmdMsg.Schedule)
+	if err != nil {
+		return resp, err
+	}
+	resp.RecurringCommand, err = dbConn.GetRecurringCommand(commandId)
+	if err != nil {
+		return resp, err
+	}
+
+	err = wsPool.SendExecuteRecurringCommandToAgent(agentId, commandId, cmdMsg.Command, cmdMsg.Interval, cmdMsg.Schedule)
+	if err != nil {
+		logger.Info("Could not send recurring command", commandId, "to agent", agentId, err.Error())
+		resp.Status = "agent-offline"
+	}
+	return resp, nil
+}
+
+// Get the recurring command from the id in the URL, the error response is sent if it cannot be found
+func (rch *RecurringCommandsHandler) getRecurringCommand(rw http.ResponseWriter, r *http.Request) (databaseModels.RecurringCommand, bool) {
+	vars := mux.Vars(r)
+	recurring_command_id, _ := strconv.ParseInt(vars["id"], 10, 64)
+
+	recurringCommand, err := rch.dbConn.GetRecurringCommand(recurring_command_id)
+	if errors.Is(err, database.ErrRecordNotFound) {
+		apiErr := models.NewNotFoundError("Recurring command not found")
+		rw.WriteHeader(http.StatusNotFound)
+		apiErr.ToJSON(rw)
+		return recurringCommand, false
+	}
+	if err != nil {
+		rch.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get the recurring command")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return recurringCommand, false
+	}
+	return recurringCommand, true
+}
+
+// Send the response after a change of a recurring command, the status shows if the agent was notified
+func (rch *RecurringCommandsHandler) writeRecurringCommandResponse(rw http.ResponseWriter, recurringCommand databaseModels.RecurringCommand, sendErr error) {
+	resp := models.RecurringCommandApiResponse{Status: "ok", RecurringCommand: recurringCommand}
+	if sendErr != nil {
+		rch.logger.Info("Could not notify agent", recurringCommand.AgentId, "about recurring command", recurringCommand.Id, sendErr.Error())
+		resp.Status = "agent-offline"
+	}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
+
+// Handler to get the recurring commands of an agent
+func (rch *RecurringCommandsHandler) GetAgentRecurringCommands(rw http.ResponseWriter, r *http.Request) {
+	//Get the agent id from the URL
+	vars := mux.Vars(r)
+	agent_id, _ := strconv.Atoi(vars["id"])
+
+	recurringCommands, err := rch.dbConn.GetAgentRecurringCommands(int64(agent_id))
+	if err != nil {
+		rch.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get the recurring commands")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	resp := models.RecurringCommandsApiResponse{RecurringCommands: recurringCommands}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
+
+// Handler to get a recurring command
+func (rch *RecurringCommandsHandler) GetRecurringCommand(rw http.ResponseWriter, r *http.Request) {
+	recurringCommand, found := rch.getRecurringCommand(rw, r)
+	if !found {
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	recurringCommand.ToJSON(rw)
+}
+
+// Handler to change the interval or the schedule of a recurring command
+func (rch *RecurringCommandsHandler) UpdateRecurringCommand(rw http.ResponseWriter, r *http.Request) {
+	updateReq := models.UpdateRecurringCommandRequest{}
+	err := updateReq.FromJSON(r.Body)
+	if err != nil {
+		apiErr := models.NewRequestParseError("Invalid JSON request, check the fields and try again")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+	err = rch.validate.Struct(updateReq)
+	if err != nil {
+		apiErr := models.NewValidationError("The interval must be a positive number of seconds")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+	updateReq.Schedule, err = resolveRecurringSchedule(rch.config, updateReq.Interval, updateReq.Schedule)
+	if err != nil {
+		apiErr := models.NewValidationError("Invalid schedule, " + err.Error())
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	recurringCommand, found := rch.getRecurringCommand(rw, r)
+	if !found {
+		return
+	}
+
+	err = rch.dbConn.UpdateRecurringCommandSchedule(recurringCommand.Id, updateReq.Interval, updateReq.Schedule)
+	if err != nil {
+		rch.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not update the recurring command")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+	recurringCommand.Interval = updateReq.Interval
+	recurringCommand.Schedule = updateReq.Schedule
+
+	//A paused command gets the new interval or schedule when it is resumed
+	var sendErr error
+	if !recurringCommand.Paused {
+		sendErr = rch.wsPool.SendUpdateRecurringCommandToAgent(recurringCommand.AgentId, recurringCommand.Id, recurringCommand.Interval, recurringCommand.Schedule)
+	}
+	rch.writeRecurringCommandResponse(rw, recurringCommand, sendErr)
+}
+
+// Handler to stop the executions of a recurring command until it is resumed
+func (rch *RecurringCommandsHandler) PauseRecurringCommand(rw http.ResponseWriter, r *http.Request) {
+	recurringCommand, found := rch.getRecurringCommand(rw, r)
+	if !found {
+		return
+	}
+
+	err := rch.dbConn.SetRecurringCommandPaused(recurringCommand.Id, true)
+	if err != nil {
+		rch.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not pause the recurring command")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+	recurringCommand.Paused = true
+
+	sendErr := rch.wsPool.SendStopRecurringCommandToAgent(recurringCommand.AgentId, recurringCommand.Id)
+	rch.writeRecurringCommandResponse(rw, recurringCommand, sendErr)
+}
+
+// Handler to restart the executions of a paused recurring command
+func (rch *RecurringCommandsHandler) ResumeRecurringCommand(rw http.ResponseWriter, r *http.Request) {
+	recurringCommand, found := rch.getRecurringCommand(rw, r)
+	if !found {
+		return
+	}
+
+	err := rch.dbConn.SetRecurringCommandPaused(recurringCommand.Id, false)
+	if err != nil {
+		rch.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not resume the recurring command")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+	recurringCommand.Paused = false
+
+	sendErr := rch.wsPool.SendExecuteRecurringCommandToAgent(recurringCommand.AgentId, recurringCommand.Id, recurringCommand.Command, recurringCommand.Interval, recurringCommand.Schedule)
+	rch.writeRecurringCommandResponse(rw, recurringCommand, sendErr)
+}
+
+// Handler to delete a recurring command together with its outputs
+func (rch *RecurringCommandsHandler) DeleteRecurringCommand(rw http.ResponseWriter, r *http.Request) {
+	recurringCommand, found := rch.getRecurringCommand(rw, r)
+	if !found {
+		return
+	}
+
+	err := rch.dbConn.DeleteRecurringCommand(recurringCommand.Id)
+	if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+		rch.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not delete the recurring command")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	sendErr := rch.wsPool.SendStopRecurringCommandToAgent(recurringCommand.AgentId, recurringCommand.Id)
+	rch.writeRecurringCommandResponse(rw, recurringCommand, sendErr)
+}
+
+// Handler to get the outputs of a recurring command in a time range, one page at a time
+func (rch *RecurringCommandsHandler) GetRecurringCommandOutputs(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := models.RecurringOutputsFilter{Limit: defaultRecurringOutputsPageSize}
+
+	var err error
+	if value := query.Get("limit"); value != "" {
+		filter.Limit, err = strconv.ParseInt(value, 10, 64)
+	}
+	if value := query.Get("cursor"); value != "" && err == nil {
+		var cursor models.RecurringOutputsCursor
+		cursor, err = models.ParseRecurringOutputsCursor(value)
+		filter.After = &cursor
+	}
+	if err == nil {
+		filter.From, err = parseQueryTime(r, "from")
+	}
+	if err == nil {
+		filter.To, err = parseQueryTime(r, "to")
+	}
+	if err != nil || filter.Limit <= 0 || filter.Limit > maxRecurringOutputsPageSize {
+		apiErr := models.NewValidationError("Invalid query parameters, limit must be between 1 and 1000, the times must be in RFC3339 format and the cursor must be the one from the previous page")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	recurringCommand, found := rch.getRecurringCommand(rw, r)
+	if !found {
+		return
+	}
+	filter.RecurringCommandId = recurringCommand.Id
+
+	//Get one more output to know if there is a next page
+	pageSize := filter.Limit
+	filter.Limit++
+	outputs, err := rch.dbConn.GetRecurringCommandOutputs(filter)
+	if err != nil {
+		rch.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get the outputs of the recurring command")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	resp := models.RecurringOutputsApiResponse{Outputs: outputs}
+	if int64(len(outputs)) > pageSize {
+		resp.Outputs = outputs[:pageSize]
+		last := resp.Outputs[pageSize-1]
+		resp.NextCursor = models.RecurringOutputsCursor{Timestamp: last.Timestamp, Id: last.Id}.String()
+	}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
+
+// Handler to get the most recent output of a recurring command
+func (rch *RecurringCommandsHandler) GetLatestRecurringCommandOutput(rw http.ResponseWriter, r *http.Request) {
+	recurringCommand, found := rch.getRecurringCommand(rw, r)
+	if !found {
+		return
+	}
+
+	output, err := rch.dbConn.GetLatestRecurringCommandOutput(recurringCommand.Id)
+	if errors.Is(err, database.ErrRecordNotFound) {
+		apiErr := models.NewNotFoundError("The recurring command has no outputs yet")
+		rw.WriteHeader(http.StatusNotFound)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if err != nil {
+		rch.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get the output of the recurring command")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	output.ToJSON(rw)
+}
+
+// Handler to create a recurring command on all the agents which match a selector
+func (rch *RecurringCommandsHandler) CreateSelectorRecurringCommands(rw http.ResponseWriter, r *http.Request) {
+	cmdReq := models.SelectorRecurringCommandRequest{}
+	err := cmdReq.FromJSON(r.Body)
+	if err != nil {
+		apiErr := models.NewRequestParseError("Invalid JSON request, check the fields and try again")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+	err = rch.validate.Struct(cmdReq)
+	if err != nil {
+		apiErr := models.NewValidationError("Invalid recurring command, " + err.Error())
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+	cmdReq.Schedule, err = resolveRecurringSchedule(rch.config, cmdReq.Interval, cmdReq.Schedule)
+	if err != nil {
+		apiErr := models.NewValidationError("Invalid schedule, " + err.Error())
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+	sel, err := selector.Parse(cmdReq.Selector)
+	if err != nil {
+		apiErr := models.NewValidationError("Invalid selector, " + err.Error())
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	agents, err := selectAgents(rch.dbConn, rch.wsPool, sel)
+	if err != nil {
+		rch.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get agents")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if len(agents) == 0 {
+		apiErr := models.NewNotFoundError("No agent matches the selector")
+		rw.WriteHeader(http.StatusNotFound)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//The commands of all the agents are created together so a failure does not leave only some of the agents with the command
+	agentIds := make([]int64, 0, len(agents))
+	for _, agent := range agents {
+		agentIds = append(agentIds, agent.Id)
+	}
+	recurringCommands, err := rch.dbConn.RegisterRecurringCommands(agentIds, cmdReq.Command, cmdReq.Interval, cmdReq.Schedule)
+	if err != nil {
+		rch.logger.Error("Could not create the recurring command on the agents matching", cmdReq.Selector, err.Error())
+		apiErr := models.NewDatabaseError("Could not insert the commands, no agent received the command")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	resp := models.SelectorRecurringCommandsApiResponse{Results: make([]models.RecurringCommandApiResponse, 0, len(recurringCommands))}
+	for _, recurringCommand := range recurringCommands {
+		result := models.RecurringCommandApiResponse{Status: "ok", RecurringCommand: recurringCommand}
+		//The offline agents get the command when they reconnect
+		err = rch.wsPool.SendExecuteRecurringCommandToAgent(recurringCommand.AgentId, recurringCommand.Id, recurringCommand.Command, recurringCommand.Interval, recurringCommand.Schedule)
+		if err != nil {
+			rch.logger.Info("Could not send recurring command", recurringCommand.Id, "to agent", recurringCommand.AgentId, err.Error())
+			result.Status = "agent-offline"
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
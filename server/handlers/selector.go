@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/lucacoratu/ADTool/server/database"
+	"github.com/lucacoratu/ADTool/server/models"
+	"github.com/lucacoratu/ADTool/server/selector"
+	"github.com/lucacoratu/ADTool/server/websocket"
+)
+
+// Convert the inventory of an agent to the target a selector is evaluated against
+func selectorTarget(inventory models.AgentInventory, online bool) selector.Target {
+	agent := inventory.Agent
+	return selector.Target{
+		Attributes: map[string][]string{
+			selector.AttributeId:        {strconv.FormatInt(agent.Id, 10)},
+			selector.AttributeName:      {agent.Name},
+			selector.AttributeUsername:  {agent.Username},
+			selector.AttributeUserId:    {agent.OsUserId},
+			selector.AttributeHostname:  {inventory.Hostname},
+			selector.AttributeOs:        {inventory.Os},
+			selector.AttributeIp:        inventory.IpAddresses,
+			selector.AttributeInterface: inventory.Interfaces,
+			selector.AttributeGroup:     inventory.Groups,
+			selector.AttributeTag:       agent.Tags,
+		},
+		Online: online,
+	}
+}
+
+// Get the agents which match the selector
+func selectAgents(dbConn database.IConnection, wsPool *websocket.Pool, sel selector.Selector) ([]models.AgentsResponse, error) {
+	inventories, err := dbConn.GetAgentsInventory()
+	if err != nil {
+		return nil, err
+	}
+	agents := make([]models.AgentsResponse, 0)
+	for _, inventory := range inventories {
+		if sel.Matches(selectorTarget(inventory, wsPool.IsAgentConnected(inventory.Agent.Id))) {
+			agents = append(agents, inventory.Agent)
+		}
+	}
+	return agents, nil
+}
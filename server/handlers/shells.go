@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lucacoratu/ADTool/server/database"
+	"github.com/lucacoratu/ADTool/server/models"
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+)
+
+// Handler to get the shell sessions which were opened on an agent
+func (ah *AgentsHandler) GetShellSessions(rw http.ResponseWriter, r *http.Request) {
+	//Get the agent id from the URL
+	vars := mux.Vars(r)
+	agent_id, _ := strconv.Atoi(vars["id"])
+
+	if !ah.checkAgentExists(rw, int64(agent_id)) {
+		return
+	}
+
+	sessions, err := ah.dbConn.GetAgentShellSessions(int64(agent_id))
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get the shell sessions of the agent")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	resp := models.ShellSessionsApiResponse{Sessions: sessions}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
+
+// Get the shell session from the URL, an error response is sent if it cannot be found
+func (ah *AgentsHandler) shellSessionFromRequest(rw http.ResponseWriter, r *http.Request) (databaseModels.ShellSession, bool) {
+	//Get the agent id and the session id from the URL
+	vars := mux.Vars(r)
+	agent_id, _ := strconv.Atoi(vars["id"])
+
+	session, err := ah.dbConn.GetShellSession(int64(agent_id), vars["sessionId"])
+	if errors.Is(err, database.ErrRecordNotFound) {
+		apiErr := models.NewNotFoundError("Shell session not found")
+		rw.WriteHeader(http.StatusNotFound)
+		apiErr.ToJSON(rw)
+		return session, false
+	}
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get the shell session")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return session, false
+	}
+	return session, true
+}
+
+// Handler to get a shell session of an agent
+func (ah *AgentsHandler) GetShellSession(rw http.ResponseWriter, r *http.Request) {
+	session, found := ah.shellSessionFromRequest(rw, r)
+	if !found {
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	session.ToJSON(rw)
+}
+
+// Handler to download the recording of a shell session in the asciicast v2 format
+// The recording can be replayed with asciinema (asciinema play <file>) or with the asciinema player in the browser
+// The recording of a session which is still open contains the frames received so far
+func (ah *AgentsHandler) GetShellSessionRecording(rw http.ResponseWriter, r *http.Request) {
+	session, found := ah.shellSessionFromRequest(rw, r)
+	if !found {
+		return
+	}
+
+	//The name of the file is saved by the server, it never comes from the request
+	file, err := os.Open(filepath.Join(ah.config.ShellRecordingsPath(), session.Recording))
+	if errors.Is(err, os.ErrNotExist) {
+		apiErr := models.NewNotFoundError("The recording of the shell session does not exist anymore")
+		rw.WriteHeader(http.StatusNotFound)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if err != nil {
+		ah.logger.Error("Could not open the recording of shell session", session.SessionId, err.Error())
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		ah.logger.Error("Could not read the recording of shell session", session.SessionId, err.Error())
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/x-asciicast")
+	rw.Header().Set("Content-Disposition", "attachment; filename=\"agent-"+strconv.FormatInt(session.AgentId, 10)+"-"+session.Recording+"\"")
+	http.ServeContent(rw, r, session.Recording, info.ModTime(), file)
+}
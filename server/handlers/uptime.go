@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lucacoratu/ADTool/server/models"
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+)
+
+// The time window of the uptime report if the start is not specified
+const defaultUptimeWindow = 24 * time.Hour
+
+// Compute the availability of an agent in the window from its connection events
+// previous is the last event of the agent before the window (nil if it did not connect before the window)
+// The time before the first connection of the agent is not monitored, so agents added during the game are not penalized
+func computeAgentUptime(agentId int64, previous *databaseModels.AgentConnectionEvent, events []databaseModels.AgentConnectionEvent, from time.Time, to time.Time) models.AgentUptime {
+	uptime := models.AgentUptime{AgentId: agentId, Outages: make([]models.AgentOutage, 0)}
+	var monitoredFrom, since time.Time
+	var outage *models.AgentOutage
+	online := false
+	if previous != nil {
+		monitoredFrom, since = from, from
+		online = previous.Event == databaseModels.AgentConnectionConnected
+		if !online {
+			outage = &models.AgentOutage{From: from, Reason: previous.Reason}
+		}
+	}
+
+	for _, event := range events {
+		if monitoredFrom.IsZero() {
+			monitoredFrom, since = event.Timestamp, event.Timestamp
+		}
+		switch event.Event {
+		case databaseModels.AgentConnectionConnected:
+			if online {
+				continue
+			}
+			if outage != nil {
+				outage.To = event.Timestamp
+				outage.Duration = outage.To.Sub(outage.From).Seconds()
+				uptime.Outages = append(uptime.Outages, *outage)
+				outage = nil
+			}
+			online, since = true, event.Timestamp
+		case databaseModels.AgentConnectionDisconnected:
+			if !online {
+				continue
+			}
+			uptime.OnlineSeconds += event.Timestamp.Sub(since).Seconds()
+			uptime.Disconnections++
+			online = false
+			outage = &models.AgentOutage{From: event.Timestamp, Reason: event.Reason}
+		}
+	}
+	if monitoredFrom.IsZero() {
+		return uptime
+	}
+
+	if online {
+		uptime.OnlineSeconds += to.Sub(since).Seconds()
+	}
+	if outage != nil {
+		outage.To = to
+		outage.Duration = outage.To.Sub(outage.From).Seconds()
+		outage.Ongoing = true
+		uptime.Outages = append(uptime.Outages, *outage)
+	}
+	uptime.MonitoredSeconds = to.Sub(monitoredFrom).Seconds()
+	percentage := 100.0
+	if uptime.MonitoredSeconds > 0 {
+		percentage = uptime.OnlineSeconds / uptime.MonitoredSeconds * 100
+	}
+	uptime.Uptime = &percentage
+	return uptime
+}
+
+// Parse the time window from the query (?from=...&to=... in RFC3339 format)
+// The window ends now if the end is not specified (or it is in the future) and starts defaultWindow before the end
+func parseTimeWindow(r *http.Request, defaultWindow time.Duration) (time.Time, time.Time, bool) {
+	from, err := parseQueryTime(r, "from")
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	to, err := parseQueryTime(r, "to")
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	end := time.Now()
+	if to != nil && to.Before(end) {
+		end = *to
+	}
+	start := end.Add(-defaultWindow)
+	if from != nil {
+		start = *from
+	}
+	return start, end, start.Before(end)
+}
+
+// Handler to get the uptime of the agents and the periods they were offline in a time window
+// The agents can be filtered by id (?agent=1&agent=2), all the agents are returned by default
+func (ah *AgentsHandler) GetAgentsUptime(rw http.ResponseWriter, r *http.Request) {
+	from, to, valid := parseTimeWindow(r, defaultUptimeWindow)
+	agentIds := make([]int64, 0)
+	for _, value := range r.URL.Query()["agent"] {
+		agentId, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			valid = false
+			break
+		}
+		agentIds = append(agentIds, agentId)
+	}
+	if !valid {
+		apiErr := models.NewValidationError("Invalid query parameters, the agents must be ids and the times must be in RFC3339 format with from before to")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	agents, err := ah.dbConn.GetAgents()
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get agents")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if len(agentIds) != 0 {
+		agents = filterAgents(agents, agentIds, nil)
+	}
+
+	events, previous, err := ah.dbConn.GetAgentConnectionEvents(agentIds, from, to)
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get the connection history of the agents")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+	agentEvents := make(map[int64][]databaseModels.AgentConnectionEvent)
+	for _, event := range events {
+		agentEvents[event.AgentId] = append(agentEvents[event.AgentId], event)
+	}
+	previousEvents := make(map[int64]*databaseModels.AgentConnectionEvent)
+	for index := range previous {
+		previousEvents[previous[index].AgentId] = &previous[index]
+	}
+
+	resp := models.UptimeApiResponse{From: from, To: to, Agents: make([]models.AgentUptime, 0, len(agents))}
+	for _, agent := range agents {
+		resp.Agents = append(resp.Agents, computeAgentUptime(agent.Id, previousEvents[agent.Id], agentEvents[agent.Id], from, to))
+	}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
+
+// Handler to get the connections and disconnections of an agent (?from=...&to=... limit the time range)
+func (ah *AgentsHandler) GetAgentConnections(rw http.ResponseWriter, r *http.Request) {
+	//Get the agent id from the URL
+	vars := mux.Vars(r)
+	agent_id, _ := strconv.Atoi(vars["id"])
+
+	//The whole history is returned by default
+	from, to, valid := parseTimeWindow(r, time.Since(time.Unix(0, 0)))
+	if !valid {
+		apiErr := models.NewValidationError("Invalid query parameters, the times must be in RFC3339 format with from before to")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if !ah.checkAgentExists(rw, int64(agent_id)) {
+		return
+	}
+
+	events, _, err := ah.dbConn.GetAgentConnectionEvents([]int64{int64(agent_id)}, from, to)
+	if err != nil {
+		ah.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get the connection history of the agent")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	resp := models.AgentConnectionsApiResponse{Events: events}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
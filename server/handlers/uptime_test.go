@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lucacoratu/ADTool/server/models"
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+)
+
+func TestComputeAgentUptime(t *testing.T) {
+	from := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	to := from.Add(2 * time.Hour)
+	at := func(minutes int) time.Time {
+		return from.Add(time.Duration(minutes) * time.Minute)
+	}
+	connected := func(minutes int) databaseModels.AgentConnectionEvent {
+		return databaseModels.AgentConnectionEvent{AgentId: 1, Event: databaseModels.AgentConnectionConnected, Timestamp: at(minutes)}
+	}
+	disconnected := func(minutes int, reason string) databaseModels.AgentConnectionEvent {
+		return databaseModels.AgentConnectionEvent{AgentId: 1, Event: databaseModels.AgentConnectionDisconnected, Reason: reason, Timestamp: at(minutes)}
+	}
+	percentage := func(value float64) *float64 {
+		return &value
+	}
+	connectedBefore := connected(-60)
+	disconnectedBefore := disconnected(-10, "heartbeat timeout")
+
+	tests := []struct {
+		name     string
+		previous *databaseModels.AgentConnectionEvent
+		events   []databaseModels.AgentConnectionEvent
+		want     models.AgentUptime
+	}{
+		{
+			name:     "disconnected before the window",
+			previous: &disconnectedBefore,
+			events:   []databaseModels.AgentConnectionEvent{connected(30), disconnected(60, "closed by the agent (1000)"), connected(75)},
+			want: models.AgentUptime{Uptime: percentage(62.5), OnlineSeconds: 4500, MonitoredSeconds: 7200, Disconnections: 1, Outages: []models.AgentOutage{
+				{From: from, To: at(30), Duration: 1800, Reason: "heartbeat timeout"},
+				{From: at(60), To: at(75), Duration: 900, Reason: "closed by the agent (1000)"},
+			}},
+		},
+		{
+			name:     "offline during the whole window",
+			previous: &disconnectedBefore,
+			events:   []databaseModels.AgentConnectionEvent{},
+			want: models.AgentUptime{Uptime: percentage(0), MonitoredSeconds: 7200, Outages: []models.AgentOutage{
+				{From: from, To: to, Duration: 7200, Reason: "heartbeat timeout", Ongoing: true},
+			}},
+		},
+		{
+			name:     "duplicated connected events",
+			previous: &connectedBefore,
+			events:   []databaseModels.AgentConnectionEvent{connected(30), disconnected(60, "heartbeat timeout"), connected(90), connected(100)},
+			want: models.AgentUptime{Uptime: percentage(75), OnlineSeconds: 5400, MonitoredSeconds: 7200, Disconnections: 1, Outages: []models.AgentOutage{
+				{From: at(60), To: at(90), Duration: 1800, Reason: "heartbeat timeout"},
+			}},
+		},
+		{
+			name:     "duplicated disconnected events",
+			previous: &connectedBefore,
+			events:   []databaseModels.AgentConnectionEvent{disconnected(60, "heartbeat timeout"), disconnected(70, "unknown"), connected(90)},
+			want: models.AgentUptime{Uptime: percentage(75), OnlineSeconds: 5400, MonitoredSeconds: 7200, Disconnections: 1, Outages: []models.AgentOutage{
+				{From: at(60), To: at(90), Duration: 1800, Reason: "heartbeat timeout"},
+			}},
+		},
+		{
+			name:   "first seen in the middle of the window",
+			events: []databaseModels.AgentConnectionEvent{connected(60), disconnected(90, "heartbeat timeout"), connected(105)},
+			want: models.AgentUptime{Uptime: percentage(75), OnlineSeconds: 2700, MonitoredSeconds: 3600, Disconnections: 1, Outages: []models.AgentOutage{
+				{From: at(90), To: at(105), Duration: 900, Reason: "heartbeat timeout"},
+			}},
+		},
+		{
+			name:     "outage ongoing at the end of the window",
+			previous: &connectedBefore,
+			events:   []databaseModels.AgentConnectionEvent{disconnected(60, "the agent reconnected")},
+			want: models.AgentUptime{Uptime: percentage(50), OnlineSeconds: 3600, MonitoredSeconds: 7200, Disconnections: 1, Outages: []models.AgentOutage{
+				{From: at(60), To: to, Duration: 3600, Reason: "the agent reconnected", Ongoing: true},
+			}},
+		},
+		{
+			name:   "never connected",
+			events: []databaseModels.AgentConnectionEvent{},
+			want:   models.AgentUptime{Outages: []models.AgentOutage{}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.want.AgentId = 1
+			got := computeAgentUptime(1, test.previous, test.events, from, to)
+			if (got.Uptime == nil) != (test.want.Uptime == nil) || got.Uptime != nil && *got.Uptime != *test.want.Uptime {
+				t.Errorf("uptime: got %v, want %v", formatPercentage(got.Uptime), formatPercentage(test.want.Uptime))
+			}
+			got.Uptime, test.want.Uptime = nil, nil
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func formatPercentage(value *float64) interface{} {
+	if value == nil {
+		return "null"
+	}
+	return *value
+}
@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/lucacoratu/ADTool/server/configuration"
+	"github.com/lucacoratu/ADTool/server/database"
+	"github.com/lucacoratu/ADTool/server/logging"
+	"github.com/lucacoratu/ADTool/server/models"
+	"github.com/lucacoratu/ADTool/server/utils"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The default number of hours a session is valid if it is not specified in the configuration
+const defaultSessionLifetime = 12
+
+type UsersHandler struct {
+	logger   logging.ILogger
+	config   configuration.Configuration
+	dbConn   database.IConnection
+	validate *validator.Validate
+}
+
+func NewUsersHandler(logger logging.ILogger, config configuration.Configuration, dbConn database.IConnection) *UsersHandler {
+	return &UsersHandler{logger: logger, config: config, dbConn: dbConn, validate: validator.New(validator.WithRequiredStructEnabled())}
+}
+
+// Parse and validate the credentials from the request body
+// If the credentials are not valid an APIError is sent back to the client and false is returned
+func (uh *UsersHandler) parseCredentials(rw http.ResponseWriter, r *http.Request) (models.UserCredentials, bool) {
+	creds := models.UserCredentials{}
+	err := creds.FromJSON(r.Body)
+	if err != nil {
+		apiErr := models.NewRequestParseError("Invalid JSON request, check the fields and try again")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return creds, false
+	}
+
+	err = uh.validate.Struct(creds)
+	if err != nil {
+		apiErr := models.NewValidationError("Username must have between 3 and 64 characters and password between 8 and 72 characters")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return creds, false
+	}
+	return creds, true
+}
+
+// Save an action on a public route in the audit log, only the username is saved as payload (never the password)
+func (uh *UsersHandler) auditCredentialsAction(r *http.Request, action string, username string, userId int64, statusCode int) {
+	entry := NewAuditEntry(r, action)
+	entry.UserId = userId
+	entry.Username = username
+	payload, _ := json.Marshal(map[string]string{"username": username})
+	entry.Payload = string(payload)
+	entry.StatusCode = statusCode
+	RecordAuditEntry(uh.logger, uh.dbConn, entry)
+}
+
+// Handler to create a new operator account
+func (uh *UsersHandler) Register(rw http.ResponseWriter, r *http.Request) {
+	creds, ok := uh.parseCredentials(rw, r)
+	if !ok {
+		return
+	}
+
+	//Check if the username is already taken
+	_, err := uh.dbConn.GetUserByUsername(creds.Username)
+	if err == nil {
+		apiErr := models.NewValidationError("Username is already taken")
+		rw.WriteHeader(http.StatusConflict)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if !errors.Is(err, database.ErrRecordNotFound) {
+		uh.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not check if the username is available")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//Hash the password (bcrypt generates a random salt for every hash)
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
+	if err != nil {
+		uh.logger.Error(err.Error())
+		apiErr := models.NewAuthenticationError("Could not hash the password")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//The first account is the admin of the server, every other account waits for an admin to set its role (unless the registration is open)
+	role := models.RolePending
+	if uh.config.OpenRegistration {
+		role = models.RoleViewer
+	}
+
+	//Save the user in the database, the database gives the admin role to the first user
+	userId, role, err := uh.dbConn.RegisterUser(creds.Username, string(passwordHash), role)
+	if err != nil {
+		uh.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not insert the user in the database")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	uh.auditCredentialsAction(r, "register-user", creds.Username, userId, http.StatusOK)
+
+	resp := models.UserRegisterResponse{Status: "ok", UserId: userId, Role: role}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
+
+// Handler to authenticate an operator and issue a bearer token
+func (uh *UsersHandler) Login(rw http.ResponseWriter, r *http.Request) {
+	creds, ok := uh.parseCredentials(rw, r)
+	if !ok {
+		return
+	}
+
+	//Get the user from the database
+	user, err := uh.dbConn.GetUserByUsername(creds.Username)
+	if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+		uh.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get the user")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//Compare the passwords (an unknown user and a wrong password return the same error)
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(creds.Password)) != nil {
+		uh.auditCredentialsAction(r, "login", creds.Username, user.Id, http.StatusUnauthorized)
+		apiErr := models.NewAuthenticationError("Invalid username or password")
+		rw.WriteHeader(http.StatusUnauthorized)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//The accounts which were not approved by an admin cannot log in
+	if user.Role == models.RolePending {
+		uh.auditCredentialsAction(r, "login", user.Username, user.Id, http.StatusForbidden)
+		apiErr := models.NewAuthorizationError("The account is waiting for an admin to approve it")
+		rw.WriteHeader(http.StatusForbidden)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//Generate the session token, only the hash of it is saved in the database
+	token, err := utils.GenerateRandomToken(32)
+	if err != nil {
+		uh.logger.Error(err.Error())
+		apiErr := models.NewAuthenticationError("Could not generate the session token")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	lifetime := uh.config.SessionLifetime
+	if lifetime == 0 {
+		lifetime = defaultSessionLifetime
+	}
+	expiresAt := time.Now().Add(time.Hour * time.Duration(lifetime))
+
+	err = uh.dbConn.CreateSession(user.Id, utils.HashToken(token), expiresAt)
+	if err != nil {
+		uh.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not create the session")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	uh.auditCredentialsAction(r, "login", user.Username, user.Id, http.StatusOK)
+
+	resp := models.LoginResponse{Status: "ok", Token: token, ExpiresAt: expiresAt.Unix()}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
+
+// Handler to invalidate the session token used for the request
+func (uh *UsersHandler) Logout(rw http.ResponseWriter, r *http.Request) {
+	err := uh.dbConn.DeleteSession(utils.HashToken(GetBearerToken(r)))
+	if err != nil {
+		uh.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not delete the session")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("ok"))
+}
+
+// Handler to get the information about the authenticated user
+func (uh *UsersHandler) WhoAmI(rw http.ResponseWriter, r *http.Request) {
+	user, _ := UserFromRequest(r)
+	resp := models.WhoAmIResponse{
+		Id:              user.Id,
+		Username:        user.Username,
+		Role:            user.Role,
+		CanExecute:      models.RoleHasPermission(user.Role, models.RoleOperator),
+		CanManageUsers:  models.RoleHasPermission(user.Role, models.RoleAdmin),
+		CanManageAgents: models.RoleHasPermission(user.Role, models.RoleAdmin),
+	}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
+
+// Handler to get all the operator accounts
+func (uh *UsersHandler) GetUsers(rw http.ResponseWriter, r *http.Request) {
+	users, err := uh.dbConn.GetUsers()
+	if err != nil {
+		uh.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not get users")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	resp := models.UsersApiResponse{Users: users}
+	rw.WriteHeader(http.StatusOK)
+	resp.ToJSON(rw)
+}
+
+// Handler to change the role of an operator
+func (uh *UsersHandler) UpdateUserRole(rw http.ResponseWriter, r *http.Request) {
+	//Get the user id from the URL
+	vars := mux.Vars(r)
+	user_id, _ := strconv.Atoi(vars["id"])
+
+	roleReq := models.UpdateRoleRequest{}
+	err := roleReq.FromJSON(r.Body)
+	if err != nil {
+		apiErr := models.NewRequestParseError("Could not parse role from body")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+	err = uh.validate.Struct(roleReq)
+	if err != nil {
+		apiErr := models.NewValidationError("Role must be one of viewer, operator or admin")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//Prevent the admin from locking themselves out
+	currentUser, _ := UserFromRequest(r)
+	if currentUser.Id == int64(user_id) && roleReq.Role != models.RoleAdmin {
+		apiErr := models.NewValidationError("You cannot remove your own admin role")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	err = uh.dbConn.UpdateUserRole(int64(user_id), roleReq.Role)
+	if errors.Is(err, database.ErrRecordNotFound) {
+		apiErr := models.NewNotFoundError("User not found")
+		rw.WriteHeader(http.StatusNotFound)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if err != nil {
+		uh.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not update the role of the user")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("ok"))
+}
+
+// Handler to delete an operator account
+func (uh *UsersHandler) DeleteUser(rw http.ResponseWriter, r *http.Request) {
+	//Get the user id from the URL
+	vars := mux.Vars(r)
+	user_id, _ := strconv.Atoi(vars["id"])
+
+	currentUser, _ := UserFromRequest(r)
+	if currentUser.Id == int64(user_id) {
+		apiErr := models.NewValidationError("You cannot delete your own account")
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	err := uh.dbConn.DeleteUser(int64(user_id))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		apiErr := models.NewNotFoundError("User not found")
+		rw.WriteHeader(http.StatusNotFound)
+		apiErr.ToJSON(rw)
+		return
+	}
+	if err != nil {
+		uh.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not delete the user")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("ok"))
+}
@@ -1,20 +1,83 @@
 package handlers
 
 import (
+	"crypto/subtle"
+	"errors"
 	"net/http"
 	"strconv"
 
 	"github.com/gorilla/mux"
+	"github.com/lucacoratu/ADTool/server/configuration"
+	"github.com/lucacoratu/ADTool/server/database"
 	"github.com/lucacoratu/ADTool/server/logging"
+	"github.com/lucacoratu/ADTool/server/models"
+	"github.com/lucacoratu/ADTool/server/utils"
 	"github.com/lucacoratu/ADTool/server/websocket"
 )
 
 type WebsocketHandler struct {
 	logger logging.ILogger
+	config configuration.Configuration
+	dbConn database.IConnection
 }
 
-func NewWebsocketHandler(logger logging.ILogger) *WebsocketHandler {
-	return &WebsocketHandler{logger: logger}
+func NewWebsocketHandler(logger logging.ILogger, config configuration.Configuration, dbConn database.IConnection) *WebsocketHandler {
+	return &WebsocketHandler{logger: logger, config: config, dbConn: dbConn}
+}
+
+// Get the id of the agent from the client certificate verified during the TLS handshake
+// Returns -1 if the certificate is not valid for an agent or it was revoked
+func (wsh *WebsocketHandler) authenticateAgentCertificate(r *http.Request) (int64, error) {
+	certificate := r.TLS.VerifiedChains[0][0]
+	agentId, err := utils.AgentIdFromCertificate(certificate)
+	if err != nil {
+		return -1, nil
+	}
+	valid, err := wsh.dbConn.IsAgentCertificateValid(agentId, certificate.SerialNumber.Text(16))
+	if err != nil || !valid {
+		return -1, err
+	}
+	return agentId, nil
+}
+
+// Check if the secret sent by the agent matches the hash saved in the database when the agent was registered
+func (wsh *WebsocketHandler) authenticateAgent(agentId int64, r *http.Request) (bool, error) {
+	secret := GetBearerToken(r)
+	if secret == "" {
+		return false, nil
+	}
+	secretHash, err := wsh.dbConn.GetAgentSecretHash(agentId)
+	if errors.Is(err, database.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	//Agents registered before the secrets were introduced do not have a secret and must register again
+	if secretHash == "" {
+		return false, nil
+	}
+	return subtle.ConstantTimeCompare([]byte(secretHash), []byte(utils.HashToken(secret))) == 1, nil
+}
+
+// Check the secret of the agent, if it is not valid an APIError is sent back and false is returned
+func (wsh *WebsocketHandler) checkAgentSecret(rw http.ResponseWriter, r *http.Request, agentId int64) bool {
+	authenticated, err := wsh.authenticateAgent(agentId, r)
+	if err != nil {
+		wsh.logger.Error(err.Error())
+		apiErr := models.NewDatabaseError("Could not verify the agent secret")
+		rw.WriteHeader(http.StatusInternalServerError)
+		apiErr.ToJSON(rw)
+		return false
+	}
+	if !authenticated {
+		wsh.logger.Warning("Rejected websocket connection with invalid secret for agent", agentId, "from", r.RemoteAddr)
+		apiErr := models.NewAuthenticationError("Invalid agent secret")
+		rw.WriteHeader(http.StatusUnauthorized)
+		apiErr.ToJSON(rw)
+		return false
+	}
+	return true
 }
 
 /*
@@ -25,6 +88,41 @@ func (wsh *WebsocketHandler) ServeAgentWs(pool *websocket.Pool, rw http.Response
 	vars := mux.Vars(r)
 	agent_id, _ := strconv.Atoi(vars["id"])
 
+	//Check the identity of the agent before upgrading the connection
+	//If the agent sent a client certificate, the id of the agent is taken from the certificate instead of the secret
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		certAgentId, err := wsh.authenticateAgentCertificate(r)
+		if err != nil {
+			wsh.logger.Error(err.Error())
+			apiErr := models.NewDatabaseError("Could not verify the agent certificate")
+			rw.WriteHeader(http.StatusInternalServerError)
+			apiErr.ToJSON(rw)
+			return
+		}
+		if certAgentId == -1 {
+			wsh.logger.Warning("Rejected websocket connection with invalid or revoked certificate from", r.RemoteAddr)
+			apiErr := models.NewAuthenticationError("Invalid or revoked agent certificate")
+			rw.WriteHeader(http.StatusUnauthorized)
+			apiErr.ToJSON(rw)
+			return
+		}
+		if certAgentId != int64(agent_id) {
+			wsh.logger.Warning("Rejected websocket connection of agent", certAgentId, "trying to connect as agent", agent_id)
+			apiErr := models.NewAuthorizationError("The certificate was issued to another agent")
+			rw.WriteHeader(http.StatusForbidden)
+			apiErr.ToJSON(rw)
+			return
+		}
+	} else if wsh.config.RequireAgentCertificates {
+		wsh.logger.Warning("Rejected websocket connection without client certificate for agent", agent_id, "from", r.RemoteAddr)
+		apiErr := models.NewAuthenticationError("A client certificate is required")
+		rw.WriteHeader(http.StatusUnauthorized)
+		apiErr.ToJSON(rw)
+		return
+	} else if !wsh.checkAgentSecret(rw, r, int64(agent_id)) {
+		return
+	}
+
 	//Upgrade the connection to a Websocket connection
 	ws, err := websocket.Upgrade(rw, r)
 	//Check if an error occured
@@ -35,16 +133,141 @@ func (wsh *WebsocketHandler) ServeAgentWs(pool *websocket.Pool, rw http.Response
 	}
 
 	//Create the client structure which will be saved in the pool
-	client := &websocket.AgentClient{
-		Conn:   ws,
-		Pool:   pool,
-		Status: "Offline",
-		Id:     int64(agent_id),
-	}
-
+	client := websocket.NewAgentClient(int64(agent_id), ws, pool, GetSourceIP(r))
+	//Start the writer before the client is registered, the queued commands are sent when it is registered
+	go client.Write()
 	//Call the client register function
 	pool.RegisterAgent <- client
 	//Start reading data from the connection
-	//go client.Write()
 	go client.Read()
 }
+
+/*
+ * This function will handle when an operator connects the dashboard to the websocket endpoint
+ * The events can be filtered with the query parameters (?agent=1&agent=2&event=command-output)
+ */
+func (wsh *WebsocketHandler) ServeDashboardWs(pool *websocket.Pool, rw http.ResponseWriter, r *http.Request) {
+	subscription := websocket.DashboardSubscription{AgentIds: make([]int64, 0), Events: r.URL.Query()["event"]}
+	for _, value := range r.URL.Query()["agent"] {
+		agentId, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			apiErr := models.NewValidationError("Invalid agent id " + value)
+			rw.WriteHeader(http.StatusBadRequest)
+			apiErr.ToJSON(rw)
+			return
+		}
+		subscription.AgentIds = append(subscription.AgentIds, agentId)
+	}
+	err := subscription.Validate()
+	if err != nil {
+		apiErr := models.NewValidationError("Invalid subscription, " + err.Error())
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	//Upgrade the connection to a Websocket connection
+	ws, err := websocket.Upgrade(rw, r)
+	if err != nil {
+		wsh.logger.Error(err.Error())
+		return
+	}
+
+	user, _ := UserFromRequest(r)
+	client := websocket.NewDashboardClient(ws, pool, user.Username, subscription)
+	pool.RegisterDashboard <- client
+	go client.Write()
+	go client.Read()
+}
+
+// Default size of the terminal if the operator does not send it
+const (
+	defaultShellRows = 24
+	defaultShellCols = 80
+)
+
+// The default number of seconds without input or output after which a shell session is closed
+const defaultShellIdleTimeout = 900
+
+// Parse the size of the terminal from the query parameters
+func parseTerminalSize(r *http.Request, name string, defaultValue uint16) (uint16, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	size, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || size == 0 {
+		return 0, errors.New("invalid " + name)
+	}
+	return uint16(size), nil
+}
+
+/*
+ * This function will handle when an operator opens an interactive shell on an agent
+ * The terminal exchanges JSON frames with the server (input, resize and close from the operator, output and closed from the server)
+ */
+func (wsh *WebsocketHandler) ServeShellWs(pool *websocket.Pool, rw http.ResponseWriter, r *http.Request) {
+	//Get the agent id from the URL
+	vars := mux.Vars(r)
+	agent_id, _ := strconv.Atoi(vars["id"])
+	agentId := int64(agent_id)
+
+	//Get the size of the terminal from the query
+	rows, err := parseTerminalSize(r, "rows", defaultShellRows)
+	if err != nil {
+		apiErr := models.NewValidationError("The size of the terminal is not valid, " + err.Error())
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+	cols, err := parseTerminalSize(r, "cols", defaultShellCols)
+	if err != nil {
+		apiErr := models.NewValidationError("The size of the terminal is not valid, " + err.Error())
+		rw.WriteHeader(http.StatusBadRequest)
+		apiErr.ToJSON(rw)
+		return
+	}
+
+	if !pool.IsAgentConnected(agentId) {
+		apiErr := models.NewAgentError("The agent is not connected")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		apiErr.ToJSON(rw)
+		return
+	}
+	sessionId, err := utils.GenerateRandomToken(16)
+	if err != nil {
+		wsh.logger.Error("Could not generate the id of the shell session,", err.Error())
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	//Upgrade the connection to a Websocket connection
+	ws, err := websocket.Upgrade(rw, r)
+	if err != nil {
+		wsh.logger.Error(err.Error())
+		return
+	}
+
+	user, _ := UserFromRequest(r)
+	idleTimeout := wsh.config.ShellIdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultShellIdleTimeout
+	}
+	session := websocket.NewShellSession(sessionId, agentId, user.Username, ws, pool)
+	err = pool.OpenShellSession(session, rows, cols, int64(idleTimeout), wsh.config.ShellRecordingsPath())
+	if err != nil {
+		ws.WriteJSON(websocket.ShellFrame{Type: websocket.ShellFrameClosed, Reason: err.Error(), ExitCode: -1})
+		ws.Close()
+		return
+	}
+
+	//Opening a shell is recorded in the audit log like the other operator actions
+	entry := NewAuditEntry(r, "open-shell-session")
+	entry.AgentId = &agentId
+	entry.Payload = "session=" + sessionId
+	entry.StatusCode = http.StatusSwitchingProtocols
+	RecordAuditEntry(wsh.logger, wsh.dbConn, entry)
+
+	go session.Write()
+	go session.Read()
+}
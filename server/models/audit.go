@@ -0,0 +1,33 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+)
+
+// This structure holds the filters which can be applied when querying the audit log
+// Empty fields are not used to filter the entries
+type AuditFilter struct {
+	Username string     //Only the actions of this operator
+	AgentId  int64      //Only the actions targeting this agent
+	Action   string     //Only the actions with this name
+	From     *time.Time //Only the actions after this moment
+	To       *time.Time //Only the actions before this moment
+	Limit    int64      //The maximum number of entries returned
+	Offset   int64      //The number of entries to skip
+}
+
+type AuditApiResponse struct {
+	Entries []databaseModels.AuditEntry `json:"entries"` //The audit entries of the page
+	Total   int64                       `json:"total"`   //The total number of entries which match the filters
+	Limit   int64                       `json:"limit"`   //The maximum number of entries in a page
+	Offset  int64                       `json:"offset"`  //The offset of the page
+}
+
+func (aar *AuditApiResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(aar)
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+)
+
+// This structure holds a command which is executed on all the agents which match the target
+// The target filters are combined, an agent must match all of them
+type BatchCommandRequest struct {
+	ExecuteCommand
+	AgentIds []int64  `json:"agentIds" validate:"omitempty,dive,gt=0"`        //Only the agents with these ids
+	Tags     []string `json:"tags" validate:"omitempty,dive,required,max=64"` //Only the agents which have all these tags
+	Selector string   `json:"selector" validate:"max=1024"`                   //Only the agents which match the selector (ex. os=linux AND hostname~web*)
+}
+
+func (bcr *BatchCommandRequest) FromJSON(r io.Reader) error {
+	d := json.NewDecoder(r)
+	return d.Decode(bcr)
+}
+
+// The status of a request which creates a command for several agents
+const (
+	MultiAgentStatusOk      string = "ok"      //The command was created for every agent
+	MultiAgentStatusPartial string = "partial" //The command could not be created for some of the agents
+	MultiAgentStatusFailed  string = "failed"  //The command could not be created for any agent
+)
+
+// Get the status of a request for several agents and the HTTP status code it is sent with
+func MultiAgentStatus(total int, failed int) (string, int) {
+	switch {
+	case failed == 0:
+		return MultiAgentStatusOk, http.StatusOK
+	case failed < total:
+		return MultiAgentStatusPartial, http.StatusMultiStatus
+	}
+	return MultiAgentStatusFailed, http.StatusInternalServerError
+}
+
+// The result of sending the command of a batch to one agent
+type BatchDispatchResult struct {
+	AgentId   int64  `json:"agentId"`
+	CommandId int64  `json:"commandId"` //The id of the command of the agent
+	Status    string `json:"status"`    //ok if the command was sent, queued if the agent is offline, error: <reason> if it could not be created
+}
+
+type BatchCommandApiResponse struct {
+	Status  string                `json:"status"`  //ok, partial or failed (see the results of the agents)
+	BatchId int64                 `json:"batchId"` //The id which can be used to get the results of all the agents
+	Failed  int                   `json:"failed"`  //The number of agents the command could not be created for
+	Results []BatchDispatchResult `json:"results"` //The command created for every agent
+}
+
+func (bcar *BatchCommandApiResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(bcar)
+}
+
+type BatchApiResponse struct {
+	Batch    databaseModels.CommandBatch `json:"batch"`
+	Summary  map[string]int              `json:"summary"`  //The number of commands in every status
+	Commands []databaseModels.Command    `json:"commands"` //The command of every agent with its result
+}
+
+func (bar *BatchApiResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(bar)
+}
@@ -6,7 +6,9 @@ import (
 )
 
 type ExecuteCommand struct {
-	Command string `json:"command"`
+	Command   string `json:"command" validate:"required"`
+	ExpiresIn int64  `json:"expiresIn" validate:"gte=0"` //Optional number of seconds the command can wait in the queue if the agent is offline (0 means no expiry)
+	Timeout   int64  `json:"timeout" validate:"gte=0"`   //Optional number of seconds after which the agent kills the command (0 means no timeout)
 }
 
 func (ec *ExecuteCommand) FromJSON(r io.Reader) error {
@@ -15,11 +17,22 @@ func (ec *ExecuteCommand) FromJSON(r io.Reader) error {
 }
 
 type ExecuteRecurringCommand struct {
-	Command  string `json:"command"`
-	Interval int64  `json:"interval"`
+	Command  string `json:"command" validate:"required"`
+	Interval int64  `json:"interval" validate:"gte=0"`   //The number of seconds between two executions
+	Schedule string `json:"schedule" validate:"max=255"` //A cron expression, @every <period>[+<offset>] or @tick[+<offset>] used instead of the interval
 }
 
 func (erc *ExecuteRecurringCommand) FromJSON(r io.Reader) error {
 	d := json.NewDecoder(r)
 	return d.Decode(erc)
 }
+
+type ExecuteCommandApiResponse struct {
+	Status    string `json:"status"`    //ok if the command was sent, queued if the agent is offline (cancelled or cancelling for cancel requests)
+	CommandId int64  `json:"commandId"` //The id of the command which can be used to follow its status
+}
+
+func (ecar *ExecuteCommandApiResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(ecar)
+}
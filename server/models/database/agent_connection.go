@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+)
+
+// The events of the connection of an agent to the websocket
+const (
+	AgentConnectionConnected    string = "connected"    //The agent connected
+	AgentConnectionDisconnected string = "disconnected" //The agent disconnected (the reason is set)
+)
+
+// A connection or a disconnection of an agent
+type AgentConnectionEvent struct {
+	Id            int64     `json:"id"`
+	AgentId       int64     `json:"agentId"`
+	Event         string    `json:"event"`         //connected or disconnected
+	RemoteAddress string    `json:"remoteAddress"` //The address the agent connected from
+	Reason        string    `json:"reason"`        //Why the agent disconnected (empty for connections)
+	Timestamp     time.Time `json:"timestamp"`     //When the event happened
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+type AuditEntry struct {
+	Id         int64     `json:"id"`         //The id of the audit entry
+	UserId     int64     `json:"userId"`     //The id of the operator which made the request (0 for agents and failed logins)
+	Username   string    `json:"username"`   //The username of the operator
+	Action     string    `json:"action"`     //The name of the action (ex. execute-command)
+	Method     string    `json:"method"`     //The HTTP method of the request
+	Path       string    `json:"path"`       //The path of the request
+	SourceIP   string    `json:"sourceIp"`   //The IP address the request came from
+	AgentId    *int64    `json:"agentId"`    //The id of the target agent (null if the action does not target an agent)
+	Payload    string    `json:"payload"`    //The body of the request
+	StatusCode int       `json:"statusCode"` //The status code of the response
+	CreatedAt  time.Time `json:"createdAt"`  //When the action happened
+}
+
+func (ae *AuditEntry) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(ae)
+}
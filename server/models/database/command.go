@@ -3,12 +3,47 @@ package models
 import (
 	"encoding/json"
 	"io"
+	"time"
 )
 
+// The states a command goes through
+const (
+	CommandStatusPending   string = "pending"   //The command was saved but not sent to the agent
+	CommandStatusSent      string = "sent"      //The command was sent to the agent
+	CommandStatusRunning   string = "running"   //The agent started the command
+	CommandStatusSucceeded string = "succeeded" //The command finished with exit code 0
+	CommandStatusFailed    string = "failed"    //The command finished with a non zero exit code or could not be started
+	CommandStatusTimedOut  string = "timed-out" //The command was killed because it exceeded its timeout
+	CommandStatusExpired   string = "expired"   //The agent was offline until the command expired so it was never sent
+	CommandStatusCancelled string = "cancelled" //The command was cancelled by an operator
+)
+
+// Check if the status is one of the final states a command can end in
+func IsFinalCommandStatus(status string) bool {
+	switch status {
+	case CommandStatusSucceeded, CommandStatusFailed, CommandStatusTimedOut, CommandStatusExpired, CommandStatusCancelled:
+		return true
+	}
+	return false
+}
+
 type Command struct {
-	Id      int64  `json:"id"`
-	Command string `json:"command"`
-	Output  string `json:"output"`
+	Id               int64      `json:"id"`
+	AgentId          int64      `json:"agentId"` //The agent which executes the command
+	BatchId          *int64     `json:"batchId"` //The batch the command is part of (null if it was executed on a single agent)
+	Command          string     `json:"command"`
+	Output           string     `json:"output"`           //The standard output of the command
+	Stderr           string     `json:"stderr"`           //The standard error of the command
+	Status           string     `json:"status"`           //The state of the command (pending, sent, running, succeeded, failed, timed-out, expired, cancelled)
+	ExitCode         *int       `json:"exitCode"`         //The exit code of the command (null until it finishes)
+	CreatedAt        time.Time  `json:"createdAt"`        //When the command was created by the operator
+	SentAt           *time.Time `json:"sentAt"`           //When the command was sent to the agent
+	StartedAt        *time.Time `json:"startedAt"`        //When the agent started the command
+	FinishedAt       *time.Time `json:"finishedAt"`       //When the command finished
+	ExpiresAt        *time.Time `json:"expiresAt"`        //After this moment the command is not sent anymore if it is still queued (null if it does not expire)
+	Timeout          int64      `json:"timeout"`          //The number of seconds after which the agent kills the command (0 means no timeout)
+	OutputSequence   int64      `json:"outputSequence"`   //The sequence number of the last output chunk streamed by the agent (0 if the output was not streamed)
+	OutputIncomplete bool       `json:"outputIncomplete"` //If chunks of the streamed output are missing or the output was too large to be saved completely
 }
 
 func (c *Command) ToJSON(w io.Writer) error {
@@ -0,0 +1,14 @@
+package models
+
+import (
+	"time"
+)
+
+// A command executed on multiple agents at once, every agent gets its own command with the id of the batch
+type CommandBatch struct {
+	Id        int64     `json:"id"`
+	Command   string    `json:"command"`   //The system command
+	Target    string    `json:"target"`    //The description of the agents which were targeted
+	CreatedBy string    `json:"createdBy"` //The username of the operator which created the batch
+	CreatedAt time.Time `json:"createdAt"` //When the batch was created
+}
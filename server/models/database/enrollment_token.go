@@ -0,0 +1,23 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+type EnrollmentToken struct {
+	Id          int64      `json:"id"`          //The id of the token
+	Description string     `json:"description"` //The description of the token (ex. the team the vulnboxes belong to)
+	MaxUses     int64      `json:"maxUses"`     //The number of agents which can register with this token
+	Uses        int64      `json:"uses"`        //The number of agents which registered with this token
+	ExpiresAt   *time.Time `json:"expiresAt"`   //When the token expires (null if it does not expire)
+	Tags        []string   `json:"tags"`        //The tags assigned to the agents which register with this token
+	CreatedBy   int64      `json:"createdBy"`   //The id of the user which created the token
+	CreatedAt   time.Time  `json:"createdAt"`   //When the token was created
+}
+
+func (et *EnrollmentToken) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(et)
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+type RecurringCommand struct {
+	Id        int64      `json:"id"`
+	AgentId   int64      `json:"agentId"`   //The agent which executes the command
+	Command   string     `json:"command"`   //The system command
+	Interval  int64      `json:"interval"`  //The number of seconds between two executions (0 if the command uses a schedule)
+	Schedule  string     `json:"schedule"`  //The cron expression or @every schedule of the command (empty if it uses an interval)
+	StartTime time.Time  `json:"startTime"` //When the recurring command was created
+	Paused    bool       `json:"paused"`    //If the agent stopped executing the command until it is resumed
+	LastRun   *time.Time `json:"lastRun"`   //When the command last ran, even if the run failed (null if the command did not run yet)
+}
+
+func (rc *RecurringCommand) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(rc)
+}
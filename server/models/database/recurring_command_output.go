@@ -0,0 +1,25 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+type RecurringCommandOutput struct {
+	Id                 int64     `json:"id"`
+	RecurringCommandId int64     `json:"recurringCommandId"` //The recurring command which produced the output
+	Output             string    `json:"output"`             //The standard output of the execution
+	Timestamp          time.Time `json:"timestamp"`          //When the agent executed the command
+}
+
+func (rco *RecurringCommandOutput) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(rco)
+}
+
+// An output received from an agent, the outputs of multiple agents are saved together
+type AgentRecurringCommandOutput struct {
+	AgentId int64 //The agent which sent the output
+	RecurringCommandOutput
+}
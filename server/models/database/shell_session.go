@@ -0,0 +1,28 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// An interactive shell session opened by an operator on an agent, the input and the output are saved in a recording
+type ShellSession struct {
+	Id            int64      `json:"id"`
+	SessionId     string     `json:"sessionId"`     //The id of the session used on the websocket
+	AgentId       int64      `json:"agentId"`       //The agent the shell was opened on
+	Username      string     `json:"username"`      //The operator who opened the session
+	Rows          uint16     `json:"rows"`          //The number of rows of the terminal when the session was opened
+	Cols          uint16     `json:"cols"`          //The number of columns of the terminal when the session was opened
+	Recording     string     `json:"-"`             //The name of the recording file in the recordings directory
+	RecordingSize int64      `json:"recordingSize"` //The size of the recording in bytes (0 until the session ends)
+	Reason        string     `json:"reason"`        //Why the session ended
+	ExitCode      *int       `json:"exitCode"`      //The exit code of the shell (null if the session did not end or the shell was killed)
+	StartedAt     time.Time  `json:"startedAt"`     //When the session was opened
+	EndedAt       *time.Time `json:"endedAt"`       //When the session ended (null while it is open)
+}
+
+func (ss *ShellSession) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(ss)
+}
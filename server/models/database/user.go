@@ -0,0 +1,18 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+)
+
+type User struct {
+	Id           int64  `json:"id"`       //The id of the user
+	Username     string `json:"username"` //The username the operator logs in with
+	PasswordHash string `json:"-"`        //The salted hash of the password (never sent to the clients)
+	Role         string `json:"role"`     //The role of the user (viewer, operator or admin)
+}
+
+func (u *User) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(u)
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+)
+
+// This structure holds the parameters of a new enrollment token sent by an admin
+type CreateEnrollmentTokenRequest struct {
+	Description string   `json:"description" validate:"max=255"`                 //Optional description of the token
+	MaxUses     int64    `json:"maxUses" validate:"omitempty,gt=0"`              //The number of agents which can use the token (default 1)
+	ExpiresIn   int64    `json:"expiresIn" validate:"omitempty,gt=0"`            //The number of seconds after which the token expires (0 means no expiry)
+	Tags        []string `json:"tags" validate:"omitempty,dive,required,max=64"` //The tags assigned to the agents which register with the token
+}
+
+func (cetr *CreateEnrollmentTokenRequest) FromJSON(r io.Reader) error {
+	d := json.NewDecoder(r)
+	return d.Decode(cetr)
+}
+
+type CreateEnrollmentTokenResponse struct {
+	Status          string                         `json:"status"`
+	Token           string                         `json:"token"`           //The token which should be put in the agent configuration (only sent once)
+	EnrollmentToken databaseModels.EnrollmentToken `json:"enrollmentToken"` //The details of the token
+}
+
+func (cetr *CreateEnrollmentTokenResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(cetr)
+}
+
+type EnrollmentTokensApiResponse struct {
+	EnrollmentTokens []databaseModels.EnrollmentToken `json:"enrollmentTokens"` //The list of enrollment tokens
+}
+
+func (etar *EnrollmentTokensApiResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(etar)
+}
@@ -25,6 +25,11 @@ func (ae *APIError) ToJSON(w io.Writer) error {
 const (
 	APIRequestParseError int64 = 0
 	DatabaseError        int64 = 1
+	ValidationError      int64 = 2
+	AuthenticationError  int64 = 3
+	AuthorizationError   int64 = 4
+	NotFoundError        int64 = 5
+	AgentError           int64 = 6
 )
 
 func NewRequestParseError(message string) APIError {
@@ -34,3 +39,23 @@ func NewRequestParseError(message string) APIError {
 func NewDatabaseError(message string) APIError {
 	return APIError{Code: DatabaseError, Message: message}
 }
+
+func NewValidationError(message string) APIError {
+	return APIError{Code: ValidationError, Message: message}
+}
+
+func NewAuthenticationError(message string) APIError {
+	return APIError{Code: AuthenticationError, Message: message}
+}
+
+func NewAuthorizationError(message string) APIError {
+	return APIError{Code: AuthorizationError, Message: message}
+}
+
+func NewNotFoundError(message string) APIError {
+	return APIError{Code: NotFoundError, Message: message}
+}
+
+func NewAgentError(message string) APIError {
+	return APIError{Code: AgentError, Message: message}
+}
@@ -0,0 +1,11 @@
+package models
+
+// This structure holds everything known about an agent, it is used to evaluate the selectors
+type AgentInventory struct {
+	Agent       AgentsResponse //The agent
+	Hostname    string         //The hostname of the machine the agent is running on
+	Os          string         //The operating system of the machine
+	IpAddresses []string       //The ip addresses of the interfaces of the machine
+	Interfaces  []string       //The names of the interfaces of the machine
+	Groups      []string       //The names of the OS groups of the user the agent is running as
+}
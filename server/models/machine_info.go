@@ -44,3 +44,15 @@ func (mi *MachineInformation) ToJSON(w io.Writer) error {
 	e := json.NewEncoder(w)
 	return e.Encode(mi)
 }
+
+// This structure holds the data sent by an agent when it registers
+// The machine information is embedded so the fields are at the top level of the JSON
+type AgentRegisterRequest struct {
+	MachineInformation
+	CertificateRequest string `json:"certificateRequest"` //Optional PEM certificate signing request for the client certificate of the agent
+}
+
+func (arr *AgentRegisterRequest) FromJSON(r io.Reader) error {
+	d := json.NewDecoder(r)
+	return d.Decode(arr)
+}
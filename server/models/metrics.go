@@ -0,0 +1,30 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// The state of the pipeline which saves the messages of the agents in the database
+type PersistenceMetrics struct {
+	Workers                  int     `json:"workers"`                  //The number of workers which write in the database
+	Queued                   int     `json:"queued"`                   //The number of writes waiting in the queues
+	QueueCapacity            int     `json:"queueCapacity"`            //The maximum number of writes which can wait in the queues
+	Enqueued                 int64   `json:"enqueued"`                 //The number of writes received since the server started
+	Written                  int64   `json:"written"`                  //The number of writes which succeeded
+	Failed                   int64   `json:"failed"`                   //The number of writes which failed
+	Batches                  int64   `json:"batches"`                  //The number of batches the writes were grouped in
+	LargestBatch             int64   `json:"largestBatch"`             //The largest number of writes done at once
+	AverageBatchMilliseconds float64 `json:"averageBatchMilliseconds"` //The average time it took to write a batch
+	BlockedEnqueues          int64   `json:"blockedEnqueues"`          //The number of times an agent waited because the queue of its worker was full
+	BlockedMilliseconds      float64 `json:"blockedMilliseconds"`      //The total time the agents waited for the queues
+}
+
+type MetricsApiResponse struct {
+	Persistence PersistenceMetrics `json:"persistence"` //The database writes of the agent messages
+}
+
+func (mar *MetricsApiResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(mar)
+}
@@ -0,0 +1,109 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+)
+
+// This structure holds the new interval or schedule of a recurring command sent by an operator
+type UpdateRecurringCommandRequest struct {
+	Interval int64  `json:"interval" validate:"gte=0"`   //The new number of seconds between two executions
+	Schedule string `json:"schedule" validate:"max=255"` //The new schedule used instead of the interval
+}
+
+func (urcr *UpdateRecurringCommandRequest) FromJSON(r io.Reader) error {
+	d := json.NewDecoder(r)
+	return d.Decode(urcr)
+}
+
+type RecurringCommandApiResponse struct {
+	Status           string                          `json:"status"`           //ok if the agent was notified, agent-offline if the change is applied when it reconnects
+	RecurringCommand databaseModels.RecurringCommand `json:"recurringCommand"` //The recurring command after the change
+}
+
+func (rcar *RecurringCommandApiResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(rcar)
+}
+
+type RecurringCommandsApiResponse struct {
+	RecurringCommands []databaseModels.RecurringCommand `json:"recurringCommands"` //The recurring commands of the agent
+}
+
+func (rcar *RecurringCommandsApiResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(rcar)
+}
+
+// This structure holds a recurring command which is created on all the agents which match the selector
+type SelectorRecurringCommandRequest struct {
+	ExecuteRecurringCommand
+	Selector string `json:"selector" validate:"required,max=1024"` //The selector of the agents (ex. os=linux AND online)
+}
+
+func (srcr *SelectorRecurringCommandRequest) FromJSON(r io.Reader) error {
+	d := json.NewDecoder(r)
+	return d.Decode(srcr)
+}
+
+type SelectorRecurringCommandsApiResponse struct {
+	Results []RecurringCommandApiResponse `json:"results"` //The recurring command created for every agent which matched the selector
+}
+
+func (srcar *SelectorRecurringCommandsApiResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(srcar)
+}
+
+// The position after which the next page of recurring command outputs starts
+// The outputs are ordered by timestamp and id so the pages stay consistent while new outputs are added
+type RecurringOutputsCursor struct {
+	Timestamp time.Time //The timestamp of the last output of the previous page
+	Id        int64     //The id of the last output of the previous page
+}
+
+// Encode the cursor as an opaque string which can be sent in the query parameters
+func (roc RecurringOutputsCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", roc.Timestamp.UnixNano(), roc.Id)))
+}
+
+// Decode a cursor received in the query parameters
+func ParseRecurringOutputsCursor(value string) (RecurringOutputsCursor, error) {
+	cursor := RecurringOutputsCursor{}
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, errors.New("invalid cursor")
+	}
+	var nanoseconds int64
+	_, err = fmt.Sscanf(string(decoded), "%d:%d", &nanoseconds, &cursor.Id)
+	if err != nil {
+		return cursor, errors.New("invalid cursor")
+	}
+	cursor.Timestamp = time.Unix(0, nanoseconds).UTC()
+	return cursor, nil
+}
+
+// This structure holds the filters which can be applied when querying the outputs of a recurring command
+type RecurringOutputsFilter struct {
+	RecurringCommandId int64                   //The recurring command which produced the outputs
+	From               *time.Time              //Only the outputs after this moment
+	To                 *time.Time              //Only the outputs before this moment
+	After              *RecurringOutputsCursor //Only the outputs after the cursor (the next page)
+	Limit              int64                   //The maximum number of outputs returned
+}
+
+type RecurringOutputsApiResponse struct {
+	Outputs    []databaseModels.RecurringCommandOutput `json:"outputs"`    //The outputs of the page in chronological order
+	NextCursor string                                  `json:"nextCursor"` //The cursor of the next page (empty if this is the last page)
+}
+
+func (roar *RecurringOutputsApiResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(roar)
+}
@@ -3,13 +3,16 @@ package models
 import (
 	"encoding/json"
 	"io"
+	"time"
 
 	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
 )
 
 type AgentRegisterResponse struct {
-	Status  string `json:"status"`
-	AgentId int64  `json:"agentId"`
+	Status      string `json:"status"`
+	AgentId     int64  `json:"agentId"`
+	Secret      string `json:"secret"`      //The secret the agent uses to authenticate on the websocket (only sent once)
+	Certificate string `json:"certificate"` //The PEM client certificate signed by the agents CA (if the agent sent a certificate request)
 }
 
 func (arr *AgentRegisterResponse) FromJSON(r io.Reader) error {
@@ -23,13 +26,19 @@ func (arr *AgentRegisterResponse) ToJSON(w io.Writer) error {
 }
 
 type AgentsResponse struct {
-	Id            int64  `json:"id"`            //The id of the agent
-	Name          string `json:"name"`          //The name of the agent
-	Username      string `json:"username"`      //The OS username the agent is running as
-	DisplayName   string `json:"displayname"`   //The display name of the user the agent is running as
-	OsUserId      string `json:"osUserId"`      //The UserId from the OS of the user the agent is running as
-	OsUserGroupId string `json:"osUserGroupId"` //The GroupId from the OS of the user the agent is running as
-	HomeDirectory string `json:"homeDirectory"` //The home directory of the OS user the agent is running as
+	Id             int64      `json:"id"`             //The id of the agent
+	Name           string     `json:"name"`           //The name of the agent
+	Username       string     `json:"username"`       //The OS username the agent is running as
+	DisplayName    string     `json:"displayname"`    //The display name of the user the agent is running as
+	OsUserId       string     `json:"osUserId"`       //The UserId from the OS of the user the agent is running as
+	OsUserGroupId  string     `json:"osUserGroupId"`  //The GroupId from the OS of the user the agent is running as
+	HomeDirectory  string     `json:"homeDirectory"`  //The home directory of the OS user the agent is running as
+	Tags           []string   `json:"tags"`           //The tags assigned to the agent
+	Online         bool       `json:"online"`         //If the agent is connected to the websocket
+	LastSeen       *time.Time `json:"lastSeen"`       //The last time a message or a heartbeat was received from the agent (null if it never connected)
+	ConnectedAt    *time.Time `json:"connectedAt"`    //When the agent last connected to the websocket
+	DisconnectedAt *time.Time `json:"disconnectedAt"` //When the agent last disconnected from the websocket
+	Latency        *float64   `json:"latency"`        //The round trip time of the last heartbeat in milliseconds (null if the agent is offline or did not answer a heartbeat yet)
 }
 
 func (ar *AgentsResponse) ToJSON(w io.Writer) error {
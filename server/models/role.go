@@ -0,0 +1,46 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Roles an operator can have, each role includes the permissions of the previous ones
+const (
+	RoleViewer   string = "viewer"   //Can only view agents and command outputs
+	RoleOperator string = "operator" //Can also execute commands on the agents
+	RoleAdmin    string = "admin"    //Can also manage users and agents
+	RolePending  string = "pending"  //Registered but not approved by an admin yet, has no access until an admin sets a role
+)
+
+// The privilege level of every role, used to compare roles
+var roleLevels = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// Check if the role is one of the known roles
+func IsValidRole(role string) bool {
+	_, found := roleLevels[role]
+	return found
+}
+
+// Check if the role has at least the privileges of the required role
+func RoleHasPermission(role string, requiredRole string) bool {
+	level, found := roleLevels[role]
+	if !found {
+		return false
+	}
+	return level >= roleLevels[requiredRole]
+}
+
+// This structure holds the new role of a user sent by an admin
+type UpdateRoleRequest struct {
+	Role string `json:"role" validate:"required,oneof=viewer operator admin"`
+}
+
+func (urr *UpdateRoleRequest) FromJSON(r io.Reader) error {
+	d := json.NewDecoder(r)
+	return d.Decode(urr)
+}
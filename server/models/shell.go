@@ -0,0 +1,17 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+)
+
+type ShellSessionsApiResponse struct {
+	Sessions []databaseModels.ShellSession `json:"sessions"` //The shell sessions of the agent, the most recent first
+}
+
+func (ssar *ShellSessionsApiResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(ssar)
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// This structure holds the tags an operator assigns to an agent
+type AgentTagsRequest struct {
+	Tags []string `json:"tags" validate:"required,min=1,dive,required,max=64"` //The tags which are added to the agent
+}
+
+func (atr *AgentTagsRequest) FromJSON(r io.Reader) error {
+	d := json.NewDecoder(r)
+	return d.Decode(atr)
+}
+
+type AgentTagsApiResponse struct {
+	Tags []string `json:"tags"` //The tags of the agent
+}
+
+func (atar *AgentTagsApiResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(atar)
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+)
+
+// A period in which an agent was not connected
+type AgentOutage struct {
+	From     time.Time `json:"from"`     //When the agent disconnected (or the start of the window)
+	To       time.Time `json:"to"`       //When the agent connected again (or the end of the window)
+	Duration float64   `json:"duration"` //The number of seconds the agent was offline
+	Reason   string    `json:"reason"`   //Why the agent disconnected
+	Ongoing  bool      `json:"ongoing"`  //If the agent was still offline at the end of the window
+}
+
+// The availability of an agent in a time window
+type AgentUptime struct {
+	AgentId          int64         `json:"agentId"`
+	Uptime           *float64      `json:"uptime"`           //The percentage of the monitored time the agent was connected (null if the agent never connected before the end of the window)
+	OnlineSeconds    float64       `json:"onlineSeconds"`    //The number of seconds the agent was connected
+	MonitoredSeconds float64       `json:"monitoredSeconds"` //The number of seconds of the window after the agent first connected
+	Disconnections   int           `json:"disconnections"`   //The number of times the agent disconnected in the window
+	Outages          []AgentOutage `json:"outages"`          //The periods the agent was offline
+}
+
+type UptimeApiResponse struct {
+	From   time.Time     `json:"from"` //The start of the window
+	To     time.Time     `json:"to"`   //The end of the window
+	Agents []AgentUptime `json:"agents"`
+}
+
+func (uar *UptimeApiResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(uar)
+}
+
+type AgentConnectionsApiResponse struct {
+	Events []databaseModels.AgentConnectionEvent `json:"events"` //The connections and disconnections of the agent, the oldest first
+}
+
+func (acar *AgentConnectionsApiResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(acar)
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+)
+
+// This structure holds the credentials sent by an operator when registering or logging in
+type UserCredentials struct {
+	Username string `json:"username" validate:"required,min=3,max=64"` //The username of the operator
+	Password string `json:"password" validate:"required,min=8,max=72"` //The password of the operator (bcrypt only uses the first 72 bytes)
+}
+
+func (uc *UserCredentials) FromJSON(r io.Reader) error {
+	d := json.NewDecoder(r)
+	return d.Decode(uc)
+}
+
+type UserRegisterResponse struct {
+	Status string `json:"status"`
+	UserId int64  `json:"userId"`
+	Role   string `json:"role"` //The role of the new account (pending until an admin approves it)
+}
+
+func (urr *UserRegisterResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(urr)
+}
+
+type LoginResponse struct {
+	Status    string `json:"status"`
+	Token     string `json:"token"`     //The bearer token which should be sent in the Authorization header
+	ExpiresAt int64  `json:"expiresAt"` //Unix timestamp when the token expires
+}
+
+func (lr *LoginResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(lr)
+}
+
+type UsersApiResponse struct {
+	Users []databaseModels.User `json:"users"` //The list of operator accounts
+}
+
+func (uar *UsersApiResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(uar)
+}
+
+// This structure is returned by the "who am I" endpoint so the dashboard can adapt to the role of the operator
+type WhoAmIResponse struct {
+	Id              int64  `json:"id"`              //The id of the user
+	Username        string `json:"username"`        //The username of the user
+	Role            string `json:"role"`            //The role of the user
+	CanExecute      bool   `json:"canExecute"`      //If the user can execute commands on the agents
+	CanManageUsers  bool   `json:"canManageUsers"`  //If the user can manage the operator accounts
+	CanManageAgents bool   `json:"canManageAgents"` //If the user can delete agents
+}
+
+func (wair *WhoAmIResponse) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(wair)
+}
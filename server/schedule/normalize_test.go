@@ -0,0 +1,66 @@
+package schedule
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalize(t *testing.T) {
+	gameStart := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		tick time.Duration
+		want string //Empty if the schedule is rejected
+	}{
+		{"  */5   * * * * ", 0, "*/5 * * * *"},
+		{"@every 1m", 0, "@every 1m"},
+		{"@tick", time.Minute, "@every 1m0s 2024-05-01T09:00:00Z"},
+		{"@tick+5s", 2 * time.Minute, "@every 2m0s+5s 2024-05-01T09:00:00Z"},
+		{"@tick + 5s", 2 * time.Minute, "@every 2m0s+5s 2024-05-01T09:00:00Z"},
+		{"@tick", 0, ""},
+		{"@tick5s", time.Minute, ""},
+		{"@tick+2m", time.Minute, ""},
+		{"30 2 31 2 *", 0, ""},
+		{"61 * * * *", 0, ""},
+	}
+	for _, test := range tests {
+		got, err := Normalize(test.spec, test.tick, gameStart)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("Normalize(%q) should fail, got %q", test.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Normalize(%q) failed: %v", test.spec, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Normalize(%q) = %q, want %q", test.spec, got, test.want)
+		}
+	}
+}
+
+// The agent has a copy of the parser (the modules do not depend on each other), both must parse the schedules the same way
+func TestAgentCopyIsIdentical(t *testing.T) {
+	//The server also has Normalize at the end of schedule.go
+	files := map[string]bool{"cron.go": false, "schedule.go": true, "schedule_test.go": false}
+	for name, prefixOnly := range files {
+		agentCopy, err := os.ReadFile("../../agent/schedule/" + name)
+		if os.IsNotExist(err) {
+			t.Skip("the agent module is not next to the server module")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverCopy, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prefixOnly && !strings.HasPrefix(string(serverCopy), string(agentCopy)) || !prefixOnly && string(serverCopy) != string(agentCopy) {
+			t.Errorf("agent/schedule/%s differs from server/schedule/%s", name, name)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func mustTime(t *testing.T, value string) time.Time {
+	t.Helper()
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatalf("invalid time %q: %v", value, err)
+	}
+	return parsed
+}
+
+func TestParseInvalid(t *testing.T) {
+	specs := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+		"*/x * * * *",
+		"@every",
+		"@every 500ms",
+		"@every x",
+		"@every 1m+1m",
+		"@every 1m+x",
+		"@every 1m not-a-time",
+		"@every 1m 2024-05-01T09:00:00Z extra",
+	}
+	for _, spec := range specs {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) should fail", spec)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		spec  string
+		after string
+		want  string //Empty if the schedule never runs
+	}{
+		{"*/5 * * * *", "2024-05-01T10:02:30Z", "2024-05-01T10:05:00Z"},
+		{"*/5 * * * *", "2024-05-01T10:05:00Z", "2024-05-01T10:10:00Z"},
+		{"0 0 * * *", "2024-05-01T23:59:59Z", "2024-05-02T00:00:00Z"},
+		{"0 0 1 * *", "2024-12-15T00:00:00Z", "2025-01-01T00:00:00Z"},
+		{"0 9-17/4 * * *", "2024-05-01T10:00:00Z", "2024-05-01T13:00:00Z"},
+		{"5/20 * * * *", "2024-05-01T10:00:00Z", "2024-05-01T10:05:00Z"},
+		{"5/20 * * * *", "2024-05-01T10:05:00Z", "2024-05-01T10:25:00Z"},
+		{"15,45 * * * *", "2024-05-01T10:20:00Z", "2024-05-01T10:45:00Z"},
+		//2024-05-01 is a Wednesday, Sunday is both 0 and 7
+		{"0 12 * * 0", "2024-05-01T00:00:00Z", "2024-05-05T12:00:00Z"},
+		{"0 12 * * 7", "2024-05-01T00:00:00Z", "2024-05-05T12:00:00Z"},
+		//When both day fields are restricted a day matches if any of them matches
+		{"0 0 15 * 1", "2024-05-01T00:00:00Z", "2024-05-06T00:00:00Z"},
+		{"0 0 29 2 *", "2024-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"30 2 31 2 *", "2024-05-01T00:00:00Z", ""},
+		//The cron expressions are evaluated in UTC
+		{"0 12 * * *", "2024-05-01T13:30:00+02:00", "2024-05-01T12:00:00Z"},
+		{"0 12 * * *", "2024-05-01T14:30:00+02:00", "2024-05-02T12:00:00Z"},
+		{"@every 90s", "1970-01-01T00:00:00Z", "1970-01-01T00:01:30Z"},
+		{"@every 1m+5s", "2024-05-01T10:00:04Z", "2024-05-01T10:00:05Z"},
+		{"@every 1m+5s", "2024-05-01T10:00:05Z", "2024-05-01T10:01:05Z"},
+		{"@every 2m 2024-05-01T09:00:30Z", "2024-05-01T08:00:00Z", "2024-05-01T09:00:30Z"},
+		{"@every 2m 2024-05-01T09:00:30Z", "2024-05-01T09:01:00Z", "2024-05-01T09:02:30Z"},
+		{"@every 2m+10s 2024-05-01T09:00:30Z", "2024-05-01T09:00:40Z", "2024-05-01T09:02:40Z"},
+	}
+	for _, test := range tests {
+		sched, err := Parse(test.spec)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", test.spec, err)
+			continue
+		}
+		got := sched.Next(mustTime(t, test.after))
+		if test.want == "" {
+			if !got.IsZero() {
+				t.Errorf("%q after %s: got %s, want no run", test.spec, test.after, got)
+			}
+			continue
+		}
+		if want := mustTime(t, test.want); !got.Equal(want) {
+			t.Errorf("%q after %s: got %s, want %s", test.spec, test.after, got, want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package selector
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The maximum length of a selector expression
+const maxExpressionLength = 1024
+
+type tokenType int
+
+const (
+	tokenWord tokenType = iota
+	tokenQuoted
+	tokenOperator
+	tokenOpenParen
+	tokenCloseParen
+	tokenEnd
+)
+
+type token struct {
+	kind     tokenType
+	value    string
+	position int //The position of the token in the expression, used in the error messages
+}
+
+// Split the expression in words, quoted values, comparison operators (=, !=, ~, !~) and parentheses
+func tokenize(expr string) ([]token, error) {
+	tokens := make([]token, 0)
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenOpenParen, value: "(", position: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenCloseParen, value: ")", position: i})
+			i++
+		case c == '=' || c == '~':
+			tokens = append(tokens, token{kind: tokenOperator, value: string(c), position: i})
+			i++
+		case c == '!':
+			if i+1 >= len(expr) || (expr[i+1] != '=' && expr[i+1] != '~') {
+				return nil, fmt.Errorf("expected != or !~ at position %d", i)
+			}
+			tokens = append(tokens, token{kind: tokenOperator, value: expr[i : i+2], position: i})
+			i += 2
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(expr[i+1:], c)
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated quoted value at position %d", i)
+			}
+			tokens = append(tokens, token{kind: tokenQuoted, value: expr[i+1 : i+1+end], position: i})
+			i += end + 2
+		default:
+			start := i
+			for i < len(expr) && !strings.ContainsRune(" \t\n\r()=~!\"'", rune(expr[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenWord, value: expr[start:i], position: start})
+		}
+	}
+	tokens = append(tokens, token{kind: tokenEnd, position: len(expr)})
+	return tokens, nil
+}
+
+// Recursive descent parser, the precedence from the lowest is OR, AND, NOT
+//
+//	expression := and { OR and }
+//	and        := unary { AND unary }
+//	unary      := NOT unary | primary
+//	primary    := ( expression ) | flag | attribute operator value
+type parser struct {
+	tokens  []token
+	current int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.current]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.current]
+	if t.kind != tokenEnd {
+		p.current++
+	}
+	return t
+}
+
+// Check if the next token is the keyword (the keywords are case insensitive and cannot be quoted)
+func (p *parser) acceptKeyword(keyword string) bool {
+	t := p.peek()
+	if t.kind == tokenWord && strings.EqualFold(t.value, keyword) {
+		p.current++
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseExpression() (Selector, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orSelector{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Selector, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andSelector{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (Selector, error) {
+	if p.acceptKeyword("NOT") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notSelector{operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Selector, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenOpenParen:
+		inner, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenCloseParen {
+			return nil, fmt.Errorf("expected ) at position %d", closing.position)
+		}
+		return inner, nil
+	case tokenWord:
+	case tokenEnd:
+		return nil, errors.New("unexpected end of the selector")
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", t.value, t.position)
+	}
+
+	name := strings.ToLower(t.value)
+	if p.peek().kind != tokenOperator {
+		switch name {
+		case FlagOnline:
+			return flagSelector{online: true}, nil
+		case FlagOffline:
+			return flagSelector{online: false}, nil
+		}
+		if knownAttributes[name] {
+			return nil, fmt.Errorf("expected an operator after %q at position %d", t.value, p.peek().position)
+		}
+		return nil, fmt.Errorf("unknown flag %q at position %d", t.value, t.position)
+	}
+	if !knownAttributes[name] {
+		return nil, fmt.Errorf("unknown attribute %q at position %d", t.value, t.position)
+	}
+
+	operator := p.next()
+	value := p.next()
+	if value.kind != tokenWord && value.kind != tokenQuoted {
+		return nil, fmt.Errorf("expected a value after %s%s at position %d", t.value, operator.value, value.position)
+	}
+	comparison := comparisonSelector{attribute: name, value: value.value, negated: strings.HasPrefix(operator.value, "!")}
+	if strings.HasSuffix(operator.value, "~") {
+		comparison.pattern = compileGlob(value.value)
+	}
+	return comparison, nil
+}
+
+// Parse a selector expression
+// Comparisons (attribute=value, attribute!=value, attribute~glob, attribute!~glob) and flags (online, offline)
+// can be combined with AND, OR, NOT and parentheses
+func Parse(expr string) (Selector, error) {
+	if len(expr) > maxExpressionLength {
+		return nil, fmt.Errorf("the selector cannot be longer than %d characters", maxExpressionLength)
+	}
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	if p.peek().kind == tokenEnd {
+		return nil, errors.New("the selector is empty")
+	}
+	sel, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, fmt.Errorf("unexpected %q at position %d", t.value, t.position)
+	}
+	return sel, nil
+}
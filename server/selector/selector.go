@@ -0,0 +1,128 @@
+package selector
+
+import (
+	"regexp"
+	"strings"
+)
+
+// The attributes of an agent which can be used in a selector
+// An attribute can have multiple values (ex. the ip addresses or the groups), a comparison matches if any of the values matches
+const (
+	AttributeId        = "id"        //The id of the agent
+	AttributeName      = "name"      //The name of the agent
+	AttributeUsername  = "username"  //The OS user the agent is running as
+	AttributeUserId    = "uid"       //The OS user id the agent is running as
+	AttributeHostname  = "hostname"  //The hostname of the machine
+	AttributeOs        = "os"        //The operating system of the machine (ex. linux, windows)
+	AttributeIp        = "ip"        //The ip addresses of the interfaces of the machine
+	AttributeInterface = "interface" //The names of the interfaces of the machine
+	AttributeGroup     = "group"     //The names of the OS groups of the user the agent is running as
+	AttributeTag       = "tag"       //The tags assigned to the agent
+)
+
+// The flags which can be used without a value
+const (
+	FlagOnline  = "online"  //The agent is connected to the websocket
+	FlagOffline = "offline" //The agent is not connected to the websocket
+)
+
+var knownAttributes = map[string]bool{
+	AttributeId:        true,
+	AttributeName:      true,
+	AttributeUsername:  true,
+	AttributeUserId:    true,
+	AttributeHostname:  true,
+	AttributeOs:        true,
+	AttributeIp:        true,
+	AttributeInterface: true,
+	AttributeGroup:     true,
+	AttributeTag:       true,
+}
+
+// The data of an agent a selector is evaluated against
+type Target struct {
+	Attributes map[string][]string //The values of every attribute
+	Online     bool                //If the agent is connected to the websocket
+}
+
+// A parsed selector expression (ex. os=linux AND hostname~web* AND online AND group=docker)
+type Selector interface {
+	Matches(target Target) bool
+}
+
+type andSelector struct {
+	left  Selector
+	right Selector
+}
+
+func (as andSelector) Matches(target Target) bool {
+	return as.left.Matches(target) && as.right.Matches(target)
+}
+
+type orSelector struct {
+	left  Selector
+	right Selector
+}
+
+func (os orSelector) Matches(target Target) bool {
+	return os.left.Matches(target) || os.right.Matches(target)
+}
+
+type notSelector struct {
+	operand Selector
+}
+
+func (ns notSelector) Matches(target Target) bool {
+	return !ns.operand.Matches(target)
+}
+
+// online or offline
+type flagSelector struct {
+	online bool
+}
+
+func (fs flagSelector) Matches(target Target) bool {
+	return target.Online == fs.online
+}
+
+// attribute=value, attribute!=value, attribute~glob or attribute!~glob
+// The values are compared case insensitive
+type comparisonSelector struct {
+	attribute string
+	value     string
+	pattern   *regexp.Regexp //Set for the glob comparisons
+	negated   bool           //!= and !~ match if none of the values matches
+}
+
+func (cs comparisonSelector) Matches(target Target) bool {
+	matched := false
+	for _, value := range target.Attributes[cs.attribute] {
+		if cs.pattern != nil {
+			matched = cs.pattern.MatchString(value)
+		} else {
+			matched = strings.EqualFold(value, cs.value)
+		}
+		if matched {
+			break
+		}
+	}
+	return matched != cs.negated
+}
+
+// Convert a glob where * matches any sequence of characters and ? matches a single character to a regular expression
+func compileGlob(glob string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString("(?is)^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
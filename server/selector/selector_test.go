@@ -0,0 +1,142 @@
+package selector
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseInvalid(t *testing.T) {
+	expressions := []string{
+		"",
+		"   ",
+		"os",
+		"os=",
+		"os!=",
+		"os=linux AND",
+		"os=linux OR",
+		"NOT",
+		"AND os=linux",
+		"(os=linux",
+		"os=linux)",
+		"()",
+		"os=linux os=windows",
+		"unknown=linux",
+		"unknown",
+		"os!linux",
+		"os!",
+		"os=='linux'",
+		"= linux",
+		"os='linux",
+		"os=\"linux",
+		"os=(linux)",
+		"os=linux AND (hostname~web* OR",
+		strings.Repeat("online OR ", 103) + "online",
+	}
+	for _, expr := range expressions {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) should fail", expr)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	targets := []Target{
+		{Online: true, Attributes: map[string][]string{
+			AttributeOs: {"linux"}, AttributeHostname: {"web-01"}, AttributeTag: {"prod", "team/a"}, AttributeIp: {"10.0.0.5", "192.168.1.5"}, AttributeGroup: {"docker", "sudo"},
+		}},
+		{Online: false, Attributes: map[string][]string{
+			AttributeOs: {"linux"}, AttributeHostname: {"db.prod"}, AttributeTag: {"prod"}, AttributeIp: {"10.0.0.6"},
+		}},
+		{Online: true, Attributes: map[string][]string{
+			AttributeOs: {"windows"}, AttributeHostname: {"WIN-DC"},
+		}},
+		{Online: false, Attributes: map[string][]string{
+			AttributeOs: {"linux"}, AttributeHostname: {"dbxprod"},
+		}},
+	}
+	tests := []struct {
+		expr string
+		want string //If the selector matches every target (1) or not (0)
+	}{
+		{"os=linux", "1101"},
+		{"OS=LINUX", "1101"},
+		{"os!=linux", "0010"},
+		{"online", "1010"},
+		{"OFFLINE", "0101"},
+		{"hostname~web*", "1000"},
+		{"hostname!~web*", "0111"},
+		{"hostname~win-*", "0010"},
+		//The values of an attribute match if any of them matches, != and !~ match if none of them matches
+		{"ip~*.5", "1000"},
+		{"group=docker", "1000"},
+		{"group!=docker", "0111"},
+		{"tag!=prod", "0011"},
+		//AND has a higher precedence than OR
+		{"os=windows OR os=linux AND online", "1010"},
+		{"os=linux AND online OR os=windows", "1010"},
+		{"(os=windows OR os=linux) AND online", "1010"},
+		{"os=windows OR (os=linux AND offline)", "0111"},
+		{"(os=windows OR os=linux) AND offline", "0101"},
+		//NOT has the highest precedence
+		{"NOT online", "0101"},
+		{"NOT os=linux AND online", "0010"},
+		{"not (os=linux or offline)", "0010"},
+		{"NOT NOT online", "1010"},
+		{"((online))", "1010"},
+		//The quoted values can contain the characters of the operators and spaces
+		{"tag='team/a'", "1000"},
+		{`tag="team/a"`, "1000"},
+		{"hostname='web-01' AND tag=\"prod\"", "1000"},
+		{"hostname='web 01'", "0000"},
+		{"hostname~'(web)*'", "0000"},
+		//The metacharacters of the regular expressions are matched literally, only * and ? are wildcards
+		{"hostname~db.p*", "0100"},
+		{"hostname~db?prod", "0101"},
+		{"hostname~'web-0[1]'", "0000"},
+		{"hostname~'web-0+'", "0000"},
+		{"hostname~*", "1111"},
+		{"hostname~???-??", "1010"},
+		{"hostname~??-??", "0000"},
+		{"hostname~'db.prod\nx'", "0000"},
+	}
+	for _, test := range tests {
+		sel, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", test.expr, err)
+			continue
+		}
+		var got strings.Builder
+		for _, target := range targets {
+			if sel.Matches(target) {
+				got.WriteString("1")
+			} else {
+				got.WriteString("0")
+			}
+		}
+		if got.String() != test.want {
+			t.Errorf("%q: got %s, want %s", test.expr, got.String(), test.want)
+		}
+	}
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string //A part of the error message
+	}{
+		{"os=linux AND", "unexpected end"},
+		{"unknown=linux", `unknown attribute "unknown" at position 0`},
+		{"os=linux AND unknown", `unknown flag "unknown" at position 13`},
+		{"online AND os", `expected an operator after "os" at position 13`},
+		{"os=linux)", `unexpected ")" at position 8`},
+		{"(os=linux", "expected ) at position 9"},
+		{"os='linux", "unterminated quoted value at position 3"},
+		{"os!linux", "expected != or !~ at position 2"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.expr)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Parse(%q): got error %v, want it to contain %q", test.expr, err, test.want)
+		}
+	}
+}
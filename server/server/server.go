@@ -1,12 +1,19 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -14,6 +21,8 @@ import (
 	"github.com/lucacoratu/ADTool/server/database"
 	"github.com/lucacoratu/ADTool/server/handlers"
 	"github.com/lucacoratu/ADTool/server/logging"
+	"github.com/lucacoratu/ADTool/server/models"
+	"github.com/lucacoratu/ADTool/server/utils"
 	"github.com/lucacoratu/ADTool/server/websocket"
 )
 
@@ -23,6 +32,8 @@ type APIServer struct {
 	configFile    string
 	configuration configuration.Configuration
 	dbConnection  database.IConnection
+	agentsCA      *utils.CertificateAuthority //The CA which signs the client certificates of the agents (nil if disabled)
+	pool          *websocket.Pool             //The websocket connections of the agents and the dashboards
 }
 
 func (api *APIServer) LoggingMiddleware(next http.Handler) http.Handler {
@@ -35,6 +46,149 @@ func (api *APIServer) LoggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// Middleware which checks the bearer token of the operator and saves the user in the request context
+func (api *APIServer) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := handlers.GetBearerToken(r)
+		if token == "" {
+			apiErr := models.NewAuthenticationError("Missing bearer token")
+			w.WriteHeader(http.StatusUnauthorized)
+			apiErr.ToJSON(w)
+			return
+		}
+
+		//Get the user associated with the session token
+		user, err := api.dbConnection.GetUserBySession(utils.HashToken(token))
+		if err != nil {
+			if errors.Is(err, database.ErrRecordNotFound) {
+				apiErr := models.NewAuthenticationError("Invalid or expired token")
+				w.WriteHeader(http.StatusUnauthorized)
+				apiErr.ToJSON(w)
+				return
+			}
+			api.logger.Error(err.Error())
+			apiErr := models.NewDatabaseError("Could not verify the token")
+			w.WriteHeader(http.StatusInternalServerError)
+			apiErr.ToJSON(w)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(handlers.ContextWithUser(r.Context(), user)))
+	})
+}
+
+// Middleware which authenticates the websocket connections of the dashboards
+// The browsers cannot set the Authorization header on websockets so the token can also be sent in the token query parameter
+func (api *APIServer) WebsocketAuthMiddleware(next http.Handler) http.Handler {
+	authenticated := api.AuthMiddleware(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			if token := r.URL.Query().Get("token"); token != "" {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+		}
+		authenticated.ServeHTTP(w, r)
+	})
+}
+
+// The maximum size of the request body saved in the audit log
+const maxAuditPayloadSize = 64 * 1024
+
+// Wrapper around the ResponseWriter which saves the status code sent by the handler
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (sr *statusRecorder) WriteHeader(statusCode int) {
+	sr.statusCode = statusCode
+	sr.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Get the wrapped ResponseWriter, used by http.ResponseController
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// Take over the connection (the websocket upgrader checks for http.Hijacker directly)
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(sr.ResponseWriter).Hijack()
+	if err == nil {
+		sr.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Send the buffered response to the client (used by the streaming handlers)
+func (sr *statusRecorder) Flush() {
+	http.NewResponseController(sr.ResponseWriter).Flush()
+}
+
+// The body of an audited request, the saved prefix followed by the rest of the original body
+type auditedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// Middleware which saves every request of an authenticated operator in the audit log
+// It should be used after the AuthMiddleware so the operator is known
+func (api *APIServer) AuditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//The action is the name of the route (or the path template if the route has no name)
+		action := ""
+		template := ""
+		route := mux.CurrentRoute(r)
+		if route != nil {
+			template, _ = route.GetPathTemplate()
+			action = route.GetName()
+			if action == "" {
+				action = template
+			}
+		}
+		entry := handlers.NewAuditEntry(r, action)
+
+		//The target agent is the id from the path of the agents routes
+		if strings.HasPrefix(template, "/api/v1/agents/{id") {
+			agentId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+			if err == nil {
+				entry.AgentId = &agentId
+			}
+		}
+
+		//Read only the prefix of the body which is saved, the handler reads it again followed by the rest of the body
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxAuditPayloadSize))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = auditedBody{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+		entry.Payload = string(body)
+
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		entry.StatusCode = recorder.statusCode
+		handlers.RecordAuditEntry(api.logger, api.dbConnection, entry)
+	})
+}
+
+// Create a middleware which allows the request only if the authenticated operator has at least the required role
+// It should be used after the AuthMiddleware
+func (api *APIServer) RoleMiddleware(requiredRole string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, found := handlers.UserFromRequest(r)
+			if !found || !models.RoleHasPermission(user.Role, requiredRole) {
+				apiErr := models.NewAuthorizationError("This action requires the " + requiredRole + " role")
+				w.WriteHeader(http.StatusForbidden)
+				apiErr.ToJSON(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // Initialize the api http server based on the configuration file
 func (api *APIServer) Init() error {
 	//Initialize the logger
@@ -54,6 +208,30 @@ func (api *APIServer) Init() error {
 	}
 	api.logger.Debug("Loaded configuration from file")
 
+	//Prepare the certificate used for HTTPS
+	if api.configuration.TLSEnabled {
+		err = api.initTLS()
+		if err != nil {
+			api.logger.Error("Error occured when preparing the TLS certificate,", err.Error())
+			return err
+		}
+	}
+
+	//Load the certificate authority which signs the agent client certificates
+	if api.configuration.AgentCACertificate != "" {
+		if !api.configuration.TLSEnabled {
+			err = errors.New("the agents CA requires TLS to be enabled")
+			api.logger.Error(err.Error())
+			return err
+		}
+		api.agentsCA, err = utils.LoadCertificateAuthority(api.configuration.AgentCACertificate, api.configuration.AgentCAKey)
+		if err != nil {
+			api.logger.Error("Error occured when loading the agents CA,", err.Error())
+			return err
+		}
+		api.logger.Debug("Loaded the agents certificate authority")
+	}
+
 	//Initialize the database connection
 	api.dbConnection = database.NewMysqlConnection(api.logger, api.configuration)
 	err = api.dbConnection.Init()
@@ -62,9 +240,28 @@ func (api *APIServer) Init() error {
 		return err
 	}
 	api.logger.Debug("Connection to the database has been initialized")
+	//The shell sessions which were open when the server stopped ended with it
+	interrupted, err := api.dbConnection.FinishInterruptedShellSessions()
+	if err != nil {
+		api.logger.Error("Error occured when closing the interrupted shell sessions", err.Error())
+		return err
+	}
+	if interrupted != 0 {
+		api.logger.Warning("Closed", interrupted, "shell sessions which were open when the server stopped")
+	}
+	//The agents which were connected when the server stopped are disconnected in their history
+	interrupted, err = api.dbConnection.FinishInterruptedAgentConnections()
+	if err != nil {
+		api.logger.Error("Error occured when closing the interrupted agent connections", err.Error())
+		return err
+	}
+	if interrupted != 0 {
+		api.logger.Warning("Saved the disconnection of", interrupted, "agents which were connected when the server stopped")
+	}
 
 	//Create the pool
 	pool := websocket.NewPool(api.logger, api.dbConnection)
+	api.pool = pool
 	//Start the pool in a goroutine
 	go pool.Start()
 
@@ -74,35 +271,141 @@ func (api *APIServer) Init() error {
 	r.Use(api.LoggingMiddleware)
 
 	//Create the handlers
-	wsHandler := handlers.NewWebsocketHandler(api.logger)
-	agentHandler := handlers.NewAgentsHandler(api.logger, api.configuration, api.dbConnection, pool)
+	wsHandler := handlers.NewWebsocketHandler(api.logger, api.configuration, api.dbConnection)
+	agentHandler := handlers.NewAgentsHandler(api.logger, api.configuration, api.dbConnection, pool, api.agentsCA)
+	usersHandler := handlers.NewUsersHandler(api.logger, api.configuration, api.dbConnection)
+	enrollmentHandler := handlers.NewEnrollmentHandler(api.logger, api.dbConnection)
+	auditHandler := handlers.NewAuditHandler(api.logger, api.dbConnection)
+	recurringHandler := handlers.NewRecurringCommandsHandler(api.logger, api.configuration, api.dbConnection, pool)
+	batchesHandler := handlers.NewBatchesHandler(api.logger, api.dbConnection, pool)
+	metricsHandler := handlers.NewMetricsHandler(api.logger, pool)
 
 	//Add the routes
-	//Create the subrouter for the API path
+	//Create the subrouters for the public routes (no authentication required)
+	publicGetSubrouter := r.PathPrefix("/api/v1/").Methods("GET").Subrouter()
+	publicPostSubrouter := r.PathPrefix("/api/v1/").Methods("POST").Subrouter()
+
+	//The mutating subrouters record every request in the audit log (before the role check so denied attempts are saved too)
+	//Create the subrouters for the API path which require an authenticated operator (any role)
 	apiGetSubrouter := r.PathPrefix("/api/v1/").Methods("GET").Subrouter()
+	apiGetSubrouter.Use(api.AuthMiddleware)
 	apiPostSubrouter := r.PathPrefix("/api/v1/").Methods("POST").Subrouter()
-	//apiDeleteSubrouter := r.PathPrefix("/api/v1/").Methods("DELETE").Subrouter()
-	//apiPutSubrouter := r.PathPrefix("/api/v1/").Methods("PUT").Subrouter()
+	apiPostSubrouter.Use(api.AuthMiddleware, api.AuditMiddleware)
+
+	//Create the subrouters for the routes which require at least the operator role
+	operatorGetSubrouter := r.PathPrefix("/api/v1/").Methods("GET").Subrouter()
+	operatorGetSubrouter.Use(api.AuthMiddleware, api.RoleMiddleware(models.RoleOperator))
+	operatorPostSubrouter := r.PathPrefix("/api/v1/").Methods("POST").Subrouter()
+	operatorPostSubrouter.Use(api.AuthMiddleware, api.AuditMiddleware, api.RoleMiddleware(models.RoleOperator))
+	operatorPutSubrouter := r.PathPrefix("/api/v1/").Methods("PUT").Subrouter()
+	operatorPutSubrouter.Use(api.AuthMiddleware, api.AuditMiddleware, api.RoleMiddleware(models.RoleOperator))
+	operatorDeleteSubrouter := r.PathPrefix("/api/v1/").Methods("DELETE").Subrouter()
+	operatorDeleteSubrouter.Use(api.AuthMiddleware, api.AuditMiddleware, api.RoleMiddleware(models.RoleOperator))
+
+	//Create the subrouter for the websocket of the dashboards (any role, the token can be sent in the query)
+	dashboardWsSubrouter := r.PathPrefix("/api/v1/").Methods("GET").Subrouter()
+	dashboardWsSubrouter.Use(api.WebsocketAuthMiddleware)
+	//Create the subrouter for the websocket of the shell sessions (operator role, the token can be sent in the query)
+	shellWsSubrouter := r.PathPrefix("/api/v1/").Methods("GET").Subrouter()
+	shellWsSubrouter.Use(api.WebsocketAuthMiddleware, api.RoleMiddleware(models.RoleOperator))
+
+	//Create the subrouters for the routes which require the admin role
+	adminGetSubrouter := r.PathPrefix("/api/v1/").Methods("GET").Subrouter()
+	adminGetSubrouter.Use(api.AuthMiddleware, api.RoleMiddleware(models.RoleAdmin))
+	adminPostSubrouter := r.PathPrefix("/api/v1/").Methods("POST").Subrouter()
+	adminPostSubrouter.Use(api.AuthMiddleware, api.AuditMiddleware, api.RoleMiddleware(models.RoleAdmin))
+	adminPutSubrouter := r.PathPrefix("/api/v1/").Methods("PUT").Subrouter()
+	adminPutSubrouter.Use(api.AuthMiddleware, api.AuditMiddleware, api.RoleMiddleware(models.RoleAdmin))
+	adminDeleteSubrouter := r.PathPrefix("/api/v1/").Methods("DELETE").Subrouter()
+	adminDeleteSubrouter.Use(api.AuthMiddleware, api.AuditMiddleware, api.RoleMiddleware(models.RoleAdmin))
 
 	//Create the route for healthcheck
-	apiGetSubrouter.HandleFunc("/healthcheck", handlers.Healthcheck)
+	publicGetSubrouter.HandleFunc("/healthcheck", handlers.Healthcheck)
+	//Create the route for registering an agent (the agent authenticates with an enrollment token)
+	publicPostSubrouter.HandleFunc("/agents", agentHandler.CreateAgent)
+	//Create the routes for operator registration and login
+	publicPostSubrouter.HandleFunc("/users/register", usersHandler.Register)
+	publicPostSubrouter.HandleFunc("/users/login", usersHandler.Login)
+
 	//Create the route for agents
 	apiGetSubrouter.HandleFunc("/agents", agentHandler.GetAgents)
+	//Create the routes to list the shell sessions of an agent and to download their recordings (asciicast v2)
+	//They require the same role as opening a shell because the recordings contain everything typed and shown in the shells
+	operatorGetSubrouter.HandleFunc("/agents/{id:[0-9]+}/shells", agentHandler.GetShellSessions)
+	operatorGetSubrouter.HandleFunc("/agents/{id:[0-9]+}/shells/{sessionId:[0-9a-f]+}", agentHandler.GetShellSession)
+	operatorGetSubrouter.HandleFunc("/agents/{id:[0-9]+}/shells/{sessionId:[0-9a-f]+}/recording", agentHandler.GetShellSessionRecording)
+	//Create the routes for the connection history and the uptime of the agents
+	apiGetSubrouter.HandleFunc("/agents/uptime", agentHandler.GetAgentsUptime)
+	apiGetSubrouter.HandleFunc("/agents/{id:[0-9]+}/connections", agentHandler.GetAgentConnections)
 	//Create the route to get commands of the agent
 	apiGetSubrouter.HandleFunc("/agents/{id:[0-9]+}/cmd", agentHandler.GetCommands)
+	//Create the route to get a command of the agent (?follow=true streams the output until it finishes)
+	apiGetSubrouter.HandleFunc("/agents/{id:[0-9]+}/cmd/{cmdId:[0-9]+}", agentHandler.GetCommand)
+
+	//Create the route to get the information about the authenticated operator
+	apiGetSubrouter.HandleFunc("/users/me", usersHandler.WhoAmI)
+	//Create the route to invalidate the session of the operator
+	apiPostSubrouter.HandleFunc("/users/logout", usersHandler.Logout).Name("logout")
 
-	//Create the route for registering an agent
-	apiPostSubrouter.HandleFunc("/agents", agentHandler.CreateAgent)
 	//Create the route to execute a command on an agent
-	apiPostSubrouter.HandleFunc("/agents/{id:[0-9]+}/cmd", agentHandler.ExecuteCommandOnAgent)
+	operatorPostSubrouter.HandleFunc("/agents/{id:[0-9]+}/cmd", agentHandler.ExecuteCommandOnAgent).Name("execute-command")
 	//Create the route to execute a recurring command on an agent
-	apiPostSubrouter.HandleFunc("/agents/{id:[0-9]+}/reccmd", agentHandler.ExecuteRecurringCommandOnAgent)
+	operatorPostSubrouter.HandleFunc("/agents/{id:[0-9]+}/reccmd", agentHandler.ExecuteRecurringCommandOnAgent).Name("create-recurring-command")
+	//Create the route to cancel a queued or running command
+	operatorDeleteSubrouter.HandleFunc("/agents/{id:[0-9]+}/cmd/{cmdId:[0-9]+}", agentHandler.CancelCommand).Name("cancel-command")
+
+	//Create the routes to manage the tags of the agents
+	apiGetSubrouter.HandleFunc("/agents/{id:[0-9]+}/tags", agentHandler.GetAgentTags)
+	operatorPostSubrouter.HandleFunc("/agents/{id:[0-9]+}/tags", agentHandler.AddAgentTags).Name("add-agent-tags")
+	operatorDeleteSubrouter.HandleFunc("/agents/{id:[0-9]+}/tags/{tag:.+}", agentHandler.RemoveAgentTag).Name("remove-agent-tag")
+
+	//Create the routes to execute a command on multiple agents and get the results
+	operatorPostSubrouter.HandleFunc("/batches", batchesHandler.ExecuteBatchCommand).Name("execute-batch-command")
+	apiGetSubrouter.HandleFunc("/batches/{id:[0-9]+}", batchesHandler.GetBatch)
 
-	//Create the route which will handle websocket agent connections
-	apiGetSubrouter.HandleFunc("/agents/{id:[0-9]+}/ws", func(rw http.ResponseWriter, r *http.Request) {
+	//Create the routes to manage the recurring commands
+	apiGetSubrouter.HandleFunc("/agents/{id:[0-9]+}/reccmd", recurringHandler.GetAgentRecurringCommands)
+	operatorPostSubrouter.HandleFunc("/reccmd", recurringHandler.CreateSelectorRecurringCommands).Name("create-selector-recurring-commands")
+	apiGetSubrouter.HandleFunc("/reccmd/{id:[0-9]+}", recurringHandler.GetRecurringCommand)
+	apiGetSubrouter.HandleFunc("/reccmd/{id:[0-9]+}/outputs", recurringHandler.GetRecurringCommandOutputs)
+	apiGetSubrouter.HandleFunc("/reccmd/{id:[0-9]+}/outputs/latest", recurringHandler.GetLatestRecurringCommandOutput)
+	operatorPutSubrouter.HandleFunc("/reccmd/{id:[0-9]+}", recurringHandler.UpdateRecurringCommand).Name("update-recurring-command")
+	operatorPostSubrouter.HandleFunc("/reccmd/{id:[0-9]+}/pause", recurringHandler.PauseRecurringCommand).Name("pause-recurring-command")
+	operatorPostSubrouter.HandleFunc("/reccmd/{id:[0-9]+}/resume", recurringHandler.ResumeRecurringCommand).Name("resume-recurring-command")
+	operatorDeleteSubrouter.HandleFunc("/reccmd/{id:[0-9]+}", recurringHandler.DeleteRecurringCommand).Name("delete-recurring-command")
+
+	//Create the routes to manage the operator accounts
+	adminGetSubrouter.HandleFunc("/users", usersHandler.GetUsers)
+	adminPutSubrouter.HandleFunc("/users/{id:[0-9]+}/role", usersHandler.UpdateUserRole).Name("update-user-role")
+	adminDeleteSubrouter.HandleFunc("/users/{id:[0-9]+}", usersHandler.DeleteUser).Name("delete-user")
+	//Create the route to delete an agent
+	adminDeleteSubrouter.HandleFunc("/agents/{id:[0-9]+}", agentHandler.DeleteAgent).Name("delete-agent")
+	//Create the route to revoke the client certificates of an agent
+	adminDeleteSubrouter.HandleFunc("/agents/{id:[0-9]+}/certificate", agentHandler.RevokeAgentCertificate).Name("revoke-agent-certificate")
+	//Create the route to get the audit log of the operator actions
+	adminGetSubrouter.HandleFunc("/audit", auditHandler.GetAuditLog)
+	//Create the route to get the metrics of the server
+	adminGetSubrouter.HandleFunc("/metrics", metricsHandler.GetMetrics)
+	//Create the routes to manage the enrollment tokens used by the agents to register
+	adminGetSubrouter.HandleFunc("/enrollment-tokens", enrollmentHandler.GetEnrollmentTokens)
+	adminPostSubrouter.HandleFunc("/enrollment-tokens", enrollmentHandler.CreateEnrollmentToken).Name("create-enrollment-token")
+	adminDeleteSubrouter.HandleFunc("/enrollment-tokens/{id:[0-9]+}", enrollmentHandler.DeleteEnrollmentToken).Name("delete-enrollment-token")
+
+	//Create the route which will handle websocket agent connections (agents authenticate with their own secret)
+	publicGetSubrouter.HandleFunc("/agents/{id:[0-9]+}/ws", func(rw http.ResponseWriter, r *http.Request) {
 		wsHandler.ServeAgentWs(pool, rw, r)
 	})
 
+	//Create the route which will publish the live events to the dashboards
+	dashboardWsSubrouter.HandleFunc("/dashboard/ws", func(rw http.ResponseWriter, r *http.Request) {
+		wsHandler.ServeDashboardWs(pool, rw, r)
+	})
+
+	//Create the route which will attach the terminal of an operator to a shell on the agent
+	shellWsSubrouter.HandleFunc("/agents/{id:[0-9]+}/shell", func(rw http.ResponseWriter, r *http.Request) {
+		wsHandler.ServeShellWs(pool, rw, r)
+	})
+
 	api.srv = &http.Server{
 		Addr: api.configuration.ListeningAddress + ":" + strconv.Itoa(api.configuration.ListeningPort),
 		// Good practice to set timeouts to avoid Slowloris attacks.
@@ -112,15 +415,54 @@ func (api *APIServer) Init() error {
 		Handler:      r, // Pass our instance of gorilla/mux in.
 	}
 
+	//Ask for the client certificates of the agents (the dashboard does not have to send one)
+	if api.agentsCA != nil {
+		api.srv.TLSConfig = &tls.Config{
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  api.agentsCA.CertPool(),
+		}
+	}
+
+	return nil
+}
+
+// Check if the TLS certificate exists and generate a self-signed one if it does not
+// The fingerprint of the certificate is logged so it can be pinned in the configuration of the agents
+func (api *APIServer) initTLS() error {
+	certExists := utils.CheckFileExists(api.configuration.TLSCertificate)
+	keyExists := utils.CheckFileExists(api.configuration.TLSKey)
+	if certExists != keyExists {
+		return errors.New("only one of the TLS certificate and key files exists")
+	}
+	if !certExists {
+		hosts := []string{"localhost", "127.0.0.1", api.configuration.ListeningAddress}
+		err := utils.GenerateSelfSignedCertificate(api.configuration.TLSCertificate, api.configuration.TLSKey, hosts)
+		if err != nil {
+			return err
+		}
+		api.logger.Info("Generated self-signed certificate", api.configuration.TLSCertificate)
+	}
+
+	fingerprint, err := utils.CertificateFingerprintFromFile(api.configuration.TLSCertificate)
+	if err != nil {
+		return err
+	}
+	api.logger.Info("TLS certificate SHA256 fingerprint (pin it in the agent configuration):", fingerprint)
 	return nil
 }
 
 // Start the api server
 func (api *APIServer) Run() {
-	var wait time.Duration = 5
+	var wait time.Duration = 5 * time.Second
 	// Run our server in a goroutine so that it doesn't block.
 	go func() {
-		if err := api.srv.ListenAndServe(); err != nil {
+		var err error
+		if api.configuration.TLSEnabled {
+			err = api.srv.ListenAndServeTLS(api.configuration.TLSCertificate, api.configuration.TLSKey)
+		} else {
+			err = api.srv.ListenAndServe()
+		}
+		if err != nil {
 			api.logger.Error(err.Error())
 		}
 	}()
@@ -141,6 +483,11 @@ func (api *APIServer) Run() {
 	// Doesn't block if no connections, but will otherwise wait
 	// until the timeout deadline.
 	api.srv.Shutdown(ctx)
+	//Save the messages the agents sent before the shutdown
+	err := api.pool.Stop(ctx)
+	if err != nil {
+		api.logger.Error("Could not save all the messages of the agents before shutting down,", err.Error())
+	}
 	// Optionally, you could run srv.Shutdown in a goroutine and block on
 	// <-ctx.Done() if your application should wait for other services
 	// to finalize based on context cancellation.
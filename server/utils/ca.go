@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The prefix of the common name of the certificates issued to the agents (followed by the agent id)
+const agentCommonNamePrefix = "agent-"
+
+// The number of days a certificate issued to an agent is valid
+const agentCertificateValidityDays = 365
+
+// This structure holds the certificate and the key of the certificate authority which signs the agent certificates
+type CertificateAuthority struct {
+	Certificate *x509.Certificate
+	key         crypto.Signer
+}
+
+// Generate a random serial number for a certificate
+func generateSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// Load the certificate authority from the PEM files, the files are generated if they do not exist
+func LoadCertificateAuthority(certPath string, keyPath string) (*CertificateAuthority, error) {
+	if !CheckFileExists(certPath) && !CheckFileExists(keyPath) {
+		err := generateCertificateAuthority(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	certData, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	certBlock, _ := pem.Decode(certData)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate found in " + certPath)
+	}
+	certificate, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyData)
+	if keyBlock == nil {
+		return nil, errors.New("no private key found in " + keyPath)
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertificateAuthority{Certificate: certificate, key: key}, nil
+}
+
+// Generate the self-signed certificate of the certificate authority and its private key
+func generateCertificateAuthority(certPath string, keyPath string) error {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serialNumber, err := generateSerialNumber()
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{Organization: []string{"ADTool"}, CommonName: "ADTool Agents CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+// Create a certificate pool containing the certificate authority (used to verify the client certificates)
+func (ca *CertificateAuthority) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate)
+	return pool
+}
+
+// Sign the PEM certificate signing request of an agent
+// The common name of the certificate encodes the id of the agent, the subject from the request is ignored
+// Returns the PEM certificate and the certificate itself
+func (ca *CertificateAuthority) SignAgentCertificate(csrPEM string, agentId int64) (string, *x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return "", nil, errors.New("invalid certificate signing request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return "", nil, err
+	}
+	//Check that the agent owns the private key
+	err = csr.CheckSignature()
+	if err != nil {
+		return "", nil, err
+	}
+
+	serialNumber, err := generateSerialNumber()
+	if err != nil {
+		return "", nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{Organization: []string{"ADTool"}, CommonName: agentCommonNamePrefix + strconv.FormatInt(agentId, 10)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 0, agentCertificateValidityDays),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, ca.Certificate, csr.PublicKey, ca.key)
+	if err != nil {
+		return "", nil, err
+	}
+	certificate, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})), certificate, nil
+}
+
+// Get the id of the agent from the common name of a certificate issued by the certificate authority
+func AgentIdFromCertificate(certificate *x509.Certificate) (int64, error) {
+	idString, found := strings.CutPrefix(certificate.Subject.CommonName, agentCommonNamePrefix)
+	if !found {
+		return -1, errors.New("the certificate was not issued to an agent")
+	}
+	return strconv.ParseInt(idString, 10, 64)
+}
@@ -1,6 +1,11 @@
 package utils
 
-import "os"
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+)
 
 // Check if the filepath is valid and exists on the disk
 func CheckFileExists(filePath string) bool {
@@ -11,3 +16,19 @@ func CheckFileExists(filePath string) bool {
 	//Return the result
 	return !os.IsNotExist(err)
 }
+
+// Generate a cryptographically secure random token encoded as hex
+func GenerateRandomToken(numBytes int) (string, error) {
+	buf := make([]byte, numBytes)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Hash a token using SHA256 so it can be stored and looked up in the database
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,26 +1,158 @@
 package websocket
 
 import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/gorilla/websocket"
 )
 
+// Error returned when a message is queued for an agent whose connection is closed
+var ErrAgentConnectionClosed = errors.New("agent connection closed")
+
+// The number of messages which can wait to be sent to an agent
+const agentSendBufferSize = 256
+
+// The maximum time a message can wait for a place in the queue of an agent and the maximum time a write can take
+const agentWriteWait = 10 * time.Second
+
+// The maximum time without a message or a pong from an agent, after it the connection is considered dead
+const agentPongWait = 60 * time.Second
+
+// How often a ping is sent to the agents (it must be less than the time the pong is waited for)
+const agentPingPeriod = (agentPongWait * 9) / 10
+
+// How often the last time an agent was seen is saved in the database while it is connected
+const agentLastSeenSaveInterval = 30 * time.Second
+
+// The maximum size of a message received from an agent
+const agentMaxMessageSize = 32 * 1024 * 1024
+
 /*
  * This structure will define a client that connected to the chat service.
  * Each client will have a unique id, a websocket connection that will be used to send and receive messages
  * The client structure will also have a pointer to the pool structure which will be used for conccurency
  */
 type DashboardClient struct {
-	Id     int64
-	Status string
-	Conn   *websocket.Conn
-	Pool   *Pool
+	Id         int64
+	Status     string
+	Conn       *websocket.Conn
+	Pool       *Pool
+	Username   string              //The operator the dashboard is authenticated as
+	Send       chan DashboardEvent //The events waiting to be sent to the dashboard
+	agentIds   map[int64]bool      //The agents the dashboard is subscribed to (all if empty)
+	eventTypes map[string]bool     //The event types the dashboard is subscribed to (all if empty)
 }
 
 type AgentClient struct {
-	Id     int64
-	Status string
-	Conn   *websocket.Conn
-	Pool   *Pool
+	Id            int64
+	Status        string
+	Conn          *websocket.Conn
+	Pool          *Pool
+	RemoteAddress string                //The address the agent connected from
+	connectedAt   time.Time             //When the agent connected, the commands sent before it were sent on a previous connection
+	send          chan WebSocketMessage //The messages waiting to be sent to the agent, only the writer goroutine writes on the connection
+	sendMutex     sync.RWMutex          //Held for reading while a message is queued and for writing when the queue is drained after the connection is closed
+	done          chan struct{}         //Closed when the connection is closed
+	registered    chan struct{}         //Closed by the pool goroutine when the agent is added to the pool
+	unregistered  chan struct{}         //Closed when the end of the connection is saved
+	previousEnded <-chan struct{}       //The unregistered channel of the previous connection of the agent (set before registered is closed, nil for the first connection)
+	closeOnce     sync.Once
+	closeReason   string       //Why the connection was closed (set once, before done is closed)
+	closedAt      time.Time    //When the connection was closed (set once, before done is closed)
+	lastSeen      atomic.Int64 //The last time a message or a pong was received (unix nanoseconds)
+	latency       atomic.Int64 //The round trip time of the last ping in nanoseconds (0 until a pong is received)
+	savedSeen     time.Time    //The last time saved in the database (used only by the reader)
+}
+
+func NewAgentClient(id int64, conn *websocket.Conn, pool *Pool, remoteAddress string) *AgentClient {
+	client := &AgentClient{Id: id, Status: "offline", Conn: conn, Pool: pool, RemoteAddress: remoteAddress, send: make(chan WebSocketMessage, agentSendBufferSize), done: make(chan struct{}), registered: make(chan struct{}), unregistered: make(chan struct{}), connectedAt: time.Now()}
+	client.lastSeen.Store(time.Now().UnixNano())
+	return client
+}
+
+// Queue a message for the agent
+// If the queue is full it waits for the writer, an agent which does not read its messages is disconnected
+func (c *AgentClient) Send(wsMsg WebSocketMessage) error {
+	//The queue is not drained while a message is added so a message is never lost after the connection is closed
+	c.sendMutex.RLock()
+	defer c.sendMutex.RUnlock()
+	select {
+	case <-c.done:
+		return ErrAgentConnectionClosed
+	default:
+	}
+	select {
+	case c.send <- wsMsg:
+		return nil
+	case <-c.done:
+		return ErrAgentConnectionClosed
+	default:
+	}
+	timer := time.NewTimer(agentWriteWait)
+	defer timer.Stop()
+	select {
+	case c.send <- wsMsg:
+		return nil
+	case <-c.done:
+		return ErrAgentConnectionClosed
+	case <-timer.C:
+		c.Pool.logger.Warning("Disconnected agent", c.Id, "because it does not read its messages")
+		c.CloseWithReason("the agent did not read its messages")
+		return ErrAgentConnectionClosed
+	}
+}
+
+// Close the connection, the read loop fails and unregisters the agent from the pool
+func (c *AgentClient) Close() {
+	c.CloseWithReason("closed by the server")
+}
+
+// Close the connection and save why it was closed, only the first reason is kept
+func (c *AgentClient) CloseWithReason(reason string) {
+	c.closeOnce.Do(func() {
+		c.closeReason = reason
+		c.closedAt = time.Now()
+		close(c.done)
+		c.Conn.Close()
+	})
+}
+
+// Get why the connection was closed (empty while it is open)
+func (c *AgentClient) DisconnectReason() string {
+	select {
+	case <-c.done:
+		return c.closeReason
+	default:
+		return ""
+	}
+}
+
+// Get when the connection was closed (zero while it is open)
+func (c *AgentClient) ClosedAt() time.Time {
+	select {
+	case <-c.done:
+		return c.closedAt
+	default:
+		return time.Time{}
+	}
+}
+
+// Describe why reading from the agent failed
+func readErrorReason(err error) string {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return "closed by the agent (" + strconv.Itoa(closeErr.Code) + ")"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "heartbeat timeout"
+	}
+	return "connection lost, " + err.Error()
 }
 
 /*
@@ -45,45 +177,137 @@ type AgentMessage struct {
  */
 func (c *AgentClient) Read() {
 	//Unregister a client when it disconnects from the server (this function will be called after the infinite loop)
+	//The database work of the registration and of the unregistration is done here so a slow database does not block the pool goroutine
 	defer func() {
-		c.Pool.UnregisterAgent <- c
-		c.Conn.Close()
+		c.Close()
+		c.Pool.AgentUnregistered(c)
 	}()
-	// c.Conn.SetReadLimit(maxMessageSize)
-	// c.Conn.SetReadDeadline(time.Now().Add(pongWait))
-	// c.Conn.SetPongHandler(func(string) error {
-	// 	c.Pool.logger.Debug("Received pong message from agent")
-	// 	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
-	// 	return nil
-	// })
+	<-c.registered
+	c.Pool.AgentRegistered(c)
+	c.Conn.SetReadLimit(agentMaxMessageSize)
+	c.seen(time.Now())
+	c.Conn.SetPongHandler(func(payload string) error {
+		now := time.Now()
+		//The payload of the ping is the time it was sent
+		if sentAt, err := strconv.ParseInt(payload, 10, 64); err == nil && sentAt <= now.UnixNano() {
+			c.latency.Store(now.UnixNano() - sentAt)
+		}
+		c.seen(now)
+		return nil
+	})
 	//Check if a message is received from the server
 	for {
 		//Read the message from the server
 		messageType, p, err := c.Conn.ReadMessage()
 		if err != nil {
 			c.Pool.logger.Error("Error occured when reading message from agent", c.Id, "on the websocket,", err.Error())
+			//If the server closed the connection its reason is kept
+			c.CloseWithReason(readErrorReason(err))
 			return
 		}
+		c.seen(time.Now())
 		//Create the message structure based on the message received from the client
 		message := AgentMessage{Type: messageType, Body: string(p), C: c}
-		//Send the message to the WS message handler
-		c.Pool.AgentBroadcast <- message
-	}
-}
-
-// func (c *AgentClient) Write() {
-// 	ticker := time.NewTicker(pingPeriod)
-// 	defer func() {
-// 		ticker.Stop()
-// 		c.Conn.Close()
-// 	}()
-
-// 	for ; ; <-ticker.C {
-// 		c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-// 		c.Pool.logger.Debug("Sent pong message to agent")
-// 		if err := c.Conn.WriteMessage(websocket.PingMessage, []byte("Test")); err != nil {
-// 			c.Pool.logger.Debug(err.Error())
-// 			return
-// 		}
-// 	}
-// }
+		//Handle the message in the goroutine of the agent, only the database writes are done in the background
+		c.Pool.AgentMessageReceived(message)
+	}
+}
+
+// The agent is alive, extend the read deadline and save the time it was seen (it is saved periodically in the database)
+func (c *AgentClient) seen(now time.Time) {
+	c.lastSeen.Store(now.UnixNano())
+	c.Conn.SetReadDeadline(now.Add(agentPongWait))
+	if now.Sub(c.savedSeen) < agentLastSeenSaveInterval {
+		return
+	}
+	first := c.savedSeen.IsZero()
+	c.savedSeen = now
+	//The time the agent connected is saved when it is registered
+	if !first {
+		c.Pool.saveAgentLastSeen(c.Id, now)
+	}
+}
+
+// Get the last time the agent was seen
+func (c *AgentClient) LastSeen() time.Time {
+	return time.Unix(0, c.lastSeen.Load())
+}
+
+// Get the round trip time of the last ping (0 if the agent did not answer a ping yet)
+func (c *AgentClient) Latency() time.Duration {
+	return time.Duration(c.latency.Load())
+}
+
+/*
+ * This function will send the messages queued for the agent, it is the only goroutine which writes on the connection
+ * It also sends the pings, the agent has to answer them before the read deadline
+ * It stops when the connection is closed or a write fails
+ */
+func (c *AgentClient) Write() {
+	ticker := time.NewTicker(agentPingPeriod)
+	//The message whose write failed could have not reached the agent
+	unsent := make([]WebSocketMessage, 0)
+	defer func() {
+		ticker.Stop()
+		c.Close()
+		c.drainQueue(unsent)
+	}()
+	for {
+		select {
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(agentWriteWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, []byte(strconv.FormatInt(time.Now().UnixNano(), 10))); err != nil {
+				c.Pool.logger.Error("Could not send ping to agent", c.Id, "on the websocket,", err.Error())
+				c.CloseWithReason("could not send a ping, " + err.Error())
+				return
+			}
+		case wsMsg := <-c.send:
+			c.Conn.SetWriteDeadline(time.Now().Add(agentWriteWait))
+			if err := c.Conn.WriteJSON(wsMsg); err != nil {
+				c.Pool.logger.Error("Could not send message to agent", c.Id, "on the websocket,", err.Error())
+				c.CloseWithReason("could not send a message, " + err.Error())
+				unsent = append(unsent, wsMsg)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Put back in the queue of the database the commands which were not sent before the connection was closed
+// It is called after the connection is closed so no message can be added to the queue after it is drained
+func (c *AgentClient) drainQueue(unsent []WebSocketMessage) {
+	c.sendMutex.Lock()
+	for len(c.send) > 0 {
+		unsent = append(unsent, <-c.send)
+	}
+	c.sendMutex.Unlock()
+
+	requeued := false
+	for _, wsMsg := range unsent {
+		requeued = c.requeueCommand(wsMsg) || requeued
+	}
+	//The agent could have reconnected before the commands were put back in the queue
+	if newer := c.Pool.getAgent(c.Id); requeued && newer != nil && newer != c {
+		c.Pool.flushQueuedCommands(newer)
+	}
+}
+
+// Mark a command which was not sent as queued, it is sent when the agent reconnects (true is returned if it was a command)
+func (c *AgentClient) requeueCommand(wsMsg WebSocketMessage) bool {
+	if wsMsg.Type != WsExecuteCommand {
+		return false
+	}
+	msg, ok := wsMsg.Data.(ExecuteCommandMessage)
+	if !ok {
+		return false
+	}
+	err := c.Pool.dbConn.RequeueCommand(c.Id, msg.Id)
+	if err != nil {
+		c.Pool.logger.Error("Could not put back in the queue command", msg.Id, "of agent", c.Id, err.Error())
+		return false
+	}
+	c.Pool.logger.Info("Put back in the queue command", msg.Id, "of agent", c.Id, "because the connection was closed before it was sent")
+	return true
+}
@@ -0,0 +1,130 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The types of the events published to the dashboards
+const (
+	DashboardEventAgentOnline        = "agent-online"         //The agent connected to the websocket
+	DashboardEventAgentOffline       = "agent-offline"        //The agent disconnected from the websocket
+	DashboardEventCommandSent        = "command-sent"         //A command was sent to the agent
+	DashboardEventCommandOutput      = "command-output"       //The result of a command was received from the agent
+	DashboardEventCommandOutputChunk = "command-output-chunk" //A part of the output of a running command was received from the agent
+	DashboardEventRecurringOutput    = "recurring-output"     //An output of a recurring command was received from the agent
+)
+
+var dashboardEventTypes = map[string]bool{
+	DashboardEventAgentOnline:        true,
+	DashboardEventAgentOffline:       true,
+	DashboardEventCommandSent:        true,
+	DashboardEventCommandOutput:      true,
+	DashboardEventCommandOutputChunk: true,
+	DashboardEventRecurringOutput:    true,
+}
+
+// The number of events which can wait to be sent to a dashboard, a dashboard which falls behind is disconnected
+const dashboardSendBufferSize = 256
+
+// The maximum time a write to a dashboard can take
+const dashboardWriteWait = 10 * time.Second
+
+// An event published to the dashboards
+type DashboardEvent struct {
+	Type      string      `json:"type"`           //The type of the event
+	AgentId   int64       `json:"agentId"`        //The agent the event is about
+	Timestamp time.Time   `json:"timestamp"`      //When the event happened
+	Data      interface{} `json:"data,omitempty"` //The details of the event (the command, the output etc.)
+}
+
+// The filters of a dashboard, an empty list means no filtering
+// The dashboard sends it as a JSON message to change the filters after connecting
+type DashboardSubscription struct {
+	AgentIds []int64  `json:"agentIds"` //Only the events of these agents
+	Events   []string `json:"events"`   //Only the events of these types
+}
+
+func (ds *DashboardSubscription) FromJSON(r io.Reader) error {
+	d := json.NewDecoder(r)
+	return d.Decode(ds)
+}
+
+// Check that all the event types of the subscription exist
+func (ds *DashboardSubscription) Validate() error {
+	for _, eventType := range ds.Events {
+		if !dashboardEventTypes[eventType] {
+			return fmt.Errorf("unknown event type %q", eventType)
+		}
+	}
+	return nil
+}
+
+// Create a new dashboard client with the filters of the subscription
+func NewDashboardClient(conn *websocket.Conn, pool *Pool, username string, subscription DashboardSubscription) *DashboardClient {
+	client := &DashboardClient{Conn: conn, Pool: pool, Status: "online", Username: username, Send: make(chan DashboardEvent, dashboardSendBufferSize)}
+	client.subscribe(subscription)
+	return client
+}
+
+// Replace the filters of the dashboard (only called from the pool goroutine)
+func (c *DashboardClient) subscribe(subscription DashboardSubscription) {
+	c.agentIds = make(map[int64]bool, len(subscription.AgentIds))
+	for _, agentId := range subscription.AgentIds {
+		c.agentIds[agentId] = true
+	}
+	c.eventTypes = make(map[string]bool, len(subscription.Events))
+	for _, eventType := range subscription.Events {
+		c.eventTypes[eventType] = true
+	}
+}
+
+// Check if the event passes the filters of the dashboard
+func (c *DashboardClient) matches(event DashboardEvent) bool {
+	if len(c.agentIds) != 0 && !c.agentIds[event.AgentId] {
+		return false
+	}
+	if len(c.eventTypes) != 0 && !c.eventTypes[event.Type] {
+		return false
+	}
+	return true
+}
+
+/*
+ * This function will wait for the subscription changes sent by the dashboard and forward them to the pool
+ */
+func (c *DashboardClient) Read() {
+	defer func() {
+		c.Pool.UnregisterDashboard <- c
+		c.Conn.Close()
+	}()
+	for {
+		messageType, p, err := c.Conn.ReadMessage()
+		if err != nil {
+			c.Pool.logger.Debug("Dashboard of", c.Username, "disconnected from the websocket,", err.Error())
+			return
+		}
+		c.Pool.DashboardBroadcast <- DashboardMessage{Type: messageType, Body: string(p), C: c}
+	}
+}
+
+/*
+ * This function will send the events published by the pool to the dashboard
+ * It stops when the pool closes the send channel
+ */
+func (c *DashboardClient) Write() {
+	defer c.Conn.Close()
+	for event := range c.Send {
+		c.Conn.SetWriteDeadline(time.Now().Add(dashboardWriteWait))
+		if err := c.Conn.WriteJSON(event); err != nil {
+			c.Pool.logger.Debug("Could not send event to the dashboard of", c.Username, err.Error())
+			return
+		}
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(dashboardWriteWait))
+	c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+}
@@ -0,0 +1,60 @@
+package websocket
+
+import "sync"
+
+// The number of events which can wait to be sent to a follower of a command, a follower which falls behind is dropped
+const commandFollowerBufferSize = 256
+
+// The followers of the commands which are running, they receive the output chunks and the final result
+type commandFollowers struct {
+	mutex     sync.Mutex
+	followers map[int64]map[chan DashboardEvent]bool //The channels of the followers of every command
+}
+
+// Start following a command, the returned function must be called to stop following it
+// The channel is closed after the result of the command is received or if the follower falls behind
+func (pool *Pool) FollowCommand(commandId int64) (<-chan DashboardEvent, func()) {
+	events := make(chan DashboardEvent, commandFollowerBufferSize)
+	pool.commandFollowers.mutex.Lock()
+	if pool.commandFollowers.followers[commandId] == nil {
+		pool.commandFollowers.followers[commandId] = make(map[chan DashboardEvent]bool)
+	}
+	pool.commandFollowers.followers[commandId][events] = true
+	pool.commandFollowers.mutex.Unlock()
+
+	stop := func() {
+		pool.commandFollowers.mutex.Lock()
+		defer pool.commandFollowers.mutex.Unlock()
+		pool.removeCommandFollower(commandId, events)
+	}
+	return events, stop
+}
+
+// Remove a follower and close its channel (the mutex must be held)
+func (pool *Pool) removeCommandFollower(commandId int64, events chan DashboardEvent) {
+	if !pool.commandFollowers.followers[commandId][events] {
+		return
+	}
+	delete(pool.commandFollowers.followers[commandId], events)
+	if len(pool.commandFollowers.followers[commandId]) == 0 {
+		delete(pool.commandFollowers.followers, commandId)
+	}
+	close(events)
+}
+
+// Send an event to the followers of a command, after the final event all the followers are removed
+func (pool *Pool) notifyCommandFollowers(commandId int64, event DashboardEvent, final bool) {
+	pool.commandFollowers.mutex.Lock()
+	defer pool.commandFollowers.mutex.Unlock()
+	for events := range pool.commandFollowers.followers[commandId] {
+		select {
+		case events <- event:
+			if final {
+				pool.removeCommandFollower(commandId, events)
+			}
+		default:
+			pool.logger.Warning("Dropped a follower of command", commandId, "because it fell behind")
+			pool.removeCommandFollower(commandId, events)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/lucacoratu/ADTool/server/database"
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+)
+
+// Save the connection of an agent in its history
+func (pool *Pool) recordAgentConnected(c *AgentClient) {
+	event := databaseModels.AgentConnectionEvent{AgentId: c.Id, Event: databaseModels.AgentConnectionConnected, RemoteAddress: c.RemoteAddress, Timestamp: time.Now()}
+	pool.persistence.enqueue(persistenceJob{
+		agentId: c.Id,
+		write: func(dbConn database.IConnection) error {
+			err := dbConn.SetAgentConnected(event.AgentId, event.Timestamp)
+			if err != nil {
+				return err
+			}
+			return dbConn.RegisterAgentConnectionEvent(event)
+		},
+		done: func(err error) {
+			if err != nil {
+				pool.logger.Error("Could not save the connection of agent", c.Id, err.Error())
+			}
+		},
+	})
+}
+
+// Save the disconnection of an agent in its history
+func (pool *Pool) recordAgentDisconnected(c *AgentClient, reason string) {
+	if reason == "" {
+		reason = "unknown"
+	}
+	lastSeen := c.LastSeen()
+	event := databaseModels.AgentConnectionEvent{AgentId: c.Id, Event: databaseModels.AgentConnectionDisconnected, RemoteAddress: c.RemoteAddress, Reason: reason, Timestamp: time.Now()}
+	pool.persistence.enqueue(persistenceJob{
+		agentId: c.Id,
+		write: func(dbConn database.IConnection) error {
+			err := dbConn.SetAgentDisconnected(event.AgentId, lastSeen, event.Timestamp)
+			if err != nil {
+				return err
+			}
+			return dbConn.RegisterAgentConnectionEvent(event)
+		},
+		done: func(err error) {
+			if err != nil {
+				pool.logger.Error("Could not save the disconnection of agent", c.Id, err.Error())
+			}
+		},
+	})
+}
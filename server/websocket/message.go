@@ -3,6 +3,7 @@ package websocket
 import (
 	"encoding/json"
 	"io"
+	"time"
 )
 
 // Message Types
@@ -12,6 +13,19 @@ const (
 	WsExecuteCommandResponse          int64 = 2
 	WsExecuteRecurringCommand         int64 = 3
 	WsExecuteRecurringCommandResponse int64 = 4
+	WsCommandStarted                  int64 = 5
+	WsCancelCommand                   int64 = 6
+	WsStopRecurringCommand            int64 = 7
+	WsUpdateRecurringCommand          int64 = 8
+	WsSyncRecurringCommands           int64 = 9
+	WsCommandOutputChunk              int64 = 10
+	WsShellOpen                       int64 = 11
+	WsShellInput                      int64 = 12
+	WsShellOutput                     int64 = 13
+	WsShellResize                     int64 = 14
+	WsShellClose                      int64 = 15
+	WsRecurringCommandFailed          int64 = 16
+	WsRunningCommands                 int64 = 17
 )
 
 // WebSocket message format
@@ -33,11 +47,17 @@ func (wsm *WebSocketMessage) ToJSON(w io.Writer) error {
 type ExecuteCommandMessage struct {
 	Id      int64  `json:"id"`
 	Command string `json:"command"`
+	Timeout int64  `json:"timeout"` //The number of seconds after which the agent kills the command (0 means no timeout)
 }
 
 type ExecuteCommandResponse struct {
-	Id     int64  `json:"id"`
-	Output string `json:"output"`
+	Id               int64  `json:"id"`
+	Output           string `json:"output"`           //The standard output of the command
+	Stderr           string `json:"stderr"`           //The standard error of the command
+	ExitCode         int    `json:"exitCode"`         //The exit code of the command (-1 if it could not be started)
+	Status           string `json:"status"`           //The final status of the command (succeeded, failed, timed-out or cancelled)
+	Chunks           int64  `json:"chunks"`           //The number of output chunks the agent streamed before the response (the output of the response is what could not be streamed)
+	OutputIncomplete bool   `json:"outputIncomplete"` //If the agent dropped output because it could not send it for too long
 }
 
 func (ecr *ExecuteCommandResponse) FromJSON(r io.Reader) error {
@@ -46,7 +66,99 @@ func (ecr *ExecuteCommandResponse) FromJSON(r io.Reader) error {
 }
 
 type ExecuteRecurringCommandMessage struct {
+	Id       int64      `json:"id"`
+	Command  string     `json:"command"`
+	Interval int64      `json:"interval"`
+	Schedule string     `json:"schedule,omitempty"` //The cron expression or @every schedule used instead of the interval
+	LastRun  *time.Time `json:"lastRun,omitempty"`  //When the command last ran (or was created if it never ran), used by the agent to detect missed scheduled runs
+}
+
+// Message sent by the agent when it starts executing a command
+type CommandStartedMessage struct {
+	Id int64 `json:"id"`
+}
+
+// Message sent to the agent to kill a running command
+type CancelCommandMessage struct {
+	Id int64 `json:"id"`
+}
+
+// Message sent by the agent after each execution of a recurring command
+type RecurringCommandOutputMessage struct {
+	Id        int64     `json:"id"`
+	Output    string    `json:"output"`    //The standard output of the command
+	Timestamp time.Time `json:"timestamp"` //When the agent executed the command
+}
+
+// Message sent by the agent when an execution of a recurring command produced no output (it failed, timed out or was killed)
+type RecurringCommandFailedMessage struct {
+	Id        int64     `json:"id"`
+	Status    string    `json:"status"`    //The final status of the execution
+	Timestamp time.Time `json:"timestamp"` //When the agent executed the command
+}
+
+// Message sent to the agent to stop a recurring command (when it is paused or deleted)
+type StopRecurringCommandMessage struct {
+	Id int64 `json:"id"`
+}
+
+// Message sent to the agent to change the interval or the schedule of a recurring command
+type UpdateRecurringCommandMessage struct {
 	Id       int64  `json:"id"`
-	Command  string `json:"command"`
 	Interval int64  `json:"interval"`
+	Schedule string `json:"schedule,omitempty"`
+}
+
+// Message sent to the agent when it connects with all the recurring commands it should execute
+// The agent stops the recurring commands which are not in the list
+type SyncRecurringCommandsMessage struct {
+	RecurringCommands []ExecuteRecurringCommandMessage `json:"recurringCommands"`
+}
+
+// Message sent by the agent after it connects with the commands it is executing
+// The commands sent on a previous connection which are not in the list were lost by the agent
+type RunningCommandsMessage struct {
+	Ids []int64 `json:"ids"`
+}
+
+// Output stream names of the chunks
+const (
+	OutputStreamStdout string = "stdout"
+	OutputStreamStderr string = "stderr"
+)
+
+// A part of the output of a running command, the chunks of a command are numbered from 1 in the order they were produced
+type CommandOutputChunkMessage struct {
+	Id       int64  `json:"id"`       //The id of the command
+	Sequence int64  `json:"sequence"` //The position of the chunk in the output of the command
+	Stream   string `json:"stream"`   //stdout or stderr
+	Data     string `json:"data"`     //The output
+}
+
+// Message sent to the agent to start an interactive shell session
+type ShellOpenMessage struct {
+	SessionId   string `json:"sessionId"`
+	Rows        uint16 `json:"rows"`
+	Cols        uint16 `json:"cols"`
+	IdleTimeout int64  `json:"idleTimeout"` //The number of seconds without input or output after which the agent closes the session
+}
+
+// The input typed by the operator or the output of a shell session
+type ShellDataMessage struct {
+	SessionId string `json:"sessionId"`
+	Data      string `json:"data"`
+}
+
+// Message sent to the agent when the terminal of the operator is resized
+type ShellResizeMessage struct {
+	SessionId string `json:"sessionId"`
+	Rows      uint16 `json:"rows"`
+	Cols      uint16 `json:"cols"`
+}
+
+// Message sent to the agent to close a shell session or received when the shell session ended
+type ShellCloseMessage struct {
+	SessionId string `json:"sessionId"`
+	Reason    string `json:"reason"`   //Why the session was closed
+	ExitCode  int    `json:"exitCode"` //The exit code of the shell (-1 if it was killed or could not be started)
 }
@@ -0,0 +1,231 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucacoratu/ADTool/server/database"
+	"github.com/lucacoratu/ADTool/server/logging"
+	"github.com/lucacoratu/ADTool/server/models"
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+)
+
+// The number of workers which save the messages of the agents in the database
+// The messages of an agent are always saved by the same worker so they are saved in the order they were received
+const persistenceWorkers = 8
+
+// The number of writes which can wait for a worker, when the queue is full the agents assigned to the worker wait (their messages are not read)
+const persistenceQueueSize = 256
+
+// The maximum number of writes a worker takes from its queue at once
+const persistenceBatchSize = 64
+
+// Error passed to the callback of a write which was queued after the pipeline was stopped
+var errPersistenceStopped = errors.New("the server is shutting down")
+
+// A write in the database
+type persistenceJob struct {
+	agentId         int64
+	write           func(dbConn database.IConnection) error     //The query (nil for the outputs of the recurring commands)
+	recurringOutput *databaseModels.AgentRecurringCommandOutput //The output of a recurring command, the outputs of a batch are saved in one transaction
+	done            func(err error)                             //Called after the write (ex. to publish the result to the dashboards), can be nil
+}
+
+/*
+ * This structure saves the messages of the agents in the database in the background
+ * The reader of an agent only waits for the database when the queue of its worker is full
+ */
+type persistencePipeline struct {
+	queues       []chan persistenceJob
+	dbConn       database.IConnection
+	logger       logging.ILogger
+	enqueued     atomic.Int64
+	written      atomic.Int64
+	failed       atomic.Int64
+	batches      atomic.Int64
+	largestBatch atomic.Int64
+	batchNanos   atomic.Int64 //The total time spent writing the batches
+	blocked      atomic.Int64
+	blockedNanos atomic.Int64 //The total time the agents waited for a place in the queues
+	stopMutex    sync.RWMutex //Held for reading while a write is queued and for writing when the queues are closed
+	stopped      bool         //The queues are closed, the new writes are dropped
+	workers      sync.WaitGroup
+}
+
+func newPersistencePipeline(logger logging.ILogger, dbConn database.IConnection) *persistencePipeline {
+	pp := &persistencePipeline{queues: make([]chan persistenceJob, persistenceWorkers), dbConn: dbConn, logger: logger}
+	for i := range pp.queues {
+		pp.queues[i] = make(chan persistenceJob, persistenceQueueSize)
+	}
+	return pp
+}
+
+// Start the workers
+func (pp *persistencePipeline) start() {
+	for _, queue := range pp.queues {
+		pp.workers.Add(1)
+		go func(queue chan persistenceJob) {
+			defer pp.workers.Done()
+			pp.work(queue)
+		}(queue)
+	}
+}
+
+// Stop accepting writes and wait until the queued writes are saved, false is returned if the context is done first
+func (pp *persistencePipeline) stop(ctx context.Context) bool {
+	pp.stopMutex.Lock()
+	if !pp.stopped {
+		pp.stopped = true
+		for _, queue := range pp.queues {
+			close(queue)
+		}
+	}
+	pp.stopMutex.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		pp.workers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Queue a write, it waits if the queue of the worker of the agent is full
+func (pp *persistencePipeline) enqueue(job persistenceJob) {
+	pp.stopMutex.RLock()
+	defer pp.stopMutex.RUnlock()
+	if pp.stopped {
+		pp.finish(job, errPersistenceStopped)
+		return
+	}
+	queue := pp.queues[job.agentId%int64(len(pp.queues))]
+	pp.enqueued.Add(1)
+	select {
+	case queue <- job:
+		return
+	default:
+	}
+	//Back-pressure, the agent waits until the worker catches up
+	start := time.Now()
+	queue <- job
+	pp.blocked.Add(1)
+	pp.blockedNanos.Add(int64(time.Since(start)))
+}
+
+// Take the writes from the queue in batches until the queue is closed
+func (pp *persistencePipeline) work(queue chan persistenceJob) {
+	batch := make([]persistenceJob, 0, persistenceBatchSize)
+	for job := range queue {
+		batch = append(batch[:0], job)
+	collect:
+		for len(batch) < persistenceBatchSize {
+			select {
+			case job, ok := <-queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, job)
+			default:
+				break collect
+			}
+		}
+		pp.writeBatch(batch)
+	}
+}
+
+// Execute the writes of a batch
+// The queries are executed in order, the outputs of the recurring commands are saved together at the end
+func (pp *persistencePipeline) writeBatch(batch []persistenceJob) {
+	start := time.Now()
+	outputJobs := make([]persistenceJob, 0)
+	for _, job := range batch {
+		if job.recurringOutput != nil {
+			outputJobs = append(outputJobs, job)
+			continue
+		}
+		pp.finish(job, job.write(pp.dbConn))
+	}
+	if len(outputJobs) > 0 {
+		pp.writeRecurringOutputs(outputJobs)
+	}
+
+	pp.batches.Add(1)
+	pp.batchNanos.Add(int64(time.Since(start)))
+	for size := int64(len(batch)); ; {
+		largest := pp.largestBatch.Load()
+		if size <= largest || pp.largestBatch.CompareAndSwap(largest, size) {
+			break
+		}
+	}
+}
+
+// Save the outputs of the recurring commands in one transaction
+// If the transaction fails the outputs are saved one by one, the output which failed does not discard the outputs of the other agents
+func (pp *persistencePipeline) writeRecurringOutputs(outputJobs []persistenceJob) {
+	outputs := make([]databaseModels.AgentRecurringCommandOutput, len(outputJobs))
+	for i, job := range outputJobs {
+		outputs[i] = *job.recurringOutput
+	}
+	saved, err := pp.dbConn.RegisterRecurringCommandOutputs(outputs)
+	if err != nil && len(outputJobs) > 1 {
+		pp.logger.Warning("Could not save a batch of", len(outputJobs), "recurring command outputs, saving them one by one,", err.Error())
+		for _, job := range outputJobs {
+			pp.writeRecurringOutputs([]persistenceJob{job})
+		}
+		return
+	}
+	for i, job := range outputJobs {
+		if err == nil && !saved[i] {
+			pp.finish(job, database.ErrRecordNotFound)
+			continue
+		}
+		pp.finish(job, err)
+	}
+}
+
+// Count the result of a write and call its callback
+func (pp *persistencePipeline) finish(job persistenceJob, err error) {
+	if err != nil {
+		pp.failed.Add(1)
+	} else {
+		pp.written.Add(1)
+	}
+	if job.done != nil {
+		job.done(err)
+	}
+}
+
+// Get the metrics of the pipeline
+func (pp *persistencePipeline) metrics() models.PersistenceMetrics {
+	metrics := models.PersistenceMetrics{
+		Workers:             len(pp.queues),
+		QueueCapacity:       len(pp.queues) * persistenceQueueSize,
+		Enqueued:            pp.enqueued.Load(),
+		Written:             pp.written.Load(),
+		Failed:              pp.failed.Load(),
+		Batches:             pp.batches.Load(),
+		LargestBatch:        pp.largestBatch.Load(),
+		BlockedEnqueues:     pp.blocked.Load(),
+		BlockedMilliseconds: float64(pp.blockedNanos.Load()) / float64(time.Millisecond),
+	}
+	for _, queue := range pp.queues {
+		metrics.Queued += len(queue)
+	}
+	if metrics.Batches != 0 {
+		metrics.AverageBatchMilliseconds = float64(pp.batchNanos.Load()) / float64(metrics.Batches) / float64(time.Millisecond)
+	}
+	return metrics
+}
+
+// Get the metrics of the database writes of the agent messages
+func (pool *Pool) PersistenceMetrics() models.PersistenceMetrics {
+	return pool.persistence.metrics()
+}
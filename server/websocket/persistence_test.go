@@ -0,0 +1,99 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucacoratu/ADTool/server/database"
+	"github.com/lucacoratu/ADTool/server/logging"
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+)
+
+// The database used by the pipeline in the tests, the transactions which have an output of an invalid command fail
+type fakeOutputsConnection struct {
+	database.IConnection
+	mutex        sync.Mutex
+	transactions int
+	saved        []int64 //The commands of the saved outputs
+}
+
+func (foc *fakeOutputsConnection) RegisterRecurringCommandOutputs(outputs []databaseModels.AgentRecurringCommandOutput) ([]bool, error) {
+	//The workers are slow so the outputs are batched
+	time.Sleep(10 * time.Millisecond)
+	foc.mutex.Lock()
+	defer foc.mutex.Unlock()
+	foc.transactions++
+	for _, output := range outputs {
+		if output.RecurringCommandId < 0 {
+			return nil, errors.New("invalid command")
+		}
+	}
+	saved := make([]bool, len(outputs))
+	for i, output := range outputs {
+		foc.saved = append(foc.saved, output.RecurringCommandId)
+		saved[i] = true
+	}
+	return saved, nil
+}
+
+func TestPersistenceSavesTheOtherOutputsOfAFailedBatchAndDrainsOnStop(t *testing.T) {
+	dbConn := &fakeOutputsConnection{}
+	pp := newPersistencePipeline(&logging.Logger{InternalLogger: log.New(io.Discard, "", 0)}, dbConn)
+	pp.start()
+
+	//The agents have the same worker so their outputs are saved in the same batches
+	var resultsMutex sync.Mutex
+	results := make(map[int64]error)
+	for i := int64(1); i <= 50; i++ {
+		commandId := i
+		if i == 25 {
+			commandId = -i
+		}
+		output := databaseModels.AgentRecurringCommandOutput{AgentId: i * persistenceWorkers, RecurringCommandOutput: databaseModels.RecurringCommandOutput{RecurringCommandId: commandId, Output: "output"}}
+		pp.enqueue(persistenceJob{
+			agentId:         output.AgentId,
+			recurringOutput: &output,
+			done: func(err error) {
+				resultsMutex.Lock()
+				results[commandId] = err
+				resultsMutex.Unlock()
+			},
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if !pp.stop(ctx) {
+		t.Fatal("the queued outputs were not saved before the timeout")
+	}
+	//The writes queued after the pipeline stopped are dropped
+	var droppedErr error
+	pp.enqueue(persistenceJob{agentId: 1, write: func(dbConn database.IConnection) error { return nil }, done: func(err error) { droppedErr = err }})
+	if !errors.Is(droppedErr, errPersistenceStopped) {
+		t.Errorf("write after stop: got %v, want %v", droppedErr, errPersistenceStopped)
+	}
+
+	if len(results) != 50 {
+		t.Fatalf("%d outputs finished, want 50", len(results))
+	}
+	for commandId, err := range results {
+		if commandId < 0 && err == nil {
+			t.Errorf("the output of invalid command %d was saved", commandId)
+		}
+		if commandId > 0 && err != nil {
+			t.Errorf("the output of command %d was not saved: %v", commandId, err)
+		}
+	}
+	if len(dbConn.saved) != 49 {
+		t.Errorf("%d outputs were saved, want 49", len(dbConn.saved))
+	}
+	//The batch with the invalid output fails and its outputs are saved one by one
+	if dbConn.transactions <= 50 {
+		t.Errorf("%d transactions were used, the failed batch was not saved one output at a time", dbConn.transactions)
+	}
+}
@@ -1,49 +1,162 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/lucacoratu/ADTool/server/database"
 	"github.com/lucacoratu/ADTool/server/logging"
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
 )
 
+// Error returned when a message is sent to an agent which is not connected to the websocket
+var ErrAgentNotConnected = errors.New("agent not connected")
+
 /*
  * This structure will handle concurrent connections using channels
  * Each channel will have a particular functionality
  */
 type Pool struct {
-	RegisterAgent   chan *AgentClient     //Channel which will handle new agent connections
-	UnregisterAgent chan *AgentClient     //Channgel which will handle agent client disconnecting
-	AgentClients    map[*AgentClient]bool //A map of dashboard client connections and associated state of the connection (true for online)
-	AgentBroadcast  chan AgentMessage     //Channel which will be used to handle a message from the agent
-	logger          logging.ILogger       //The logger
-	dbConn          database.IConnection  //The database connection
+	RegisterAgent       chan *AgentClient         //Channel which will handle new agent connections
+	agents              map[int64]*AgentClient    //The connected agents by id, it is used by the handlers and the pool goroutine
+	lastConnections     map[int64]chan struct{}   //The unregistered channel of the last connection of every agent, a connection is saved after the end of the previous one
+	agentsMutex         sync.RWMutex              //Protects the agents index and the last connections
+	RegisterDashboard   chan *DashboardClient     //Channel which will handle new dashboard connections
+	UnregisterDashboard chan *DashboardClient     //Channel which will handle dashboard clients disconnecting
+	DashboardClients    map[*DashboardClient]bool //A map of the connected dashboards
+	DashboardBroadcast  chan DashboardMessage     //Channel which will be used to handle a subscription change from a dashboard
+	DashboardEvents     chan DashboardEvent       //Channel of the events which are published to the dashboards
+	commandFollowers    commandFollowers          //The followers of the output of the running commands
+	shellSessions       shellSessions             //The interactive shell sessions which are open
+	persistence         *persistencePipeline      //Saves the messages of the agents in the database in the background
+	logger              logging.ILogger           //The logger
+	dbConn              database.IConnection      //The database connection
 }
 
+// The number of events which can wait to be published to the dashboards
+const dashboardEventsBufferSize = 1024
+
+// Why the commands the agent lost while it was disconnected failed (it is saved in their standard error)
+const unreportedCommandReason = "the agent did not report the command after it reconnected"
+
 /*
  * This function will create a new pool that can then be used when starting the chat service
  */
 func NewPool(l logging.ILogger, dbConn database.IConnection) *Pool {
 	return &Pool{
-		RegisterAgent:   make(chan *AgentClient),
-		UnregisterAgent: make(chan *AgentClient),
-		AgentClients:    make(map[*AgentClient]bool),
-		AgentBroadcast:  make(chan AgentMessage),
-		logger:          l,
-		dbConn:          dbConn,
+		RegisterAgent:       make(chan *AgentClient),
+		agents:              make(map[int64]*AgentClient),
+		lastConnections:     make(map[int64]chan struct{}),
+		RegisterDashboard:   make(chan *DashboardClient),
+		UnregisterDashboard: make(chan *DashboardClient),
+		DashboardClients:    make(map[*DashboardClient]bool),
+		DashboardBroadcast:  make(chan DashboardMessage),
+		DashboardEvents:     make(chan DashboardEvent, dashboardEventsBufferSize),
+		commandFollowers:    commandFollowers{followers: make(map[int64]map[chan DashboardEvent]bool)},
+		shellSessions:       shellSessions{sessions: make(map[string]*ShellSession), reserved: make(map[int64]int)},
+		persistence:         newPersistencePipeline(l, dbConn),
+		logger:              l,
+		dbConn:              dbConn,
 	}
 }
 
+// Save the connection of the agent and send it its commands
+// It is called by the reader of the agent so the pool goroutine does not wait for the database
 func (pool *Pool) AgentRegistered(c *AgentClient) {
-	c.Status = "online"
 	pool.logger.Info("Agent connected to websocket, id:", c.Id)
+	//The end of the previous connection is saved before the new connection so the history stays in order
+	if c.previousEnded != nil {
+		<-c.previousEnded
+	}
+	pool.recordAgentConnected(c)
+	pool.publishDashboardEvent(DashboardEventAgentOnline, c.Id, nil)
+	pool.flushQueuedCommands(c)
+	pool.syncRecurringCommands(c)
+}
+
+// Send the recurring commands which are active in the database, the agent reconciles its running commands with them
+func (pool *Pool) syncRecurringCommands(c *AgentClient) {
+	recurringCommands, err := pool.dbConn.GetAgentRecurringCommands(c.Id)
+	if err != nil {
+		pool.logger.Error("Could not get the recurring commands of agent", c.Id, err.Error())
+		return
+	}
+	msg := SyncRecurringCommandsMessage{RecurringCommands: make([]ExecuteRecurringCommandMessage, 0)}
+	for _, recurringCommand := range recurringCommands {
+		if recurringCommand.Paused {
+			continue
+		}
+		//A command which never ran has missed the runs scheduled since it was created
+		lastRun := recurringCommand.LastRun
+		if lastRun == nil {
+			lastRun = &recurringCommand.StartTime
+		}
+		msg.RecurringCommands = append(msg.RecurringCommands, ExecuteRecurringCommandMessage{Id: recurringCommand.Id, Command: recurringCommand.Command, Interval: recurringCommand.Interval, Schedule: recurringCommand.Schedule, LastRun: lastRun})
+	}
+	err = c.Send(WebSocketMessage{Type: WsSyncRecurringCommands, Data: msg})
+	if err != nil {
+		pool.logger.Error("Could not send the recurring commands to agent", c.Id, err.Error())
+	}
+}
+
+// Send the commands which were queued while the agent was offline, in the order they were created
+func (pool *Pool) flushQueuedCommands(c *AgentClient) {
+	expired, err := pool.dbConn.ExpirePendingCommands(c.Id)
+	if err != nil {
+		pool.logger.Error("Could not expire the queued commands of agent", c.Id, err.Error())
+		return
+	}
+	if expired > 0 {
+		pool.logger.Info("Expired", expired, "queued commands of agent", c.Id)
+	}
+
+	commands, err := pool.dbConn.GetPendingCommands(c.Id)
+	if err != nil {
+		pool.logger.Error("Could not get the queued commands of agent", c.Id, err.Error())
+		return
+	}
+	for _, command := range commands {
+		claimed, err := pool.dbConn.ClaimPendingCommand(c.Id, command.Id)
+		if err != nil {
+			pool.logger.Error("Could not claim queued command", command.Id, "of agent", c.Id, err.Error())
+			return
+		}
+		//The command was already sent by the handler which created it
+		if !claimed {
+			continue
+		}
+		msg := ExecuteCommandMessage{Id: command.Id, Command: command.Command, Timeout: command.Timeout}
+		err = c.Send(WebSocketMessage{Type: WsExecuteCommand, Data: msg})
+		if err != nil {
+			//The connection is broken, the remaining commands stay in the queue for the next connection
+			pool.logger.Error("Could not send queued command", command.Id, "to agent", c.Id, err.Error())
+			pool.dbConn.RequeueCommand(c.Id, command.Id)
+			return
+		}
+		pool.logger.Info("Sent queued command", command.Id, "to agent", c.Id)
+		pool.publishDashboardEvent(DashboardEventCommandSent, c.Id, msg)
+	}
 }
 
+// Save the end of the connection, it is called by the reader of the agent so the pool goroutine does not wait for the database
 func (pool *Pool) AgentUnregistered(c *AgentClient) {
+	defer close(c.unregistered)
+	removed := pool.removeAgent(c)
 	c.Status = "offline"
 	pool.logger.Info("Agent disconnected from websocket, id: ", c.Id)
+	pool.recordAgentDisconnected(c, c.DisconnectReason())
+	//The shells opened after the connection was closed belong to the new connection of the agent
+	if !removed {
+		//The agent reconnected, it is still online but the shells of the previous connection were killed by the agent
+		pool.closeAgentShellSessions(c.Id, c.ClosedAt(), "the agent reconnected")
+		return
+	}
+	pool.publishDashboardEvent(DashboardEventAgentOffline, c.Id, nil)
+	pool.closeAgentShellSessions(c.Id, c.ClosedAt(), "the agent disconnected")
 }
 
 /*
@@ -64,71 +177,384 @@ func (pool *Pool) AgentMessageReceived(message AgentMessage) {
 		return
 	}
 
+	//The database writes are done by the persistence pipeline so a slow query does not block the agents
+	agentId := message.C.Id
 	//Select the action based on the message type
 	switch wsMessage.Type {
 	case WsError:
 		pool.logger.Debug("Error message received")
+	case WsCommandStarted:
+		//Mark the command as running
+		marshaledData, _ := json.Marshal(wsMessage.Data)
+		started := CommandStartedMessage{}
+		json.Unmarshal(marshaledData, &started)
+		pool.persistence.enqueue(persistenceJob{
+			agentId: agentId,
+			write: func(dbConn database.IConnection) error {
+				return dbConn.SetCommandStatus(agentId, started.Id, databaseModels.CommandStatusRunning)
+			},
+			done: func(err error) {
+				if err != nil {
+					pool.logger.Error("Could not mark command", started.Id, "as running,", err.Error())
+				}
+			},
+		})
 	case WsExecuteCommandResponse:
-		//Save the command output in the database
+		//Save the command result in the database
 		marshaledData, _ := json.Marshal(wsMessage.Data)
 		resp := ExecuteCommandResponse{}
 		json.Unmarshal(marshaledData, &resp)
-		pool.dbConn.SetCommandOutput(resp.Id, resp.Output)
+		//Agents which do not send a valid status are handled based on the exit code
+		if !databaseModels.IsFinalCommandStatus(resp.Status) {
+			resp.Status = databaseModels.CommandStatusSucceeded
+			if resp.ExitCode != 0 {
+				resp.Status = databaseModels.CommandStatusFailed
+			}
+		}
+		pool.persistence.enqueue(persistenceJob{
+			agentId: agentId,
+			write: func(dbConn database.IConnection) error {
+				if resp.Chunks > 0 {
+					//The output was saved from the chunks, the response only has the output which could not be streamed
+					return dbConn.FinishStreamedCommand(agentId, resp.Id, resp.Status, resp.Output, resp.Stderr, resp.ExitCode, resp.Chunks, resp.OutputIncomplete)
+				}
+				return dbConn.SetCommandResult(agentId, resp.Id, resp.Status, resp.Output, resp.Stderr, resp.ExitCode, resp.OutputIncomplete)
+			},
+			done: func(err error) {
+				if err != nil {
+					pool.logger.Error("Could not save the result of command", resp.Id, err.Error())
+				}
+				pool.publishDashboardEvent(DashboardEventCommandOutput, agentId, resp)
+				pool.notifyCommandFollowers(resp.Id, DashboardEvent{Type: DashboardEventCommandOutput, AgentId: agentId, Timestamp: time.Now(), Data: resp}, true)
+			},
+		})
+	case WsRunningCommands:
+		//Fail the commands sent on a previous connection which the agent does not execute anymore, their results were lost
+		marshaledData, _ := json.Marshal(wsMessage.Data)
+		running := RunningCommandsMessage{}
+		json.Unmarshal(marshaledData, &running)
+		//The commands sent on this connection may not have reached the agent when it sent the message
+		//The time is truncated to the precision of the database so a command sent right after the connection is never failed
+		sentBefore := message.C.connectedAt.Truncate(time.Millisecond)
+		var failed []int64
+		pool.persistence.enqueue(persistenceJob{
+			agentId: agentId,
+			write: func(dbConn database.IConnection) error {
+				var err error
+				failed, err = dbConn.FailUnreportedCommands(agentId, running.Ids, sentBefore, unreportedCommandReason)
+				return err
+			},
+			done: func(err error) {
+				if err != nil {
+					pool.logger.Error("Could not fail the commands which agent", agentId, "lost,", err.Error())
+					return
+				}
+				for _, commandId := range failed {
+					pool.logger.Warning("Command", commandId, "of agent", agentId, "failed,", unreportedCommandReason)
+					resp := ExecuteCommandResponse{Id: commandId, Stderr: unreportedCommandReason, ExitCode: -1, Status: databaseModels.CommandStatusFailed}
+					pool.publishDashboardEvent(DashboardEventCommandOutput, agentId, resp)
+					pool.notifyCommandFollowers(commandId, DashboardEvent{Type: DashboardEventCommandOutput, AgentId: agentId, Timestamp: time.Now(), Data: resp}, true)
+				}
+			},
+		})
+	case WsCommandOutputChunk:
+		//Append the chunk to the output of the command
+		marshaledData, _ := json.Marshal(wsMessage.Data)
+		chunk := CommandOutputChunkMessage{}
+		json.Unmarshal(marshaledData, &chunk)
+		applied := false
+		pool.persistence.enqueue(persistenceJob{
+			agentId: agentId,
+			write: func(dbConn database.IConnection) error {
+				var err error
+				applied, err = dbConn.AppendCommandOutput(agentId, chunk.Id, chunk.Sequence, chunk.Stream, chunk.Data)
+				return err
+			},
+			done: func(err error) {
+				if err != nil {
+					pool.logger.Error("Could not save output chunk", chunk.Sequence, "of command", chunk.Id, err.Error())
+					return
+				}
+				if !applied {
+					pool.logger.Warning("Ignored duplicated or older output chunk", chunk.Sequence, "of command", chunk.Id, "from agent", agentId)
+					return
+				}
+				pool.publishDashboardEvent(DashboardEventCommandOutputChunk, agentId, chunk)
+				pool.notifyCommandFollowers(chunk.Id, DashboardEvent{Type: DashboardEventCommandOutputChunk, AgentId: agentId, Timestamp: time.Now(), Data: chunk}, false)
+			},
+		})
+	case WsShellOutput:
+		//Forward the output of the shell to the operator
+		marshaledData, _ := json.Marshal(wsMessage.Data)
+		dataMessage := ShellDataMessage{}
+		json.Unmarshal(marshaledData, &dataMessage)
+		pool.shellOutputReceived(agentId, dataMessage)
+	case WsShellClose:
+		//The shell session ended on the agent
+		marshaledData, _ := json.Marshal(wsMessage.Data)
+		closeMessage := ShellCloseMessage{}
+		json.Unmarshal(marshaledData, &closeMessage)
+		pool.shellClosedReceived(agentId, closeMessage)
 	case WsExecuteRecurringCommandResponse:
+		//Save the output of the recurring command in the database
 		marshaledData, _ := json.Marshal(wsMessage.Data)
-		resp := ExecuteCommandResponse{}
+		resp := RecurringCommandOutputMessage{}
 		json.Unmarshal(marshaledData, &resp)
-		pool.logger.Debug(resp)
+		//Agents which do not send the timestamp use the time the output was received
+		if resp.Timestamp.IsZero() {
+			resp.Timestamp = time.Now()
+		}
+		output := databaseModels.AgentRecurringCommandOutput{AgentId: agentId, RecurringCommandOutput: databaseModels.RecurringCommandOutput{RecurringCommandId: resp.Id, Output: resp.Output, Timestamp: resp.Timestamp}}
+		pool.persistence.enqueue(persistenceJob{
+			agentId:         agentId,
+			recurringOutput: &output,
+			done: func(err error) {
+				if err != nil {
+					pool.logger.Error("Could not save the output of recurring command", resp.Id, "from agent", agentId, err.Error())
+					return
+				}
+				pool.publishDashboardEvent(DashboardEventRecurringOutput, agentId, resp)
+			},
+		})
+	case WsRecurringCommandFailed:
+		//Save the run of the recurring command, it is used to detect the missed scheduled runs
+		marshaledData, _ := json.Marshal(wsMessage.Data)
+		failed := RecurringCommandFailedMessage{}
+		json.Unmarshal(marshaledData, &failed)
+		if failed.Timestamp.IsZero() {
+			failed.Timestamp = time.Now()
+		}
+		pool.persistence.enqueue(persistenceJob{
+			agentId: agentId,
+			write: func(dbConn database.IConnection) error {
+				return dbConn.SetRecurringCommandLastRun(agentId, failed.Id, failed.Timestamp)
+			},
+			done: func(err error) {
+				if err != nil {
+					pool.logger.Error("Could not save the failed run of recurring command", failed.Id, "from agent", agentId, err.Error())
+				}
+			},
+		})
+	}
+}
+
+// Publish an event to the dashboards which are subscribed to it
+// The event is dropped if too many events are waiting so the agents are never blocked by the dashboards
+func (pool *Pool) publishDashboardEvent(eventType string, agentId int64, data interface{}) {
+	event := DashboardEvent{Type: eventType, AgentId: agentId, Timestamp: time.Now(), Data: data}
+	select {
+	case pool.DashboardEvents <- event:
+	default:
+		pool.logger.Warning("Dropped dashboard event", eventType, "of agent", agentId, "because the queue is full")
+	}
+}
+
+// Send the event to every dashboard which is subscribed to it
+func (pool *Pool) dispatchDashboardEvent(event DashboardEvent) {
+	for client := range pool.DashboardClients {
+		if !client.matches(event) {
+			continue
+		}
+		select {
+		case client.Send <- event:
+		default:
+			//The dashboard does not keep up with the events, it has to reconnect and fetch the current state
+			pool.logger.Warning("Disconnected the dashboard of", client.Username, "because it fell behind")
+			pool.removeDashboard(client)
+		}
+	}
+}
+
+// Remove the dashboard from the pool and stop its writer
+func (pool *Pool) removeDashboard(client *DashboardClient) {
+	if _, found := pool.DashboardClients[client]; !found {
+		return
+	}
+	client.Status = "offline"
+	delete(pool.DashboardClients, client)
+	close(client.Send)
+	pool.logger.Info("Dashboard of", client.Username, "disconnected from websocket")
+}
+
+// Handle a subscription change sent by a dashboard
+func (pool *Pool) DashboardMessageReceived(message DashboardMessage) {
+	subscription := DashboardSubscription{}
+	err := subscription.FromJSON(strings.NewReader(message.Body))
+	if err == nil {
+		err = subscription.Validate()
+	}
+	if err != nil {
+		pool.logger.Debug("Invalid subscription received from the dashboard of", message.C.Username, err.Error())
+		return
 	}
+	message.C.subscribe(subscription)
 }
 
 /*
  * This function will start the pool which will handle client connections, client disconnections and broadcast messages
  */
 func (pool *Pool) Start() {
+	//Start the workers which save the messages of the agents
+	pool.persistence.start()
 	//Loop infinetly
 	for {
 		//Check what kind of event occured (connect, disconnect, broadcast message)
 		select {
 		case client := <-pool.RegisterAgent:
-			//Agent connected to the websocket
-			pool.AgentClients[client] = true
-			pool.logger.Debug("Size of agents connection pool", len(pool.AgentClients))
-			pool.AgentRegistered(client)
-
-		case client := <-pool.UnregisterAgent:
-			//Agent client disconnected from the websocket
-			pool.AgentUnregistered(client)
-			delete(pool.AgentClients, client)
-			pool.logger.Debug("Size of agents connection pool: ", len(pool.AgentClients))
-
-		case message := <-pool.AgentBroadcast:
-			//Message received from the agent on the websocket
-			pool.AgentMessageReceived(message)
+			//Agent connected to the websocket, the reader of the agent continues the registration
+			pool.addAgent(client)
+			close(client.registered)
+
+		case client := <-pool.RegisterDashboard:
+			//Dashboard connected to the websocket
+			pool.DashboardClients[client] = true
+			pool.logger.Info("Dashboard of", client.Username, "connected to websocket")
+
+		case client := <-pool.UnregisterDashboard:
+			//Dashboard disconnected from the websocket
+			pool.removeDashboard(client)
+
+		case message := <-pool.DashboardBroadcast:
+			//Subscription change received from the dashboard
+			pool.DashboardMessageReceived(message)
+
+		case event := <-pool.DashboardEvents:
+			//Event which has to be sent to the dashboards
+			pool.dispatchDashboardEvent(event)
 		}
 	}
 }
 
+// Add an agent to the index, the previous connection of the agent is closed if it did not disconnect yet
+func (pool *Pool) addAgent(client *AgentClient) {
+	pool.agentsMutex.Lock()
+	previous := pool.agents[client.Id]
+	pool.agents[client.Id] = client
+	client.previousEnded = pool.lastConnections[client.Id]
+	pool.lastConnections[client.Id] = client.unregistered
+	size := len(pool.agents)
+	pool.agentsMutex.Unlock()
+	client.Status = "online"
+	if previous != nil {
+		//The previous connection saves its end and closes its shells when its reader stops
+		pool.logger.Warning("Agent", client.Id, "reconnected, closing its previous connection")
+		previous.CloseWithReason("the agent reconnected")
+	}
+	pool.logger.Debug("Size of agents connection pool", size)
+}
+
+// Remove an agent from the index, false is returned if the agent already has a newer connection
+func (pool *Pool) removeAgent(client *AgentClient) bool {
+	pool.agentsMutex.Lock()
+	defer pool.agentsMutex.Unlock()
+	if pool.agents[client.Id] != client {
+		return false
+	}
+	delete(pool.agents, client.Id)
+	pool.logger.Debug("Size of agents connection pool: ", len(pool.agents))
+	return true
+}
+
+// Get the connection of an agent (nil if it is not connected)
+func (pool *Pool) getAgent(agentId int64) *AgentClient {
+	pool.agentsMutex.RLock()
+	defer pool.agentsMutex.RUnlock()
+	return pool.agents[agentId]
+}
+
+// Check if the agent is connected to the websocket
+func (pool *Pool) IsAgentConnected(agentId int64) bool {
+	return pool.getAgent(agentId) != nil
+}
+
+// Get the last time the agent was seen and the round trip time of its last ping, false is returned if it is not connected
+func (pool *Pool) AgentHeartbeat(agentId int64) (time.Time, time.Duration, bool) {
+	agent := pool.getAgent(agentId)
+	if agent == nil {
+		return time.Time{}, 0, false
+	}
+	return agent.LastSeen(), agent.Latency(), true
+}
+
+// Save the last time a connected agent was seen
+func (pool *Pool) saveAgentLastSeen(agentId int64, lastSeen time.Time) {
+	pool.persistence.enqueue(persistenceJob{
+		agentId: agentId,
+		write: func(dbConn database.IConnection) error {
+			return dbConn.SetAgentLastSeen(agentId, lastSeen)
+		},
+		done: func(err error) {
+			if err != nil {
+				pool.logger.Error("Could not save the last time agent", agentId, "was seen,", err.Error())
+			}
+		},
+	})
+}
+
+// Queue a message for the agent, ErrAgentNotConnected is returned if it is not connected
+func (pool *Pool) sendToAgent(agentId int64, wsMsg WebSocketMessage) error {
+	agent := pool.getAgent(agentId)
+	if agent == nil {
+		return ErrAgentNotConnected
+	}
+	return agent.Send(wsMsg)
+}
+
 // Function to request the agent to execute a command
-func (pool *Pool) SendExecuteCommandToAgent(agentId int64, commandId int64, command string) error {
-	for agent := range pool.AgentClients {
-		if agent.Id == agentId {
-			msg := ExecuteCommandMessage{Id: commandId, Command: command}
-			wsMsg := WebSocketMessage{Type: WsExecuteCommand, Data: msg}
-			return agent.Conn.WriteJSON(wsMsg)
-		}
+func (pool *Pool) SendExecuteCommandToAgent(agentId int64, commandId int64, command string, timeout int64) error {
+	msg := ExecuteCommandMessage{Id: commandId, Command: command, Timeout: timeout}
+	err := pool.sendToAgent(agentId, WebSocketMessage{Type: WsExecuteCommand, Data: msg})
+	if err == nil {
+		pool.publishDashboardEvent(DashboardEventCommandSent, agentId, msg)
 	}
-	return errors.New("agent not found")
+	return err
 }
 
 // Function to request the agent to execute a command
-func (pool *Pool) SendExecuteRecurringCommandToAgent(agentId int64, commandId int64, command string, interval int64) error {
-	for agent := range pool.AgentClients {
-		if agent.Id == agentId {
-			msg := ExecuteRecurringCommandMessage{Id: commandId, Command: command, Interval: interval}
-			wsMsg := WebSocketMessage{Type: WsExecuteRecurringCommand, Data: msg}
-			return agent.Conn.WriteJSON(wsMsg)
-		}
+func (pool *Pool) SendExecuteRecurringCommandToAgent(agentId int64, commandId int64, command string, interval int64, schedule string) error {
+	msg := ExecuteRecurringCommandMessage{Id: commandId, Command: command, Interval: interval, Schedule: schedule}
+	return pool.sendToAgent(agentId, WebSocketMessage{Type: WsExecuteRecurringCommand, Data: msg})
+}
+
+// Function to request the agent to kill a running command
+func (pool *Pool) SendCancelCommandToAgent(agentId int64, commandId int64) error {
+	return pool.sendToAgent(agentId, WebSocketMessage{Type: WsCancelCommand, Data: CancelCommandMessage{Id: commandId}})
+}
+
+// Function to request the agent to stop executing a recurring command
+func (pool *Pool) SendStopRecurringCommandToAgent(agentId int64, recurringCommandId int64) error {
+	return pool.sendToAgent(agentId, WebSocketMessage{Type: WsStopRecurringCommand, Data: StopRecurringCommandMessage{Id: recurringCommandId}})
+}
+
+// Function to request the agent to change the interval or the schedule of a recurring command
+func (pool *Pool) SendUpdateRecurringCommandToAgent(agentId int64, recurringCommandId int64, interval int64, schedule string) error {
+	wsMsg := WebSocketMessage{Type: WsUpdateRecurringCommand, Data: UpdateRecurringCommandMessage{Id: recurringCommandId, Interval: interval, Schedule: schedule}}
+	return pool.sendToAgent(agentId, wsMsg)
+}
+
+// Disconnect the agents and wait until the messages they sent are saved in the database
+// The messages received after the database writes are stopped are dropped
+func (pool *Pool) Stop(ctx context.Context) error {
+	pool.agentsMutex.RLock()
+	agents := make([]*AgentClient, 0, len(pool.agents))
+	for _, agent := range pool.agents {
+		agents = append(agents, agent)
+	}
+	pool.agentsMutex.RUnlock()
+	for _, agent := range agents {
+		agent.CloseWithReason("the server is shutting down")
+	}
+	if !pool.persistence.stop(ctx) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// Function to close the websocket connection of an agent (ex. when it is deleted or its certificate is revoked)
+// The read loop of the client will fail and unregister the agent from the pool
+func (pool *Pool) DisconnectAgent(agentId int64, reason string) {
+	agent := pool.getAgent(agentId)
+	if agent != nil {
+		agent.CloseWithReason(reason)
 	}
-	return errors.New("agent not found")
 }
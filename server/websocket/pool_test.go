@@ -0,0 +1,336 @@
+package websocket
+
+import (
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lucacoratu/ADTool/server/database"
+	"github.com/lucacoratu/ADTool/server/logging"
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+)
+
+// The database used by the pool in the tests, it keeps the status of the commands in memory
+// The methods which are not used by the pool are not implemented (they panic)
+type fakeConnection struct {
+	database.IConnection
+	mutex    sync.Mutex
+	commands map[int64]map[int64]string //The status of the commands of every agent
+	history  map[int64][]string         //The connection events of every agent in the order they were saved
+}
+
+func newFakeConnection() *fakeConnection {
+	return &fakeConnection{commands: make(map[int64]map[int64]string), history: make(map[int64][]string)}
+}
+
+func (fc *fakeConnection) addCommand(agentId int64, commandId int64) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	if fc.commands[agentId] == nil {
+		fc.commands[agentId] = make(map[int64]string)
+	}
+	fc.commands[agentId][commandId] = databaseModels.CommandStatusPending
+}
+
+func (fc *fakeConnection) setStatus(agentId int64, commandId int64, from string, to string) bool {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	if fc.commands[agentId][commandId] != from {
+		return false
+	}
+	fc.commands[agentId][commandId] = to
+	return true
+}
+
+func (fc *fakeConnection) ClaimPendingCommand(agentId int64, commandId int64) (bool, error) {
+	return fc.setStatus(agentId, commandId, databaseModels.CommandStatusPending, databaseModels.CommandStatusSent), nil
+}
+
+func (fc *fakeConnection) RequeueCommand(agentId int64, commandId int64) error {
+	fc.setStatus(agentId, commandId, databaseModels.CommandStatusSent, databaseModels.CommandStatusPending)
+	return nil
+}
+
+func (fc *fakeConnection) ExpirePendingCommands(agentId int64) (int64, error) {
+	return 0, nil
+}
+
+func (fc *fakeConnection) GetPendingCommands(agentId int64) ([]databaseModels.Command, error) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	commands := make([]databaseModels.Command, 0)
+	for commandId, status := range fc.commands[agentId] {
+		if status == databaseModels.CommandStatusPending {
+			commands = append(commands, databaseModels.Command{Id: commandId, AgentId: agentId, Command: "id"})
+		}
+	}
+	return commands, nil
+}
+
+func (fc *fakeConnection) GetAgentRecurringCommands(agentId int64) ([]databaseModels.RecurringCommand, error) {
+	return []databaseModels.RecurringCommand{{Id: agentId, Command: "uptime", Interval: 60}}, nil
+}
+
+func (fc *fakeConnection) SetAgentConnected(agentId int64, connectedAt time.Time) error {
+	return nil
+}
+
+func (fc *fakeConnection) SetAgentDisconnected(agentId int64, lastSeen time.Time, disconnectedAt time.Time) error {
+	return nil
+}
+
+func (fc *fakeConnection) SetAgentLastSeen(agentId int64, lastSeen time.Time) error {
+	return nil
+}
+
+func (fc *fakeConnection) RegisterAgentConnectionEvent(event databaseModels.AgentConnectionEvent) error {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.history[event.AgentId] = append(fc.history[event.AgentId], event.Event)
+	return nil
+}
+
+// Connect hundreds of agents (several connections for the same agent) while commands are sent to them and they are disconnected
+// A command can only stay marked as sent if the agent received it, the others must be put back in the queue
+// The connection history of every agent must alternate between connected and disconnected
+func TestPoolConcurrentAgents(t *testing.T) {
+	const agents = 100
+	const connectionsPerAgent = 3
+	const commandsPerConnection = 20
+
+	dbConn := newFakeConnection()
+	pool := NewPool(&logging.Logger{InternalLogger: log.New(io.Discard, "", 0)}, dbConn)
+	go pool.Start()
+
+	//The goroutines of the server side of the connections
+	var serverSide sync.WaitGroup
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		agentId, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		//The goroutines are counted before the agent knows it is connected
+		serverSide.Add(2)
+		ws, err := Upgrade(rw, r)
+		if err != nil {
+			serverSide.Add(-2)
+			return
+		}
+		client := NewAgentClient(agentId, ws, pool, r.RemoteAddr)
+		go func() {
+			defer serverSide.Done()
+			client.Write()
+		}()
+		pool.RegisterAgent <- client
+		go func() {
+			defer serverSide.Done()
+			client.Read()
+		}()
+	}))
+	defer server.Close()
+
+	//The commands received by the agents
+	var receivedMutex sync.Mutex
+	received := make(map[int64]bool)
+	var agentSide sync.WaitGroup
+	connect := func(agentId int64) {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?id="+strconv.FormatInt(agentId, 10), nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		agentSide.Add(1)
+		go func() {
+			defer agentSide.Done()
+			defer conn.Close()
+			//Only the server closes the connections so the agent reads every message which was written
+			for {
+				wsMsg := WebSocketMessage{}
+				if err := conn.ReadJSON(&wsMsg); err != nil {
+					return
+				}
+				if data, ok := wsMsg.Data.(map[string]interface{}); ok && wsMsg.Type == WsExecuteCommand {
+					receivedMutex.Lock()
+					received[int64(data["id"].(float64))] = true
+					receivedMutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	var nextCommandId atomic.Int64
+	var senders sync.WaitGroup
+	for agentId := int64(1); agentId <= agents; agentId++ {
+		for i := 0; i < connectionsPerAgent; i++ {
+			senders.Add(1)
+			go func(agentId int64, seed int64) {
+				defer senders.Done()
+				random := rand.New(rand.NewSource(seed))
+				connect(agentId)
+				for j := 0; j < commandsPerConnection; j++ {
+					//Send the command the same way as the handlers
+					commandId := nextCommandId.Add(1)
+					dbConn.addCommand(agentId, commandId)
+					if claimed, _ := dbConn.ClaimPendingCommand(agentId, commandId); claimed {
+						if err := pool.SendExecuteCommandToAgent(agentId, commandId, "id", 0); err != nil {
+							dbConn.RequeueCommand(agentId, commandId)
+						}
+					}
+					switch random.Intn(8) {
+					case 0:
+						pool.DisconnectAgent(agentId, "disconnected by the test")
+					case 1:
+						pool.SendCancelCommandToAgent(agentId, commandId)
+					case 2:
+						pool.SendStopRecurringCommandToAgent(agentId, agentId)
+					case 3:
+						pool.SendUpdateRecurringCommandToAgent(agentId, agentId, 30, "")
+					case 4:
+						pool.SendExecuteRecurringCommandToAgent(agentId, agentId, "uptime", 60, "")
+					case 5:
+						pool.IsAgentConnected(agentId)
+						pool.AgentHeartbeat(agentId)
+					}
+				}
+			}(agentId, agentId*connectionsPerAgent+int64(i))
+		}
+	}
+	senders.Wait()
+
+	//Disconnect the agents until every connection is closed
+	closed := make(chan struct{})
+	go func() {
+		serverSide.Wait()
+		close(closed)
+	}()
+	deadline := time.After(30 * time.Second)
+	for stop := false; !stop; {
+		for agentId := int64(1); agentId <= agents; agentId++ {
+			pool.DisconnectAgent(agentId, "the test ended")
+		}
+		select {
+		case <-closed:
+			stop = true
+		case <-deadline:
+			t.Fatal("the connections were not closed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	agentSide.Wait()
+	//Wait for the pool goroutine to handle the last registrations
+	pool.UnregisterDashboard <- &DashboardClient{}
+	//Wait for the connection history to be saved
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := pool.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for agentId := int64(1); agentId <= agents; agentId++ {
+		if pool.IsAgentConnected(agentId) {
+			t.Errorf("agent %d is still connected", agentId)
+		}
+	}
+	dbConn.mutex.Lock()
+	defer dbConn.mutex.Unlock()
+	receivedMutex.Lock()
+	defer receivedMutex.Unlock()
+	total := 0
+	for agentId, commands := range dbConn.commands {
+		for commandId, status := range commands {
+			total++
+			if status == databaseModels.CommandStatusSent && !received[commandId] {
+				t.Errorf("command %d of agent %d is marked as sent but the agent did not receive it", commandId, agentId)
+			}
+		}
+	}
+	for agentId := int64(1); agentId <= agents; agentId++ {
+		history := dbConn.history[agentId]
+		if len(history) != 2*connectionsPerAgent {
+			t.Errorf("agent %d has %d connection events, want %d", agentId, len(history), 2*connectionsPerAgent)
+		}
+		for i, event := range history {
+			want := databaseModels.AgentConnectionConnected
+			if i%2 == 1 {
+				want = databaseModels.AgentConnectionDisconnected
+			}
+			if event != want {
+				t.Errorf("agent %d: event %d of the history is %s, want %s %v", agentId, i, event, want, history)
+				break
+			}
+		}
+	}
+	if total != agents*connectionsPerAgent*commandsPerConnection {
+		t.Errorf("%d commands were created, want %d", total, agents*connectionsPerAgent*commandsPerConnection)
+	}
+}
+
+// The database used by the test of the commands lost by an agent, it fails the commands which are not reported
+type fakeUnreportedConnection struct {
+	database.IConnection
+	sent       []int64 //The commands sent on the previous connections which are not finished
+	reported   []int64
+	sentBefore time.Time
+}
+
+func (fuc *fakeUnreportedConnection) FailUnreportedCommands(agentId int64, reported []int64, sentBefore time.Time, reason string) ([]int64, error) {
+	fuc.reported, fuc.sentBefore = reported, sentBefore
+	failed := make([]int64, 0)
+	for _, commandId := range fuc.sent {
+		found := false
+		for _, reportedId := range reported {
+			found = found || reportedId == commandId
+		}
+		if !found {
+			failed = append(failed, commandId)
+		}
+	}
+	return failed, nil
+}
+
+func TestPoolFailsTheCommandsTheAgentDoesNotReport(t *testing.T) {
+	dbConn := &fakeUnreportedConnection{sent: []int64{1, 2, 3}}
+	pool := NewPool(&logging.Logger{InternalLogger: log.New(io.Discard, "", 0)}, dbConn)
+	pool.persistence.start()
+	client := NewAgentClient(1, nil, pool, "127.0.0.1")
+	lost, stopLost := pool.FollowCommand(2)
+	defer stopLost()
+	running, stopRunning := pool.FollowCommand(3)
+	defer stopRunning()
+
+	pool.AgentMessageReceived(AgentMessage{C: client, Body: `{"type":17,"data":{"ids":[1,3]}}`})
+	select {
+	case event := <-lost:
+		resp, ok := event.Data.(ExecuteCommandResponse)
+		if !ok || resp.Id != 2 || resp.Status != databaseModels.CommandStatusFailed || resp.Stderr != unreportedCommandReason {
+			t.Errorf("got the result %+v, want command 2 failed", event.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the followers of the lost command were not notified")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !pool.persistence.stop(ctx) {
+		t.Fatal("the writes were not finished before the timeout")
+	}
+	select {
+	case event := <-running:
+		t.Errorf("the follower of the running command received %+v", event)
+	default:
+	}
+	if len(dbConn.reported) != 2 || dbConn.reported[0] != 1 || dbConn.reported[1] != 3 {
+		t.Errorf("got the reported commands %v, want [1 3]", dbConn.reported)
+	}
+	//The commands sent on this connection are never failed, the agent may not have received them yet
+	if dbConn.sentBefore.After(client.connectedAt) || client.connectedAt.Sub(dbConn.sentBefore) >= time.Millisecond {
+		t.Errorf("commands sent before %s are failed, want the connection time %s", dbConn.sentBefore, client.connectedAt)
+	}
+}
@@ -0,0 +1,108 @@
+package websocket
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The types of the events saved in a recording (asciicast v2)
+const (
+	recordingEventOutput = "o" //The output of the shell
+	recordingEventInput  = "i" //The input of the operator
+	recordingEventResize = "r" //The terminal was resized ("COLSxROWS")
+	recordingEventMarker = "m" //A marker (the end of the session)
+)
+
+// The first line of an asciicast v2 recording
+type recordingHeader struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Saves the frames of a shell session in the asciicast v2 format (https://docs.asciinema.org/manual/asciicast/v2/)
+// Every event is written to the file when it happens so the recording is kept if the server stops
+type shellRecorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	started time.Time
+	size    int64 //The number of bytes which were written
+	failed  bool  //Set after a write failed, the rest of the events are not saved
+}
+
+// Get the name of the recording file of a session
+func RecordingFileName(sessionId string) string {
+	return sessionId + ".cast"
+}
+
+// Create the recording of a session in the directory and write the header
+func newShellRecorder(directory string, session *ShellSession, rows uint16, cols uint16) (*shellRecorder, error) {
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(directory, RecordingFileName(session.Id)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	recorder := &shellRecorder{file: file, started: session.CreatedAt}
+	header := recordingHeader{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: session.CreatedAt.Unix(),
+		Title:     "Agent " + strconv.FormatInt(session.AgentId, 10) + " - " + session.Username,
+		Env:       map[string]string{"TERM": "xterm-256color"},
+	}
+	line, _ := json.Marshal(header)
+	if err := recorder.write(line); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return recorder, nil
+}
+
+// Write a line in the recording (the mutex must be held, except while the recorder is created)
+func (sr *shellRecorder) write(line []byte) error {
+	n, err := sr.file.Write(append(line, '\n'))
+	sr.size += int64(n)
+	return err
+}
+
+// Save an event with the time elapsed since the session was opened
+func (sr *shellRecorder) record(eventType string, data string) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	if sr.failed || sr.file == nil {
+		return
+	}
+	elapsed := time.Since(sr.started).Seconds()
+	line, _ := json.Marshal([]interface{}{json.Number(strconv.FormatFloat(elapsed, 'f', 6, 64)), eventType, data})
+	if sr.write(line) != nil {
+		sr.failed = true
+	}
+}
+
+// Save the size of the terminal after it was resized
+func (sr *shellRecorder) recordResize(rows uint16, cols uint16) {
+	sr.record(recordingEventResize, strconv.Itoa(int(cols))+"x"+strconv.Itoa(int(rows)))
+}
+
+// Close the recording and get its size
+func (sr *shellRecorder) close() (int64, error) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	if sr.file == nil {
+		return sr.size, nil
+	}
+	err := sr.file.Close()
+	sr.file = nil
+	return sr.size, err
+}
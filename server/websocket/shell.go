@@ -0,0 +1,309 @@
+package websocket
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lucacoratu/ADTool/server/database"
+	databaseModels "github.com/lucacoratu/ADTool/server/models/database"
+)
+
+// Error returned when an agent already has the maximum number of shell sessions
+var ErrTooManyShellSessions = errors.New("too many shell sessions")
+
+// The maximum number of shell sessions which can be open on an agent at the same time
+const maxShellSessionsPerAgent = 8
+
+// The number of frames which can wait to be sent to the operator, an operator which falls behind is disconnected
+const shellSendBufferSize = 512
+
+// The maximum time a write to the operator can take
+const shellWriteWait = 10 * time.Second
+
+// The types of the frames exchanged with the terminal of the operator
+const (
+	ShellFrameInput  = "input"  //Operator -> server, the data typed in the terminal
+	ShellFrameResize = "resize" //Operator -> server, the new size of the terminal
+	ShellFrameClose  = "close"  //Operator -> server, close the session
+	ShellFrameOutput = "output" //Server -> operator, the output of the shell
+	ShellFrameClosed = "closed" //Server -> operator, the session ended (the reason and the exit code are set)
+)
+
+// A frame exchanged with the terminal of the operator
+type ShellFrame struct {
+	Type     string `json:"type"`
+	Data     string `json:"data,omitempty"`
+	Rows     uint16 `json:"rows,omitempty"`
+	Cols     uint16 `json:"cols,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	ExitCode int    `json:"exitCode,omitempty"`
+}
+
+// An interactive shell session between the browser of an operator and an agent
+type ShellSession struct {
+	Id        string
+	AgentId   int64
+	Username  string          //The operator who opened the session
+	CreatedAt time.Time       //When the session was opened
+	Conn      *websocket.Conn //The websocket connection of the operator
+	Pool      *Pool
+	send      chan ShellFrame //The frames waiting to be sent to the operator
+	recorder  *shellRecorder  //The recording of the input and the output of the session
+	mutex     sync.Mutex      //Protects the send channel after the session ended
+	closed    bool
+}
+
+// The shell sessions which are open, they are used from the handlers, the pool and the goroutines of the operators
+type shellSessions struct {
+	mutex    sync.Mutex
+	sessions map[string]*ShellSession
+	reserved map[int64]int //The number of sessions of every agent whose recording is being created (they count as open)
+}
+
+func NewShellSession(id string, agentId int64, username string, conn *websocket.Conn, pool *Pool) *ShellSession {
+	return &ShellSession{Id: id, AgentId: agentId, Username: username, CreatedAt: time.Now(), Conn: conn, Pool: pool, send: make(chan ShellFrame, shellSendBufferSize)}
+}
+
+// Queue a frame for the operator, false is returned if the operator does not keep up with the output
+func (ss *ShellSession) deliver(frame ShellFrame) bool {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if ss.closed {
+		return true
+	}
+	select {
+	case ss.send <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// Send the final frame to the operator and stop the writer
+func (ss *ShellSession) finish(frame ShellFrame) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if ss.closed {
+		return
+	}
+	ss.closed = true
+	select {
+	case ss.send <- frame:
+	default:
+	}
+	close(ss.send)
+}
+
+/*
+ * This function will read the frames sent by the terminal of the operator and forward them to the agent
+ */
+func (ss *ShellSession) Read() {
+	defer ss.Conn.Close()
+	for {
+		frame := ShellFrame{}
+		err := ss.Conn.ReadJSON(&frame)
+		if err != nil {
+			ss.Pool.CloseShellSession(ss.Id, "the operator disconnected", true)
+			return
+		}
+		switch frame.Type {
+		case ShellFrameInput:
+			ss.recorder.record(recordingEventInput, frame.Data)
+			err = ss.Pool.sendToAgent(ss.AgentId, WebSocketMessage{Type: WsShellInput, Data: ShellDataMessage{SessionId: ss.Id, Data: frame.Data}})
+		case ShellFrameResize:
+			if frame.Rows == 0 || frame.Cols == 0 {
+				continue
+			}
+			ss.recorder.recordResize(frame.Rows, frame.Cols)
+			err = ss.Pool.sendToAgent(ss.AgentId, WebSocketMessage{Type: WsShellResize, Data: ShellResizeMessage{SessionId: ss.Id, Rows: frame.Rows, Cols: frame.Cols}})
+		case ShellFrameClose:
+			//The session ends when the agent confirms the shell exited
+			err = ss.Pool.sendToAgent(ss.AgentId, WebSocketMessage{Type: WsShellClose, Data: ShellCloseMessage{SessionId: ss.Id, Reason: "closed by the operator"}})
+		}
+		if err != nil {
+			ss.Pool.CloseShellSession(ss.Id, "the agent disconnected", false)
+			return
+		}
+	}
+}
+
+/*
+ * This function will send the output of the shell to the terminal of the operator
+ * It stops after the session ended
+ */
+func (ss *ShellSession) Write() {
+	defer ss.Conn.Close()
+	for frame := range ss.send {
+		ss.Conn.SetWriteDeadline(time.Now().Add(shellWriteWait))
+		if err := ss.Conn.WriteJSON(frame); err != nil {
+			ss.Pool.logger.Debug("Could not send frame to the operator of shell session", ss.Id, err.Error())
+			return
+		}
+	}
+	ss.Conn.SetWriteDeadline(time.Now().Add(shellWriteWait))
+	ss.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// Register a shell session and ask the agent to start the shell
+// Every session is recorded in the directory, the session is not opened if the recording cannot be created
+func (pool *Pool) OpenShellSession(session *ShellSession, rows uint16, cols uint16, idleTimeout int64, recordingsDirectory string) error {
+	pool.shellSessions.mutex.Lock()
+	open := pool.shellSessions.reserved[session.AgentId]
+	for _, other := range pool.shellSessions.sessions {
+		if other.AgentId == session.AgentId {
+			open++
+		}
+	}
+	if open >= maxShellSessionsPerAgent {
+		pool.shellSessions.mutex.Unlock()
+		return ErrTooManyShellSessions
+	}
+	//The place of the session is reserved while the recording is created, the other sessions are not blocked by the file and the database
+	pool.shellSessions.reserved[session.AgentId]++
+	pool.shellSessions.mutex.Unlock()
+
+	//The recording is created before the session is registered so every frame of the session is saved
+	err := pool.startShellRecording(session, rows, cols, recordingsDirectory)
+
+	pool.shellSessions.mutex.Lock()
+	pool.shellSessions.reserved[session.AgentId]--
+	if pool.shellSessions.reserved[session.AgentId] == 0 {
+		delete(pool.shellSessions.reserved, session.AgentId)
+	}
+	if err == nil {
+		pool.shellSessions.sessions[session.Id] = session
+	}
+	pool.shellSessions.mutex.Unlock()
+	if err != nil {
+		pool.logger.Error("Could not start the recording of shell session", session.Id, err.Error())
+		return errors.New("could not start the recording of the session")
+	}
+
+	err = pool.sendToAgent(session.AgentId, WebSocketMessage{Type: WsShellOpen, Data: ShellOpenMessage{SessionId: session.Id, Rows: rows, Cols: cols, IdleTimeout: idleTimeout}})
+	if err != nil {
+		pool.CloseShellSession(session.Id, "the agent is not connected", false)
+		return err
+	}
+	pool.logger.Info("Operator", session.Username, "opened shell session", session.Id, "on agent", session.AgentId)
+	return nil
+}
+
+// Create the recording file of a session and save the session in the database
+func (pool *Pool) startShellRecording(session *ShellSession, rows uint16, cols uint16, recordingsDirectory string) error {
+	recorder, err := newShellRecorder(recordingsDirectory, session, rows, cols)
+	if err != nil {
+		return err
+	}
+	_, err = pool.dbConn.CreateShellSession(databaseModels.ShellSession{
+		SessionId: session.Id,
+		AgentId:   session.AgentId,
+		Username:  session.Username,
+		Rows:      rows,
+		Cols:      cols,
+		Recording: RecordingFileName(session.Id),
+		StartedAt: session.CreatedAt,
+	})
+	if err != nil {
+		recorder.close()
+		os.Remove(filepath.Join(recordingsDirectory, RecordingFileName(session.Id)))
+		return err
+	}
+	session.recorder = recorder
+	return nil
+}
+
+// Close the recording of a session which ended and save how it ended
+func (pool *Pool) finishShellRecording(session *ShellSession, frame ShellFrame) {
+	session.recorder.record(recordingEventMarker, frame.Reason)
+	size, err := session.recorder.close()
+	if err != nil {
+		pool.logger.Error("Could not close the recording of shell session", session.Id, err.Error())
+	}
+	//The exit code is not known if the shell was killed or could not be started
+	var exitCode *int
+	if frame.ExitCode >= 0 {
+		exitCode = &frame.ExitCode
+	}
+	endedAt := time.Now()
+	pool.persistence.enqueue(persistenceJob{
+		agentId: session.AgentId,
+		write: func(dbConn database.IConnection) error {
+			return dbConn.FinishShellSession(session.Id, frame.Reason, exitCode, size, endedAt)
+		},
+		done: func(err error) {
+			if err != nil {
+				pool.logger.Error("Could not save the end of shell session", session.Id, err.Error())
+			}
+		},
+	})
+}
+
+// Get an open shell session
+func (pool *Pool) getShellSession(sessionId string) *ShellSession {
+	pool.shellSessions.mutex.Lock()
+	defer pool.shellSessions.mutex.Unlock()
+	return pool.shellSessions.sessions[sessionId]
+}
+
+// End a shell session, the agent is asked to kill the shell if it is still running
+func (pool *Pool) CloseShellSession(sessionId string, reason string, notifyAgent bool) {
+	pool.endShellSession(sessionId, ShellFrame{Type: ShellFrameClosed, Reason: reason, ExitCode: -1}, notifyAgent)
+}
+
+// Remove the session and send the final frame to the operator
+func (pool *Pool) endShellSession(sessionId string, frame ShellFrame, notifyAgent bool) {
+	pool.shellSessions.mutex.Lock()
+	session, found := pool.shellSessions.sessions[sessionId]
+	delete(pool.shellSessions.sessions, sessionId)
+	pool.shellSessions.mutex.Unlock()
+	if !found {
+		return
+	}
+	if notifyAgent {
+		pool.sendToAgent(session.AgentId, WebSocketMessage{Type: WsShellClose, Data: ShellCloseMessage{SessionId: sessionId, Reason: frame.Reason}})
+	}
+	session.finish(frame)
+	pool.finishShellRecording(session, frame)
+	pool.logger.Info("Shell session", sessionId, "on agent", session.AgentId, "closed,", frame.Reason)
+}
+
+// End the shell sessions of an agent which were created before a time (ex. when the connection they were opened on ended)
+func (pool *Pool) closeAgentShellSessions(agentId int64, before time.Time, reason string) {
+	pool.shellSessions.mutex.Lock()
+	sessionIds := make([]string, 0)
+	for sessionId, session := range pool.shellSessions.sessions {
+		if session.AgentId == agentId && session.CreatedAt.Before(before) {
+			sessionIds = append(sessionIds, sessionId)
+		}
+	}
+	pool.shellSessions.mutex.Unlock()
+	for _, sessionId := range sessionIds {
+		pool.CloseShellSession(sessionId, reason, false)
+	}
+}
+
+// Forward the output of a shell to the operator
+func (pool *Pool) shellOutputReceived(agentId int64, dataMessage ShellDataMessage) {
+	session := pool.getShellSession(dataMessage.SessionId)
+	if session == nil || session.AgentId != agentId {
+		return
+	}
+	session.recorder.record(recordingEventOutput, dataMessage.Data)
+	if !session.deliver(ShellFrame{Type: ShellFrameOutput, Data: dataMessage.Data}) {
+		pool.logger.Warning("Closed shell session", session.Id, "because the operator fell behind")
+		pool.CloseShellSession(session.Id, "the terminal did not keep up with the output", true)
+	}
+}
+
+// The agent ended a shell session (the shell exited, it was idle or it could not be started)
+func (pool *Pool) shellClosedReceived(agentId int64, closeMessage ShellCloseMessage) {
+	session := pool.getShellSession(closeMessage.SessionId)
+	if session == nil || session.AgentId != agentId {
+		return
+	}
+	pool.endShellSession(session.Id, ShellFrame{Type: ShellFrameClosed, Reason: closeMessage.Reason, ExitCode: closeMessage.ExitCode}, false)
+}